@@ -0,0 +1,571 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// AgentX (RFC 2741) PDU types and the values the subagent uses.
+const (
+	agentxOpen      = 1
+	agentxClose     = 2
+	agentxRegister  = 3
+	agentxGet       = 5
+	agentxGetNext   = 6
+	agentxGetBulk   = 7
+	agentxTestSet   = 8
+	agentxCommitSet = 9
+	agentxUndoSet   = 10
+	agentxCleanup   = 11
+	agentxResponse  = 18
+
+	agentxNonDefaultContext = 0x08
+	agentxNetworkByteOrder  = 0x10
+
+	agentxNotWritable = 17
+	agentxGenError    = 5
+)
+
+// SNMP types of variable bindings.
+const (
+	snmpInteger        = 2
+	snmpOctetString    = 4
+	snmpGauge32        = 66
+	snmpUnsigned32     = 66 // same encoding as Gauge32
+	snmpNoSuchObject   = 128
+	snmpNoSuchInstance = 129
+	snmpEndOfMibView   = 130
+)
+
+// snmpAdminStringMax is the longest SnmpAdminString, the type of the owner
+// and test name in the index of pingResultsTable.
+const snmpAdminStringMax = 32
+
+// pingResultsEntry is pingResultsEntry of DISMAN-PING-MIB (RFC 4560). The
+// subagent serves its table with one row per target, indexed by the owner
+// given with -agentx-owner and the target address as the test name.
+var pingResultsEntry = oid{1, 3, 6, 1, 2, 1, 80, 1, 3, 1}
+
+// Columns of pingResultsEntry.
+const (
+	pingResultsOperStatus          = 1 // enabled(1)
+	pingResultsIpTargetAddressType = 2 // InetAddressType
+	pingResultsIpTargetAddress     = 3 // InetAddress
+	pingResultsMinRtt              = 4 // milliseconds
+	pingResultsMaxRtt              = 5
+	pingResultsAverageRtt          = 6
+	pingResultsProbeResponses      = 7
+	pingResultsSentProbes          = 8
+	pingResultsRttSumOfSquares     = 9  // of the RTTs in milliseconds
+	pingResultsLastGoodProbe       = 10 // DateAndTime
+)
+
+// oid is an SNMP object identifier.
+type oid []uint32
+
+func (o oid) String() string {
+	parts := make([]string, len(o))
+	for i, n := range o {
+		parts[i] = fmt.Sprint(n)
+	}
+	return strings.Join(parts, ".")
+}
+
+// compare orders OIDs lexicographically, as SNMP walks them.
+func (o oid) compare(p oid) int {
+	for i := 0; i < len(o) && i < len(p); i++ {
+		switch {
+		case o[i] < p[i]:
+			return -1
+		case o[i] > p[i]:
+			return 1
+		}
+	}
+	return len(o) - len(p)
+}
+
+// varBind is an SNMP variable binding. Value is an int64 or uint32 for the
+// integer types and a []byte for octet strings.
+type varBind struct {
+	Name  oid
+	Type  uint16
+	Value interface{}
+}
+
+// agentx is an AgentX subagent that exposes the statistics of the targets in
+// a set through the SNMP daemon acting as master agent, for network
+// management systems that only speak SNMP.
+type agentx struct {
+	address string // unix socket path, or host:port
+	owner   string
+	set     *TargetSet
+	start   time.Time
+
+	conn     net.Conn
+	order    binary.ByteOrder // of the PDU being answered
+	session  uint32
+	packetID uint32
+
+	unindexed map[string]bool // targets left out of the table, logged once
+}
+
+func newAgentX(address, owner string, set *TargetSet) *agentx {
+	return &agentx{address: address, owner: owner, set: set, start: time.Now(), unindexed: make(map[string]bool)}
+}
+
+// run keeps a session with the master agent, reconnecting with backoff
+// whenever the master goes away, as it does when snmpd restarts.
+func (a *agentx) run() {
+	delay := time.Second
+	for {
+		started := time.Now()
+		error := a.serve()
+		log.Printf("AgentX: %v\n", error)
+		if time.Since(started) > time.Minute {
+			delay = time.Second
+		}
+		time.Sleep(delay)
+		if delay < time.Minute {
+			delay *= 2
+		}
+	}
+}
+
+// serve opens a session, registers the table and answers requests until the
+// connection fails.
+func (a *agentx) serve() error {
+	network := "tcp"
+	if strings.HasPrefix(a.address, "/") {
+		network = "unix"
+	}
+	conn, error := net.DialTimeout(network, a.address, 10*time.Second)
+	if error != nil {
+		return error
+	}
+	defer conn.Close()
+	a.conn, a.order, a.session = conn, binary.BigEndian, 0
+
+	// Open-PDU: timeout, reserved, an identifying OID and a description
+	var w agentxWriter
+	w.order = a.order
+	w.bytes(0, 0, 0, 0)
+	w.oid(nil, false)
+	w.string([]byte("ping"))
+	if error := a.request(agentxOpen, w.Bytes()); error != nil {
+		return fmt.Errorf("open: %v", error)
+	}
+
+	// Register-PDU: timeout, priority, range_subid, reserved, subtree
+	w = agentxWriter{order: a.order}
+	w.bytes(0, 127, 0, 0)
+	w.oid(pingResultsEntry[:len(pingResultsEntry)-1], false)
+	if error := a.request(agentxRegister, w.Bytes()); error != nil {
+		return fmt.Errorf("register: %v", error)
+	}
+	log.Printf("AgentX: serving pingResultsTable through %s\n", a.address)
+
+	for {
+		h, payload, error := readAgentXPDU(conn)
+		if error != nil {
+			return error
+		}
+		a.order = h.order()
+		switch h.Type {
+		case agentxGet, agentxGetNext, agentxGetBulk:
+			binds, error := a.answer(h, payload)
+			if error != nil {
+				return error
+			}
+			if error := a.respond(h, 0, 0, binds); error != nil {
+				return error
+			}
+		case agentxTestSet:
+			// nothing in the table is writable
+			if error := a.respond(h, agentxNotWritable, 1, nil); error != nil {
+				return error
+			}
+		case agentxCommitSet, agentxUndoSet:
+			if error := a.respond(h, agentxGenError, 0, nil); error != nil {
+				return error
+			}
+		case agentxCleanup, agentxResponse:
+		case agentxClose:
+			return fmt.Errorf("closed by the master agent")
+		default:
+			if error := a.respond(h, agentxGenError, 0, nil); error != nil {
+				return error
+			}
+		}
+	}
+}
+
+// request sends a PDU to the master agent and waits for its response. The
+// session ID comes from the response to the Open-PDU.
+func (a *agentx) request(typ byte, payload []byte) error {
+	a.packetID++
+	h := agentxHeader{Version: 1, Type: typ, Flags: agentxNetworkByteOrder, Session: a.session, Packet: a.packetID}
+	if error := writeAgentXPDU(a.conn, h, payload); error != nil {
+		return error
+	}
+	a.conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	defer a.conn.SetReadDeadline(time.Time{})
+	for {
+		rh, rp, error := readAgentXPDU(a.conn)
+		if error != nil {
+			return error
+		}
+		if rh.Type != agentxResponse || rh.Packet != a.packetID {
+			continue
+		}
+		if len(rp) < 8 {
+			return fmt.Errorf("short response")
+		}
+		if status := rh.order().Uint16(rp[4:]); status != 0 {
+			return fmt.Errorf("error %d", status)
+		}
+		if typ == agentxOpen {
+			a.session = rh.Session
+		}
+		return nil
+	}
+}
+
+// respond sends the Response-PDU to the request with header h.
+func (a *agentx) respond(h agentxHeader, status, index uint16, binds []varBind) error {
+	w := agentxWriter{order: a.order}
+	w.uint32(uint32(time.Since(a.start) / (10 * time.Millisecond))) // sysUpTime
+	w.uint16(status)
+	w.uint16(index)
+	for _, b := range binds {
+		w.varBind(b)
+	}
+	rh := agentxHeader{Version: 1, Type: agentxResponse, Session: h.Session, Transaction: h.Transaction, Packet: h.Packet}
+	rh.Flags = h.Flags & agentxNetworkByteOrder
+	return writeAgentXPDU(a.conn, rh, w.Bytes())
+}
+
+// answer resolves a Get, GetNext or GetBulk request against the table as it
+// is right now.
+func (a *agentx) answer(h agentxHeader, payload []byte) ([]varBind, error) {
+	r := agentxReader{b: payload, order: a.order}
+	if h.Flags&agentxNonDefaultContext != 0 {
+		r.string()
+	}
+	var nonRepeaters, maxRepetitions int
+	if h.Type == agentxGetBulk {
+		nonRepeaters, maxRepetitions = int(r.uint16()), int(r.uint16())
+	}
+	type searchRange struct {
+		start, end oid
+		include    bool
+	}
+	var ranges []searchRange
+	for r.err == nil && len(r.b) > 0 {
+		start, include := r.oid()
+		end, _ := r.oid()
+		ranges = append(ranges, searchRange{start, end, include})
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	table := a.table()
+	// next returns the first variable after start and before end, or
+	// endOfMibView when there is none.
+	next := func(start, end oid, include bool) varBind {
+		i := sort.Search(len(table), func(i int) bool {
+			c := table[i].Name.compare(start)
+			return c > 0 || include && c == 0
+		})
+		if i == len(table) || len(end) > 0 && table[i].Name.compare(end) >= 0 {
+			return varBind{Name: start, Type: snmpEndOfMibView}
+		}
+		return table[i]
+	}
+
+	var binds []varBind
+	switch h.Type {
+	case agentxGet:
+		for _, sr := range ranges {
+			// a column of the table without the row is a missing instance,
+			// anything else an object the subagent doesn't have
+			b := varBind{Name: sr.start, Type: snmpNoSuchObject}
+			if column := len(pingResultsEntry); len(sr.start) > column && sr.start[:column].compare(pingResultsEntry) == 0 &&
+				sr.start[column] >= pingResultsOperStatus && sr.start[column] <= pingResultsLastGoodProbe {
+				b.Type = snmpNoSuchInstance
+			}
+			i := sort.Search(len(table), func(i int) bool { return table[i].Name.compare(sr.start) >= 0 })
+			if i < len(table) && table[i].Name.compare(sr.start) == 0 {
+				b = table[i]
+			}
+			binds = append(binds, b)
+		}
+	case agentxGetNext:
+		for _, sr := range ranges {
+			binds = append(binds, next(sr.start, sr.end, sr.include))
+		}
+	case agentxGetBulk:
+		if nonRepeaters > len(ranges) {
+			nonRepeaters = len(ranges)
+		}
+		for _, sr := range ranges[:nonRepeaters] {
+			binds = append(binds, next(sr.start, sr.end, sr.include))
+		}
+		repeaters := ranges[nonRepeaters:]
+		for n := 0; n < maxRepetitions && len(repeaters) > 0; n++ {
+			done := true
+			for i, sr := range repeaters {
+				b := next(sr.start, sr.end, sr.include)
+				binds = append(binds, b)
+				if b.Type != snmpEndOfMibView {
+					repeaters[i].start, repeaters[i].include = b.Name, false
+					done = false
+				}
+			}
+			if done {
+				break
+			}
+		}
+	}
+	return binds, nil
+}
+
+// table returns every variable of pingResultsTable, ordered by OID, which
+// is column by column and within a column by owner and test name. Targets
+// whose address is too long for a test name are left out.
+func (a *agentx) table() []varBind {
+	var table []varBind
+	for _, t := range a.set.List() {
+		if len(t.Address) > snmpAdminStringMax {
+			if !a.unindexed[t.Address] {
+				a.unindexed[t.Address] = true
+				log.Printf("AgentX: leaving %s out of pingResultsTable, test names are at most %d octets\n", t.Address, snmpAdminStringMax)
+			}
+			continue
+		}
+		s := t.Stats.Snapshot()
+		index := append(snmpString(a.owner), snmpString(t.Address)...)
+		addressType, address := inetAddress(t.Address)
+		sumOfSquares := float64(s.Received) * (square(milliseconds(s.MdevRTT)) + square(milliseconds(s.AvgRTT)))
+		columns := []struct {
+			column uint32
+			varBind
+		}{
+			{pingResultsOperStatus, varBind{Type: snmpInteger, Value: int64(1)}},
+			{pingResultsIpTargetAddressType, varBind{Type: snmpInteger, Value: addressType}},
+			{pingResultsIpTargetAddress, varBind{Type: snmpOctetString, Value: address}},
+			{pingResultsMinRtt, varBind{Type: snmpUnsigned32, Value: uint32(s.MinRTT / time.Millisecond)}},
+			{pingResultsMaxRtt, varBind{Type: snmpUnsigned32, Value: uint32(s.MaxRTT / time.Millisecond)}},
+			{pingResultsAverageRtt, varBind{Type: snmpUnsigned32, Value: uint32(s.AvgRTT / time.Millisecond)}},
+			{pingResultsProbeResponses, varBind{Type: snmpGauge32, Value: uint32(s.Received)}},
+			{pingResultsSentProbes, varBind{Type: snmpGauge32, Value: uint32(s.Sent)}},
+			{pingResultsRttSumOfSquares, varBind{Type: snmpUnsigned32, Value: clampUint32(sumOfSquares)}},
+			{pingResultsLastGoodProbe, varBind{Type: snmpOctetString, Value: dateAndTime(s.LastReply)}},
+		}
+		for _, c := range columns {
+			b := c.varBind
+			b.Name = append(append(append(oid(nil), pingResultsEntry...), c.column), index...)
+			table = append(table, b)
+		}
+	}
+	sort.Slice(table, func(i, j int) bool { return table[i].Name.compare(table[j].Name) < 0 })
+	return table
+}
+
+// snmpString encodes s as a variable-length string index: its length, then
+// a sub-identifier per byte.
+func snmpString(s string) oid {
+	o := oid{uint32(len(s))}
+	for i := 0; i < len(s); i++ {
+		o = append(o, uint32(s[i]))
+	}
+	return o
+}
+
+// inetAddress returns the InetAddressType and InetAddress of a target
+// address: ipv4(1) or ipv6(2) for addresses, dns(16) for host names.
+func inetAddress(address string) (int64, []byte) {
+	ip := net.ParseIP(address)
+	switch {
+	case ip == nil:
+		return 16, []byte(address)
+	case ip.To4() != nil:
+		return 1, ip.To4()
+	}
+	return 2, ip.To16()
+}
+
+// dateAndTime encodes t as an SNMPv2-TC DateAndTime in UTC. The zero time,
+// for targets that never replied, is all zeros.
+func dateAndTime(t time.Time) []byte {
+	if t.IsZero() {
+		return make([]byte, 8)
+	}
+	t = t.UTC()
+	return []byte{byte(t.Year() >> 8), byte(t.Year()), byte(t.Month()), byte(t.Day()),
+		byte(t.Hour()), byte(t.Minute()), byte(t.Second()), byte(t.Nanosecond() / 1e8), '+', 0, 0}
+}
+
+func square(f float64) float64 { return f * f }
+
+func clampUint32(f float64) uint32 {
+	if f >= 1<<32-1 {
+		return 1<<32 - 1
+	}
+	return uint32(f)
+}
+
+// agentxHeader is the 20-byte header every AgentX PDU starts with.
+type agentxHeader struct {
+	Version, Type, Flags, _ byte
+	Session, Transaction    uint32
+	Packet, Length          uint32
+}
+
+func (h agentxHeader) order() binary.ByteOrder {
+	if h.Flags&agentxNetworkByteOrder != 0 {
+		return binary.BigEndian
+	}
+	return binary.LittleEndian
+}
+
+func readAgentXPDU(r io.Reader) (agentxHeader, []byte, error) {
+	var b [20]byte
+	if _, error := io.ReadFull(r, b[:]); error != nil {
+		return agentxHeader{}, nil, error
+	}
+	h := agentxHeader{Version: b[0], Type: b[1], Flags: b[2]}
+	order := h.order()
+	h.Session, h.Transaction = order.Uint32(b[4:]), order.Uint32(b[8:])
+	h.Packet, h.Length = order.Uint32(b[12:]), order.Uint32(b[16:])
+	if h.Version != 1 {
+		return h, nil, fmt.Errorf("AgentX version %d", h.Version)
+	}
+	if h.Length > 1<<20 || h.Length%4 != 0 {
+		return h, nil, fmt.Errorf("bad payload length %d", h.Length)
+	}
+	payload := make([]byte, h.Length)
+	_, error := io.ReadFull(r, payload)
+	return h, payload, error
+}
+
+func writeAgentXPDU(w io.Writer, h agentxHeader, payload []byte) error {
+	order := h.order()
+	b := make([]byte, 20, 20+len(payload))
+	b[0], b[1], b[2] = h.Version, h.Type, h.Flags
+	order.PutUint32(b[4:], h.Session)
+	order.PutUint32(b[8:], h.Transaction)
+	order.PutUint32(b[12:], h.Packet)
+	order.PutUint32(b[16:], uint32(len(payload)))
+	_, error := w.Write(append(b, payload...))
+	return error
+}
+
+// agentxWriter builds a PDU payload.
+type agentxWriter struct {
+	bytes.Buffer
+	order binary.ByteOrder
+}
+
+func (w *agentxWriter) bytes(b ...byte) { w.Write(b) }
+
+func (w *agentxWriter) uint16(n uint16) {
+	var b [2]byte
+	w.order.PutUint16(b[:], n)
+	w.Write(b[:])
+}
+
+func (w *agentxWriter) uint32(n uint32) {
+	var b [4]byte
+	w.order.PutUint32(b[:], n)
+	w.Write(b[:])
+}
+
+// oid writes o, using the 1.3.6.1 prefix compression where it applies.
+func (w *agentxWriter) oid(o oid, include bool) {
+	prefix := byte(0)
+	if len(o) > 5 && o[0] == 1 && o[1] == 3 && o[2] == 6 && o[3] == 1 && o[4] > 0 && o[4] < 256 {
+		prefix, o = byte(o[4]), o[5:]
+	}
+	flag := byte(0)
+	if include {
+		flag = 1
+	}
+	w.bytes(byte(len(o)), prefix, flag, 0)
+	for _, n := range o {
+		w.uint32(n)
+	}
+}
+
+// string writes an octet string, padded to a multiple of 4 bytes.
+func (w *agentxWriter) string(s []byte) {
+	w.uint32(uint32(len(s)))
+	w.Write(s)
+	w.Write(make([]byte, (4-len(s)%4)%4))
+}
+
+func (w *agentxWriter) varBind(b varBind) {
+	w.uint16(b.Type)
+	w.uint16(0)
+	w.oid(b.Name, false)
+	switch v := b.Value.(type) {
+	case int64:
+		w.uint32(uint32(v))
+	case uint32:
+		w.uint32(v)
+	case []byte:
+		w.string(v)
+	}
+}
+
+// agentxReader decodes a PDU payload. The first error sticks, and every
+// read after it returns zero values.
+type agentxReader struct {
+	b     []byte
+	order binary.ByteOrder
+	err   error
+}
+
+func (r *agentxReader) take(n int) []byte {
+	if r.err != nil || len(r.b) < n {
+		if r.err == nil {
+			r.err = fmt.Errorf("truncated PDU")
+		}
+		return make([]byte, n)
+	}
+	b := r.b[:n]
+	r.b = r.b[n:]
+	return b
+}
+
+func (r *agentxReader) uint16() uint16 { return r.order.Uint16(r.take(2)) }
+func (r *agentxReader) uint32() uint32 { return r.order.Uint32(r.take(4)) }
+
+func (r *agentxReader) oid() (oid, bool) {
+	b := r.take(4)
+	n, prefix, include := int(b[0]), b[1], b[2] != 0
+	var o oid
+	if prefix != 0 {
+		o = oid{1, 3, 6, 1, uint32(prefix)}
+	}
+	for i := 0; i < n && r.err == nil; i++ {
+		o = append(o, r.uint32())
+	}
+	return o, include
+}
+
+func (r *agentxReader) string() []byte {
+	n := int(r.uint32())
+	if n > len(r.b) {
+		r.err = fmt.Errorf("truncated PDU")
+		return nil
+	}
+	return r.take((n + 3) &^ 3)[:n]
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAgentXPDU(t *testing.T) {
+	tests := []struct {
+		name   string
+		header agentxHeader
+		wire   string
+	}{
+		{
+			name:   "network byte order",
+			header: agentxHeader{Version: 1, Type: agentxResponse, Flags: agentxNetworkByteOrder, Session: 1, Transaction: 2, Packet: 3},
+			wire:   "\x01\x12\x10\x00\x00\x00\x00\x01\x00\x00\x00\x02\x00\x00\x00\x03\x00\x00\x00\x04abcd",
+		},
+		{
+			name:   "little endian",
+			header: agentxHeader{Version: 1, Type: agentxGet, Session: 1, Transaction: 2, Packet: 3},
+			wire:   "\x01\x05\x00\x00\x01\x00\x00\x00\x02\x00\x00\x00\x03\x00\x00\x00\x04\x00\x00\x00abcd",
+		},
+	}
+	for _, test := range tests {
+		var b bytes.Buffer
+		if error := writeAgentXPDU(&b, test.header, []byte("abcd")); error != nil {
+			t.Fatal(error)
+		}
+		if b.String() != test.wire {
+			t.Errorf("%s: wrote %q, want %q", test.name, b.String(), test.wire)
+		}
+		h, payload, error := readAgentXPDU(strings.NewReader(test.wire))
+		test.header.Length = 4
+		if error != nil || h != test.header || string(payload) != "abcd" {
+			t.Errorf("%s: read %+v, %q, %v, want %+v, \"abcd\"", test.name, h, payload, error, test.header)
+		}
+	}
+}
+
+func TestReadAgentXPDUErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		wire string
+	}{
+		{"short header", "\x01\x05\x10\x00"},
+		{"version 2", "\x02\x05\x10\x00" + strings.Repeat("\x00", 16)},
+		{"unaligned length", "\x01\x05\x10\x00" + strings.Repeat("\x00", 12) + "\x00\x00\x00\x03abc"},
+		{"truncated payload", "\x01\x05\x10\x00" + strings.Repeat("\x00", 12) + "\x00\x00\x00\x08abcd"},
+	}
+	for _, test := range tests {
+		if _, _, error := readAgentXPDU(strings.NewReader(test.wire)); error == nil {
+			t.Errorf("%s: no error", test.name)
+		}
+	}
+}
+
+func TestAgentXEncoding(t *testing.T) {
+	tests := []struct {
+		name  string
+		write func(w *agentxWriter)
+		wire  string
+	}{
+		{
+			name:  "prefixed oid",
+			write: func(w *agentxWriter) { w.oid(oid{1, 3, 6, 1, 2, 1, 80}, true) },
+			wire:  "\x02\x02\x01\x00\x00\x00\x00\x01\x00\x00\x00\x50",
+		},
+		{
+			name:  "oid outside 1.3.6.1",
+			write: func(w *agentxWriter) { w.oid(oid{1, 0}, false) },
+			wire:  "\x02\x00\x00\x00\x00\x00\x00\x01\x00\x00\x00\x00",
+		},
+		{
+			name:  "null oid",
+			write: func(w *agentxWriter) { w.oid(nil, false) },
+			wire:  "\x00\x00\x00\x00",
+		},
+		{
+			name:  "padded string",
+			write: func(w *agentxWriter) { w.string([]byte("abcde")) },
+			wire:  "\x00\x00\x00\x05abcde\x00\x00\x00",
+		},
+		{
+			name: "integer binding",
+			write: func(w *agentxWriter) {
+				w.varBind(varBind{Name: oid{1, 3, 6, 1, 4, 1}, Type: snmpInteger, Value: int64(-1)})
+			},
+			wire: "\x00\x02\x00\x00\x01\x04\x00\x00\x00\x00\x00\x01\xff\xff\xff\xff",
+		},
+		{
+			name:  "missing instance",
+			write: func(w *agentxWriter) { w.varBind(varBind{Name: oid{1, 3, 6, 1, 4, 1}, Type: snmpNoSuchInstance}) },
+			wire:  "\x00\x81\x00\x00\x01\x04\x00\x00\x00\x00\x00\x01",
+		},
+	}
+	for _, test := range tests {
+		w := agentxWriter{order: binary.BigEndian}
+		test.write(&w)
+		if w.String() != test.wire {
+			t.Errorf("%s: wrote %q, want %q", test.name, w.String(), test.wire)
+		}
+	}
+
+	// what the writer writes, the reader reads back
+	w := agentxWriter{order: binary.LittleEndian}
+	w.oid(pingResultsEntry, true)
+	w.string([]byte("ping"))
+	w.uint16(7)
+	r := agentxReader{b: w.Bytes(), order: binary.LittleEndian}
+	o, include := r.oid()
+	s := r.string()
+	n := r.uint16()
+	if r.err != nil || o.compare(pingResultsEntry) != 0 || !include || string(s) != "ping" || n != 7 {
+		t.Errorf("read back %v, %v, %q, %d, %v", o, include, s, n, r.err)
+	}
+	r.uint32()
+	if r.err == nil {
+		t.Error("no error reading past the end")
+	}
+}
+
+func TestAgentXAnswer(t *testing.T) {
+	set := NewTargetSet()
+	long := strings.Repeat("a", 30) + ".example.com"
+	set.Sync("test", []TargetSpec{{Address: "192.0.2.1"}, {Address: long}})
+	for _, target := range set.List() {
+		target.Stats.Record(time.Millisecond, nil)
+	}
+	a := newAgentX("", "ping", set)
+	a.order = binary.BigEndian
+
+	index := append(snmpString("ping"), snmpString("192.0.2.1")...)
+	column := func(c uint32, index oid) oid {
+		return append(append(append(oid(nil), pingResultsEntry...), c), index...)
+	}
+	missing := append(snmpString("ping"), snmpString("192.0.2.2")...)
+	type request struct {
+		start   oid
+		include bool
+	}
+	tests := []struct {
+		name           string
+		typ            byte
+		nonRepeaters   uint16
+		maxRepetitions uint16
+		requests       []request
+		want           []varBind
+	}{
+		{
+			name:     "get",
+			typ:      agentxGet,
+			requests: []request{{column(pingResultsSentProbes, index), true}},
+			want:     []varBind{{Name: column(pingResultsSentProbes, index), Type: snmpGauge32, Value: uint32(1)}},
+		},
+		{
+			name: "get missing row",
+			typ:  agentxGet,
+			requests: []request{
+				{column(pingResultsSentProbes, missing), true},
+				{column(pingResultsSentProbes, nil), true},
+			},
+			want: []varBind{
+				{Name: column(pingResultsSentProbes, missing), Type: snmpNoSuchInstance},
+				{Name: column(pingResultsSentProbes, nil), Type: snmpNoSuchInstance},
+			},
+		},
+		{
+			name: "get missing object",
+			typ:  agentxGet,
+			requests: []request{
+				{column(99, index), true},
+				{pingResultsEntry, true},
+				{oid{1, 3, 6, 1, 2, 1, 1, 1, 0}, true},
+			},
+			want: []varBind{
+				{Name: column(99, index), Type: snmpNoSuchObject},
+				{Name: pingResultsEntry, Type: snmpNoSuchObject},
+				{Name: oid{1, 3, 6, 1, 2, 1, 1, 1, 0}, Type: snmpNoSuchObject},
+			},
+		},
+		{
+			name:     "get next",
+			typ:      agentxGetNext,
+			requests: []request{{pingResultsEntry, false}, {column(pingResultsLastGoodProbe, index), false}},
+			want: []varBind{
+				{Name: column(pingResultsOperStatus, index), Type: snmpInteger, Value: int64(1)},
+				{Name: column(pingResultsLastGoodProbe, index), Type: snmpEndOfMibView},
+			},
+		},
+		{
+			name:           "get bulk",
+			typ:            agentxGetBulk,
+			maxRepetitions: 3,
+			requests:       []request{{column(pingResultsProbeResponses, index), true}},
+			want: []varBind{
+				{Name: column(pingResultsProbeResponses, index), Type: snmpGauge32, Value: uint32(1)},
+				{Name: column(pingResultsSentProbes, index), Type: snmpGauge32, Value: uint32(1)},
+				{Name: column(pingResultsRttSumOfSquares, index), Type: snmpUnsigned32, Value: uint32(1)},
+			},
+		},
+	}
+	for _, test := range tests {
+		w := agentxWriter{order: binary.BigEndian}
+		if test.typ == agentxGetBulk {
+			w.uint16(test.nonRepeaters)
+			w.uint16(test.maxRepetitions)
+		}
+		for _, r := range test.requests {
+			w.oid(r.start, r.include)
+			w.oid(nil, false)
+		}
+		h := agentxHeader{Version: 1, Type: test.typ, Flags: agentxNetworkByteOrder}
+		got, error := a.answer(h, w.Bytes())
+		if error != nil || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, %v, want %v", test.name, got, error, test.want)
+		}
+	}
+
+	// the target whose name doesn't fit a test name is left out
+	if n := len(a.table()); n != 10 {
+		t.Errorf("table has %d variables, want the 10 columns of one row", n)
+	}
+}
+
+func TestSNMPString(t *testing.T) {
+	if got, want := snmpString("ab"), (oid{2, 97, 98}); got.compare(want) != 0 {
+		t.Errorf("snmpString(ab) = %v, want %v", got, want)
+	}
+	if got := snmpString(""); got.compare(oid{0}) != 0 {
+		t.Errorf("snmpString() = %v, want 0", got)
+	}
+}
+
+func TestInetAddress(t *testing.T) {
+	tests := []struct {
+		address string
+		typ     int64
+		value   []byte
+	}{
+		{"192.0.2.1", 1, []byte{192, 0, 2, 1}},
+		{"2001:db8::1", 2, []byte{0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1}},
+		{"example.com", 16, []byte("example.com")},
+	}
+	for _, test := range tests {
+		typ, value := inetAddress(test.address)
+		if typ != test.typ || !bytes.Equal(value, test.value) {
+			t.Errorf("inetAddress(%s) = %d, %v, want %d, %v", test.address, typ, value, test.typ, test.value)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+// listenFDsStart is the first file descriptor systemd passes to a
+// socket-activated service.
+const listenFDsStart = 3
+
+// apiListener returns the listener for the HTTP API: the socket systemd
+// passed in when the service is socket activated, otherwise a new one on
+// address. It returns nil when neither applies.
+func apiListener(address string) (net.Listener, error) {
+	if os.Getenv("LISTEN_PID") == strconv.Itoa(os.Getpid()) {
+		n, _ := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+		if n > 0 {
+			f := os.NewFile(listenFDsStart, "LISTEN_FD_3")
+			defer f.Close()
+			return net.FileListener(f)
+		}
+	}
+	if address == "" {
+		return nil, nil
+	}
+	return net.Listen("tcp", address)
+}
+
+// targetStats is how a target appears in the API: its labels alongside its
+// statistics.
+type targetStats struct {
+	Labels map[string]string `json:"labels,omitempty"`
+	StatsSnapshot
+}
+
+// serveAPI serves the statistics of the targets in set as JSON on /stats,
+// and their health under /health as health judges it.
+func serveAPI(l net.Listener, set *TargetSet, health healthPolicy) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+		out := make(map[string]targetStats)
+		for _, t := range set.List() {
+			out[t.Address] = targetStats{Labels: t.Labels(), StatsSnapshot: t.Stats.Snapshot()}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(out)
+	})
+	mux.HandleFunc("/health", health.serveHealth(set))
+	mux.HandleFunc("/health/", health.serveHealth(set))
+	return http.Serve(l, mux)
+}
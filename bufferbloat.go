@@ -0,0 +1,240 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The load generator speaks a one-byte protocol to the sink: the client
+// sends sinkUpload and then streams data the sink discards, or sinkDownload
+// and then reads what the sink streams back, until either side hangs up.
+const (
+	sinkUpload   = 'U'
+	sinkDownload = 'D'
+)
+
+// bufferbloatCommand measures latency under load. It pings the target while
+// the link is idle, then again while saturating TCP downloads and uploads run
+// against a sink, and grades how much the latency grows, which is what
+// oversized buffers in the path (bufferbloat) do.
+func bufferbloatCommand(args []string) error {
+	flags := flag.NewFlagSet("bufferbloat", flag.ExitOnError)
+	privileged := flags.Bool("privileged", false, "use raw sockets (needs root or CAP_NET_RAW)")
+	endpoint := flags.String("endpoint", "", "host:port of the sink to load the link against (see ping sink)")
+	phase := flags.Duration("duration", 10*time.Second, "length of each phase: idle, download and upload")
+	streams := flags.Int("streams", 4, "number of parallel TCP streams")
+	interval := flags.Duration("i", 100*time.Millisecond, "time between probes")
+	flags.Usage = func() {
+		fmt.Println("Usage: ping bufferbloat -endpoint host:port [-privileged] [-duration d] [-streams n] [-i interval] <host>")
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 || *endpoint == "" {
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	dst, error := net.ResolveIPAddr("ip", flags.Arg(0))
+	if error != nil {
+		return error
+	}
+	session, error := NewSession(*privileged)
+	if error != nil {
+		return error
+	}
+	defer session.Close()
+	session.Timeout = time.Second
+
+	// probe sends pings for d while load runs, returning the RTTs (-1 when lost)
+	probe := func(d time.Duration) []time.Duration {
+		var rtts []time.Duration
+		deadline := time.Now().Add(d)
+		for time.Now().Before(deadline) {
+			start := time.Now()
+			rtt, error := session.PingIP(dst)
+			if error != nil {
+				rtt = -1
+			}
+			rtts = append(rtts, rtt)
+			time.Sleep(*interval - time.Since(start))
+		}
+		return rtts
+	}
+
+	fmt.Printf("Measuring idle latency to %s for %s...\n", flags.Arg(0), *phase)
+	idle := describe(probe(*phase))
+	if idle.received == 0 {
+		return fmt.Errorf("no replies from %s while idle", flags.Arg(0))
+	}
+
+	session.Timeout = loadTimeout(idle)
+
+	results := []struct {
+		name      string
+		direction byte
+		rtts      description
+		rate      float64
+	}{
+		{name: "download", direction: sinkDownload},
+		{name: "upload", direction: sinkUpload},
+	}
+	for i := range results {
+		r := &results[i]
+		fmt.Printf("Measuring latency during %s for %s...\n", r.name, *phase)
+		l, error := startLoad(*endpoint, r.direction, *streams)
+		if error != nil {
+			return error
+		}
+		r.rtts = describe(probe(*phase))
+		r.rate = l.stop()
+	}
+
+	fmt.Println()
+	fmt.Printf("%-10s %10s %10s %10s %8s %12s\n", "phase", "median", "p90", "increase", "loss", "throughput")
+	fmt.Printf("%-10s %8.3fms %8.3fms %10s %7.1f%% %12s\n", "idle", milliseconds(idle.median), milliseconds(idle.p90), "", idle.loss, "")
+	worst := time.Duration(0)
+	for _, r := range results {
+		if r.rtts.received == 0 {
+			// nothing got through at all, which is as bad as it gets
+			worst = time.Hour
+			fmt.Printf("%-10s %10s %10s %10s %7.1f%% %7.1fMbit/s\n", r.name, "-", "-", "-", r.rtts.loss, r.rate/1e6)
+			continue
+		}
+		increase := r.rtts.median - idle.median
+		if increase > worst {
+			worst = increase
+		}
+		fmt.Printf("%-10s %8.3fms %8.3fms %+8.3fms %7.1f%% %7.1fMbit/s\n", r.name,
+			milliseconds(r.rtts.median), milliseconds(r.rtts.p90), milliseconds(increase), r.rtts.loss, r.rate/1e6)
+	}
+	fmt.Printf("\nBufferbloat grade: %s\n", bufferbloatGrade(worst))
+	return nil
+}
+
+// bufferbloatGrades is the scale popularised by the DSLReports speed test:
+// the grade for latency increases below each bound. Anything above the last
+// one is an F.
+var bufferbloatGrades = []struct {
+	below time.Duration
+	grade string
+}{
+	{5 * time.Millisecond, "A+"},
+	{30 * time.Millisecond, "A"},
+	{60 * time.Millisecond, "B"},
+	{200 * time.Millisecond, "C"},
+	{400 * time.Millisecond, "D"},
+}
+
+// bufferbloatGrade grades the worst latency increase under load.
+func bufferbloatGrade(increase time.Duration) string {
+	for _, g := range bufferbloatGrades {
+		if increase < g.below {
+			return g.grade
+		}
+	}
+	return "F"
+}
+
+// loadTimeout is how long a probe under load waits for its reply. Replies
+// delayed well past the F bound must still count as replies, not as loss, or
+// the worst bufferbloat would look like packet loss with a flattering median.
+func loadTimeout(idle description) time.Duration {
+	return idle.max + 4*bufferbloatGrades[len(bufferbloatGrades)-1].below + time.Second
+}
+
+// load is a set of TCP streams saturating the link in one direction.
+type load struct {
+	conns []net.Conn
+	bytes uint64
+	start time.Time
+	wg    sync.WaitGroup
+}
+
+func startLoad(endpoint string, direction byte, streams int) (*load, error) {
+	l := &load{start: time.Now()}
+	for i := 0; i < streams; i++ {
+		c, error := net.DialTimeout("tcp", endpoint, 5*time.Second)
+		if error != nil {
+			l.stop()
+			return nil, error
+		}
+		if _, error := c.Write([]byte{direction}); error != nil {
+			c.Close()
+			l.stop()
+			return nil, error
+		}
+		l.conns = append(l.conns, c)
+		transfer := c.Read
+		if direction == sinkUpload {
+			transfer = c.Write
+		}
+		l.wg.Add(1)
+		go func() {
+			defer l.wg.Done()
+			buf := make([]byte, 64*1024)
+			for {
+				n, error := transfer(buf)
+				atomic.AddUint64(&l.bytes, uint64(n))
+				if error != nil {
+					return
+				}
+			}
+		}()
+	}
+	return l, nil
+}
+
+// stop closes the streams and returns the throughput they reached in bits
+// per second.
+func (l *load) stop() float64 {
+	for _, c := range l.conns {
+		c.Close()
+	}
+	l.wg.Wait()
+	return float64(atomic.LoadUint64(&l.bytes)) * 8 / time.Since(l.start).Seconds()
+}
+
+// sinkCommand runs the TCP sink the bufferbloat test loads the link against.
+func sinkCommand(args []string) error {
+	flags := flag.NewFlagSet("sink", flag.ExitOnError)
+	listen := flags.String("listen", ":9999", "address to listen on")
+	flags.Parse(args)
+
+	l, error := net.Listen("tcp", *listen)
+	if error != nil {
+		return error
+	}
+	log.Printf("Sink listening on %s\n", l.Addr())
+	for {
+		c, error := l.Accept()
+		if error != nil {
+			return error
+		}
+		go serveSink(c)
+	}
+}
+
+func serveSink(c net.Conn) {
+	defer c.Close()
+	var direction [1]byte
+	if _, error := io.ReadFull(c, direction[:]); error != nil {
+		return
+	}
+	switch direction[0] {
+	case sinkUpload:
+		io.Copy(io.Discard, c)
+	case sinkDownload:
+		buf := make([]byte, 64*1024)
+		for {
+			if _, error := c.Write(buf); error != nil {
+				return
+			}
+		}
+	}
+}
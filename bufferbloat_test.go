@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestBufferbloatGrade(t *testing.T) {
+	tests := []struct {
+		increase time.Duration
+		want     string
+	}{
+		{-time.Millisecond, "A+"},
+		{0, "A+"},
+		{4999 * time.Microsecond, "A+"},
+		{5 * time.Millisecond, "A"},
+		{29 * time.Millisecond, "A"},
+		{30 * time.Millisecond, "B"},
+		{60 * time.Millisecond, "C"},
+		{199 * time.Millisecond, "C"},
+		{200 * time.Millisecond, "D"},
+		{400 * time.Millisecond, "F"},
+		{time.Hour, "F"},
+	}
+	for _, test := range tests {
+		if got := bufferbloatGrade(test.increase); got != test.want {
+			t.Errorf("%v: got %s, want %s", test.increase, got, test.want)
+		}
+	}
+}
+
+func TestLoadTimeout(t *testing.T) {
+	idle := description{max: 300 * time.Millisecond}
+	worst := bufferbloatGrades[len(bufferbloatGrades)-1].below
+	if got := loadTimeout(idle); got <= idle.max+worst {
+		t.Errorf("timeout %v doesn't leave room for replies delayed past the F bound", got)
+	}
+}
+
+func TestSink(t *testing.T) {
+	l, error := net.Listen("tcp", "127.0.0.1:0")
+	if error != nil {
+		t.Fatal(error)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, error := l.Accept()
+			if error != nil {
+				return
+			}
+			go serveSink(c)
+		}
+	}()
+
+	for _, direction := range []byte{sinkDownload, sinkUpload} {
+		load, error := startLoad(l.Addr().String(), direction, 2)
+		if error != nil {
+			t.Fatalf("%c: %v", direction, error)
+		}
+		time.Sleep(100 * time.Millisecond)
+		if rate := load.stop(); rate <= 0 {
+			t.Errorf("%c: no data moved", direction)
+		}
+	}
+
+	// anything but a direction byte gets the connection closed
+	c, error := net.Dial("tcp", l.Addr().String())
+	if error != nil {
+		t.Fatal(error)
+	}
+	defer c.Close()
+	c.Write([]byte{'X'})
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, error := c.Read(make([]byte, 1)); n != 0 || error == nil {
+		t.Errorf("unknown direction: read %d bytes, %v", n, error)
+	} else if e, ok := error.(net.Error); ok && e.Timeout() {
+		t.Errorf("unknown direction: connection left open")
+	}
+}
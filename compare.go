@@ -0,0 +1,257 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// compareCommand pings two or more targets in lockstep: every round sends
+// one probe to each target at the same time, so all targets see the same
+// network conditions and a lost probe doesn't hold up the others. It then reports
+// how the RTT distributions and loss of each target differ from the first
+// one, with paired significance tests on the time-aligned rounds.
+func compareCommand(args []string) error {
+	flags := flag.NewFlagSet("compare", flag.ExitOnError)
+	privileged := flags.Bool("privileged", false, "use raw sockets (needs root or CAP_NET_RAW)")
+	count := flags.Int("c", 50, "number of rounds")
+	interval := flags.Duration("i", time.Second, "time between rounds")
+	timeout := flags.Duration("W", time.Second, "time to wait for each reply")
+	flags.Usage = func() {
+		fmt.Println("Usage: ping compare [-privileged] [-c rounds] [-i interval] [-W timeout] <host> <host> [host ...]")
+	}
+	flags.Parse(args)
+	if flags.NArg() < 2 {
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	var dsts []*net.IPAddr
+	for _, address := range flags.Args() {
+		dst, error := net.ResolveIPAddr("ip", address)
+		if error != nil {
+			return error
+		}
+		dsts = append(dsts, dst)
+	}
+
+	session, error := NewSession(*privileged)
+	if error != nil {
+		return error
+	}
+	defer session.Close()
+	session.Timeout = *timeout
+
+	// rtts[t][round] is the RTT of target t in that round, or -1 if lost
+	rtts := make([][]time.Duration, len(dsts))
+	for round := 0; round < *count; round++ {
+		start := time.Now()
+		row := make([]time.Duration, len(dsts))
+		var wg sync.WaitGroup
+		for t := range dsts {
+			wg.Add(1)
+			go func(t int) {
+				defer wg.Done()
+				rtt, error := session.PingIP(dsts[t])
+				if error != nil {
+					rtt = -1
+				}
+				row[t] = rtt
+			}(t)
+		}
+		wg.Wait()
+		for t, rtt := range row {
+			rtts[t] = append(rtts[t], rtt)
+		}
+		fmt.Fprintf(os.Stderr, "\rround %d/%d", round+1, *count)
+		if round+1 < *count {
+			time.Sleep(*interval - time.Since(start))
+		}
+	}
+	fmt.Fprintln(os.Stderr)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "target\tsent\trecv\tloss\tmin\tmedian\tmean\tp90\tmax\tstddev\t")
+	for t, address := range flags.Args() {
+		d := describe(rtts[t])
+		fmt.Fprintf(w, "%s\t%d\t%d\t%.1f%%\t%.3f\t%.3f\t%.3f\t%.3f\t%.3f\t%.3f\t\n", address,
+			len(rtts[t]), d.received, d.loss, milliseconds(d.min), milliseconds(d.median),
+			milliseconds(d.mean), milliseconds(d.p90), milliseconds(d.max), milliseconds(d.stddev))
+	}
+	w.Flush()
+	fmt.Println("(RTTs in ms)")
+
+	base := flags.Arg(0)
+	for t := 1; t < len(dsts); t++ {
+		fmt.Printf("\n%s vs %s:\n", flags.Arg(t), base)
+
+		n, median, p := wilcoxon(rtts[t], rtts[0])
+		if n < 10 {
+			fmt.Printf("  RTT:  only %d rounds with both replies, too few for a test\n", n)
+		} else {
+			fmt.Printf("  RTT:  median paired difference %+.3f ms over %d rounds, p=%.4f (Wilcoxon signed-rank)%s\n",
+				milliseconds(median), n, p, significance(p))
+		}
+
+		only, onlyBase, p := mcnemar(rtts[t], rtts[0])
+		fmt.Printf("  loss: %d rounds lost only by %s, %d only by %s, p=%.4f (McNemar)%s\n",
+			only, flags.Arg(t), onlyBase, base, p, significance(p))
+	}
+	return nil
+}
+
+func significance(p float64) string {
+	if p < 0.05 {
+		return ", significant"
+	}
+	return ""
+}
+
+// description summarises a series of RTTs in which -1 marks a lost probe.
+type description struct {
+	received                            int
+	loss                                float64
+	min, median, mean, p90, max, stddev time.Duration
+}
+
+func describe(rtts []time.Duration) description {
+	var got []time.Duration
+	for _, rtt := range rtts {
+		if rtt >= 0 {
+			got = append(got, rtt)
+		}
+	}
+	d := description{received: len(got)}
+	if len(rtts) > 0 {
+		d.loss = float64(len(rtts)-len(got)) / float64(len(rtts)) * 100
+	}
+	if len(got) == 0 {
+		return d
+	}
+	sort.Slice(got, func(i, j int) bool { return got[i] < got[j] })
+	d.min, d.max = got[0], got[len(got)-1]
+	d.median = percentile(got, 50)
+	d.p90 = percentile(got, 90)
+
+	var sum, squares float64
+	for _, rtt := range got {
+		sum += float64(rtt)
+		squares += float64(rtt) * float64(rtt)
+	}
+	mean := sum / float64(len(got))
+	d.mean = time.Duration(mean)
+	if v := squares/float64(len(got)) - mean*mean; v > 0 {
+		d.stddev = time.Duration(math.Sqrt(v))
+	}
+	return d
+}
+
+// percentile returns the p-th percentile of sorted, interpolating between
+// the closest ranks.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 1 {
+		return sorted[0]
+	}
+	rank := p / 100 * float64(len(sorted)-1)
+	lo := int(rank)
+	if lo+1 >= len(sorted) {
+		return sorted[len(sorted)-1]
+	}
+	frac := rank - float64(lo)
+	return sorted[lo] + time.Duration(frac*float64(sorted[lo+1]-sorted[lo]))
+}
+
+// wilcoxon runs a two-sided Wilcoxon signed-rank test on the rounds where
+// both a and b got a reply, using the normal approximation with tie
+// correction. It returns the number of such rounds, the median of the
+// differences a-b, and the p-value.
+func wilcoxon(a, b []time.Duration) (int, time.Duration, float64) {
+	var diffs []float64
+	for i := range a {
+		if a[i] >= 0 && b[i] >= 0 {
+			diffs = append(diffs, float64(a[i]-b[i]))
+		}
+	}
+	n := len(diffs)
+	if n == 0 {
+		return 0, 0, 1
+	}
+	sorted := append([]float64(nil), diffs...)
+	sort.Float64s(sorted)
+	median := time.Duration(sorted[n/2])
+	if n%2 == 0 {
+		median = time.Duration((sorted[n/2-1] + sorted[n/2]) / 2)
+	}
+
+	// zero differences carry no sign and are dropped
+	var nonzero []float64
+	for _, d := range diffs {
+		if d != 0 {
+			nonzero = append(nonzero, d)
+		}
+	}
+	m := float64(len(nonzero))
+	if m == 0 {
+		return n, median, 1
+	}
+	sort.Slice(nonzero, func(i, j int) bool { return math.Abs(nonzero[i]) < math.Abs(nonzero[j]) })
+
+	var wPlus, ties float64
+	for i := 0; i < len(nonzero); {
+		j := i
+		for j < len(nonzero) && math.Abs(nonzero[j]) == math.Abs(nonzero[i]) {
+			j++
+		}
+		rank := float64(i+j+1) / 2 // average of ranks i+1..j
+		for k := i; k < j; k++ {
+			if nonzero[k] > 0 {
+				wPlus += rank
+			}
+		}
+		t := float64(j - i)
+		ties += t*t*t - t
+		i = j
+	}
+
+	mean := m * (m + 1) / 4
+	variance := m*(m+1)*(2*m+1)/24 - ties/48
+	if variance <= 0 {
+		return n, median, 1
+	}
+	z := (math.Abs(wPlus-mean) - 0.5) / math.Sqrt(variance)
+	if z < 0 {
+		z = 0
+	}
+	return n, median, math.Erfc(z / math.Sqrt2)
+}
+
+// mcnemar compares the loss of a and b over the same rounds with McNemar's
+// test (with continuity correction). It returns the number of rounds lost
+// only by a, only by b, and the p-value.
+func mcnemar(a, b []time.Duration) (int, int, float64) {
+	onlyA, onlyB := 0, 0
+	for i := range a {
+		switch {
+		case a[i] < 0 && b[i] >= 0:
+			onlyA++
+		case a[i] >= 0 && b[i] < 0:
+			onlyB++
+		}
+	}
+	if onlyA+onlyB == 0 {
+		return 0, 0, 1
+	}
+	diff := math.Abs(float64(onlyA-onlyB)) - 1
+	if diff < 0 {
+		diff = 0
+	}
+	chi2 := diff * diff / float64(onlyA+onlyB)
+	// the chi-squared distribution with one degree of freedom
+	return onlyA, onlyB, math.Erfc(math.Sqrt(chi2 / 2))
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// ms builds a series of RTTs from milliseconds, with -1 for a lost probe.
+func ms(values ...float64) []time.Duration {
+	rtts := make([]time.Duration, len(values))
+	for i, v := range values {
+		if v < 0 {
+			rtts[i] = -1
+		} else {
+			rtts[i] = time.Duration(v * float64(time.Millisecond))
+		}
+	}
+	return rtts
+}
+
+func TestWilcoxon(t *testing.T) {
+	tests := []struct {
+		name   string
+		a, b   []time.Duration
+		n      int
+		median time.Duration
+		p      float64
+	}{
+		{"no common replies", ms(1, -1), ms(-1, 2), 0, 0, 1},
+		{"identical", ms(1, 2, 3), ms(1, 2, 3), 3, 0, 1},
+		{"all higher", ms(2, 4, 6, 8, 10), ms(1, 2, 3, 4, 5), 5, 3 * time.Millisecond, 0.059058},
+		{"mixed signs", ms(2, 1, 6, 8), ms(1, 3, 3, 4), 4, 2 * time.Millisecond, 0.361310},
+		{"lost rounds skipped", ms(2, -1, 4, 6, 8, 10), ms(1, 5, 2, 3, 4, 5), 5, 3 * time.Millisecond, 0.059058},
+	}
+	for _, test := range tests {
+		n, median, p := wilcoxon(test.a, test.b)
+		if n != test.n || median != test.median || math.Abs(p-test.p) > 1e-6 {
+			t.Errorf("%s: got %d, %v, %f, want %d, %v, %f", test.name, n, median, p, test.n, test.median, test.p)
+		}
+	}
+}
+
+func TestMcnemar(t *testing.T) {
+	tests := []struct {
+		name         string
+		a, b         []time.Duration
+		onlyA, onlyB int
+		p            float64
+	}{
+		{"no loss", ms(1, 2), ms(1, 2), 0, 0, 1},
+		{"both lost", ms(-1, 2), ms(-1, 2), 0, 0, 1},
+		{"one each", ms(-1, 2), ms(1, -1), 1, 1, 1},
+		{
+			"a lossier",
+			ms(-1, -1, -1, -1, -1, -1, -1, -1, -1, -1, 1, 1),
+			ms(1, 1, 1, 1, 1, 1, 1, 1, 1, 1, -1, -1),
+			10, 2, 0.043308,
+		},
+	}
+	for _, test := range tests {
+		onlyA, onlyB, p := mcnemar(test.a, test.b)
+		if onlyA != test.onlyA || onlyB != test.onlyB || math.Abs(p-test.p) > 1e-6 {
+			t.Errorf("%s: got %d, %d, %f, want %d, %d, %f", test.name, onlyA, onlyB, p, test.onlyA, test.onlyB, test.p)
+		}
+	}
+}
+
+func TestDescribe(t *testing.T) {
+	tests := []struct {
+		name string
+		rtts []time.Duration
+		want description
+	}{
+		{"empty", nil, description{}},
+		{"all lost", ms(-1, -1), description{loss: 100}},
+		{
+			"single reply",
+			ms(5),
+			description{received: 1, min: 5 * time.Millisecond, median: 5 * time.Millisecond, mean: 5 * time.Millisecond, p90: 5 * time.Millisecond, max: 5 * time.Millisecond},
+		},
+		{
+			"interpolated percentiles",
+			ms(4, -1, 1, 3, 2),
+			description{
+				received: 4, loss: 20,
+				min: 1 * time.Millisecond, median: 2500 * time.Microsecond, mean: 2500 * time.Microsecond,
+				p90: 3700 * time.Microsecond, max: 4 * time.Millisecond, stddev: 1118033 * time.Nanosecond,
+			},
+		},
+	}
+	for _, test := range tests {
+		got := describe(test.rtts)
+		if got.stddev.Round(time.Microsecond) == test.want.stddev.Round(time.Microsecond) {
+			got.stddev = test.want.stddev
+		}
+		if got != test.want {
+			t.Errorf("%s: got %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,637 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// Diagnosis is everything diagnose found out about one host, in a form that
+// can be attached to a support ticket as is.
+type Diagnosis struct {
+	Host     string         `json:"host"`
+	Time     time.Time      `json:"time"`
+	From     string         `json:"from"` // the host name of the machine that ran the diagnosis
+	DNS      DNSReport      `json:"dns"`
+	Families []FamilyReport `json:"families"` // one per address family the host resolved to
+}
+
+// DNSReport holds the records found for the host.
+type DNSReport struct {
+	Addresses []string            `json:"addresses,omitempty"` // A and AAAA
+	CNAME     string              `json:"cname,omitempty"`
+	MX        []string            `json:"mx,omitempty"`
+	NS        []string            `json:"ns,omitempty"`
+	TXT       []string            `json:"txt,omitempty"`
+	PTR       map[string][]string `json:"ptr,omitempty"`    // by address
+	Errors    map[string]string   `json:"errors,omitempty"` // lookups that failed other than by not finding anything, by record type
+	Duration  time.Duration       `json:"duration_ns"`
+}
+
+// FamilyReport holds the checks run against one address of the host.
+type FamilyReport struct {
+	Family  string      `json:"family"` // IPv4 or IPv6
+	Address string      `json:"address"`
+	Geo     *GeoInfo    `json:"geo,omitempty"`
+	Ping    PingReport  `json:"ping"`
+	PMTU    PMTUReport  `json:"pmtu"`
+	Route   RouteReport `json:"route"`
+	TCP     []PortCheck `json:"tcp"`
+}
+
+// PingReport summarises a short run of echo requests.
+type PingReport struct {
+	Sent     int           `json:"sent"`
+	Received int           `json:"received"`
+	Loss     float64       `json:"loss"`
+	Min      time.Duration `json:"min_ns"`
+	Avg      time.Duration `json:"avg_ns"`
+	Max      time.Duration `json:"max_ns"`
+	Stddev   time.Duration `json:"stddev_ns"`
+	Error    string        `json:"error,omitempty"` // the last error, when no reply came back at all
+}
+
+// PMTUReport is the largest packet, IP header included, that reached the host
+// and came back without being fragmented.
+type PMTUReport struct {
+	MTU   int    `json:"mtu,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// RouteReport is the traceroute to the host.
+type RouteReport struct {
+	Hops  []Hop  `json:"hops,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// Hop is one TTL of a traceroute.
+type Hop struct {
+	TTL     int             `json:"ttl"`
+	Address string          `json:"address,omitempty"` // empty when nothing answered
+	Name    string          `json:"name,omitempty"`
+	RTTs    []time.Duration `json:"rtts_ns"` // one per query, -1 when lost
+	Error   string          `json:"error,omitempty"`
+	Geo     *GeoInfo        `json:"geo,omitempty"`
+}
+
+// PortCheck is the outcome of one TCP connection attempt.
+type PortCheck struct {
+	Port  int           `json:"port"`
+	State string        `json:"state"` // open, closed, filtered, or the error
+	Time  time.Duration `json:"time_ns"`
+}
+
+// diagnoseCommand runs the checks a support engineer would ask for first
+// against one host: DNS, ping over both IPv4 and IPv6, path MTU, traceroute
+// and TCP connects to common ports, and prints them as one report.
+func diagnoseCommand(args []string) error {
+	flags := flag.NewFlagSet("diagnose", flag.ExitOnError)
+	privileged := flags.Bool("privileged", false, "use raw sockets (needs root or CAP_NET_RAW; required for traceroute)")
+	count := flags.Int("c", 10, "number of echo requests per address")
+	interval := flags.Duration("i", 200*time.Millisecond, "time between echo requests")
+	timeout := flags.Duration("W", time.Second, "time to wait for each reply or connection")
+	maxHops := flags.Int("max-hops", 30, "give up the traceroute after this many hops")
+	queries := flags.Int("q", 3, "traceroute probes per hop")
+	ports := flags.String("ports", "22,25,53,80,443,3389", "comma-separated TCP ports to connect to")
+	jsonOutput := flags.Bool("json", false, "write the report as JSON")
+	outputPath := flags.String("o", "", "write the report to this file instead of standard output")
+	var geoipPaths stringList
+	flags.Var(&geoipPaths, "geoip", "annotate the host and traceroute hops with country, city and AS from this MaxMind DB file (repeatable)")
+	flags.Usage = func() {
+		fmt.Println("Usage: ping diagnose [-privileged] [-c count] [-i interval] [-W timeout] [-max-hops n] [-q n] [-ports list] [-geoip file] [-json] [-o file] <host>")
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	var tcpPorts []int
+	for _, p := range strings.Split(*ports, ",") {
+		port, error := strconv.Atoi(p)
+		if error != nil || port <= 0 || port > 65535 {
+			return fmt.Errorf("bad TCP port %q", p)
+		}
+		tcpPorts = append(tcpPorts, port)
+	}
+
+	geo, error := openGeoDB(geoipPaths)
+	if error != nil {
+		return error
+	}
+
+	host := flags.Arg(0)
+	d := Diagnosis{Host: host, Time: time.Now().UTC()}
+	d.From, _ = os.Hostname()
+
+	fmt.Fprintf(os.Stderr, "Looking up %s\n", host)
+	var addrs []net.IP
+	d.DNS, addrs = lookupAll(host, *timeout)
+
+	// the first address of each family, like a client would try
+	var picked []net.IP
+	for _, v4 := range []bool{true, false} {
+		for _, ip := range addrs {
+			if (ip.To4() != nil) == v4 {
+				picked = append(picked, ip)
+				break
+			}
+		}
+	}
+	for _, ip := range picked {
+		d.Families = append(d.Families, diagnoseAddress(ip, *privileged, *count, *interval, *timeout, *maxHops, *queries, tcpPorts))
+	}
+	if len(geo) > 0 {
+		for i := range d.Families {
+			f := &d.Families[i]
+			f.Geo = geoAnnotation(geo, f.Address)
+			for j := range f.Route.Hops {
+				f.Route.Hops[j].Geo = geoAnnotation(geo, f.Route.Hops[j].Address)
+			}
+		}
+	}
+
+	var w io.Writer = os.Stdout
+	if *outputPath != "" {
+		f, error := os.Create(*outputPath)
+		if error != nil {
+			return error
+		}
+		defer f.Close()
+		w = f
+	}
+	if *jsonOutput {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(d)
+	}
+	printDiagnosis(w, d)
+	return nil
+}
+
+// geoAnnotation looks address up, returning nil when there is nothing to
+// say about it.
+func geoAnnotation(db geoDB, address string) *GeoInfo {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return nil
+	}
+	g := db.lookup(ip)
+	if g == (GeoInfo{}) {
+		return nil
+	}
+	return &g
+}
+
+// lookupAll collects the host's address, CNAME, MX, NS and TXT records and
+// the reverse names of its addresses. A host given as an address only gets
+// the reverse lookup.
+func lookupAll(host string, timeout time.Duration) (DNSReport, []net.IP) {
+	r := DNSReport{PTR: make(map[string][]string), Errors: make(map[string]string)}
+	start := time.Now()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*timeout)
+	defer cancel()
+	resolver := net.DefaultResolver
+
+	// lookup errors that only mean there is no such record are not worth
+	// reporting
+	failed := func(kind string, error error) bool {
+		if error == nil {
+			return false
+		}
+		var dnsError *net.DNSError
+		if !errors.As(error, &dnsError) || !dnsError.IsNotFound {
+			r.Errors[kind] = error.Error()
+		}
+		return true
+	}
+
+	var addrs []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		addrs = []net.IP{ip}
+	} else {
+		ipAddrs, error := resolver.LookupIPAddr(ctx, host)
+		if !failed("A/AAAA", error) {
+			for _, a := range ipAddrs {
+				addrs = append(addrs, a.IP)
+				r.Addresses = append(r.Addresses, a.IP.String())
+			}
+		}
+		if cname, error := resolver.LookupCNAME(ctx, host); !failed("CNAME", error) && strings.TrimSuffix(cname, ".") != strings.TrimSuffix(host, ".") {
+			r.CNAME = cname
+		}
+		if mxs, error := resolver.LookupMX(ctx, host); !failed("MX", error) {
+			for _, mx := range mxs {
+				r.MX = append(r.MX, fmt.Sprintf("%d %s", mx.Pref, mx.Host))
+			}
+		}
+		if nss, error := resolver.LookupNS(ctx, host); !failed("NS", error) {
+			for _, ns := range nss {
+				r.NS = append(r.NS, ns.Host)
+			}
+		}
+		if txts, error := resolver.LookupTXT(ctx, host); !failed("TXT", error) {
+			r.TXT = txts
+		}
+	}
+	for _, ip := range addrs {
+		if names, error := resolver.LookupAddr(ctx, ip.String()); !failed("PTR "+ip.String(), error) {
+			r.PTR[ip.String()] = names
+		}
+	}
+	r.Duration = time.Since(start)
+	return r, addrs
+}
+
+// diagnoseAddress runs the ping, path MTU, traceroute and TCP checks against
+// one address.
+func diagnoseAddress(ip net.IP, privileged bool, count int, interval, timeout time.Duration, maxHops, queries int, ports []int) FamilyReport {
+	r := FamilyReport{Family: "IPv4", Address: ip.String()}
+	if ip.To4() == nil {
+		r.Family = "IPv6"
+	}
+	dst := &net.IPAddr{IP: ip}
+
+	fmt.Fprintf(os.Stderr, "Pinging %s\n", ip)
+	r.Ping = diagnosePing(dst, privileged, count, interval, timeout)
+
+	fmt.Fprintf(os.Stderr, "Discovering the path MTU to %s\n", ip)
+	if session, error := NewSessionVia(privileged, SocketOptions{DontFragment: true}); error != nil {
+		r.PMTU.Error = error.Error()
+	} else {
+		session.Timeout = timeout
+		r.PMTU.MTU, error = discoverPMTU(session, dst)
+		if error != nil {
+			r.PMTU.Error = error.Error()
+		}
+		session.Close()
+	}
+
+	if !privileged {
+		r.Route.Error = "traceroute needs -privileged"
+	} else if session, error := NewSession(true); error != nil {
+		r.Route.Error = error.Error()
+	} else {
+		fmt.Fprintf(os.Stderr, "Tracing the route to %s\n", ip)
+		session.Timeout = timeout
+		r.Route.Hops, error = traceroute(session, dst, maxHops, queries, nil)
+		if error != nil {
+			r.Route.Error = error.Error()
+		}
+		session.Close()
+	}
+
+	fmt.Fprintf(os.Stderr, "Connecting to TCP ports on %s\n", ip)
+	r.TCP = make([]PortCheck, len(ports))
+	var wg sync.WaitGroup
+	for i, port := range ports {
+		wg.Add(1)
+		go func(i, port int) {
+			defer wg.Done()
+			r.TCP[i] = checkPort(ip, port, timeout)
+		}(i, port)
+	}
+	wg.Wait()
+	return r
+}
+
+func diagnosePing(dst *net.IPAddr, privileged bool, count int, interval, timeout time.Duration) PingReport {
+	var r PingReport
+	session, error := NewSession(privileged)
+	if error != nil {
+		r.Error = error.Error()
+		return r
+	}
+	defer session.Close()
+	session.Timeout = timeout
+
+	var rtts []time.Duration
+	for i := 0; i < count; i++ {
+		start := time.Now()
+		rtt, error := session.PingIP(dst)
+		if error != nil {
+			rtt = -1
+			r.Error = error.Error()
+		}
+		rtts = append(rtts, rtt)
+		if i < count-1 {
+			time.Sleep(interval - time.Since(start))
+		}
+	}
+	desc := describe(rtts)
+	r.Sent, r.Received, r.Loss = len(rtts), desc.received, desc.loss
+	r.Min, r.Avg, r.Max, r.Stddev = desc.min, desc.mean, desc.max, desc.stddev
+	if r.Received > 0 {
+		r.Error = ""
+	}
+	return r
+}
+
+// discoverPMTU finds the largest probe that gets an answer from dst by binary
+// search between the minimum MTU of the family and the MTU of the interface
+// the route goes out of. s must have been opened with DontFragment, and is
+// left with a changed Size.
+func discoverPMTU(s *Session, dst *net.IPAddr) (int, error) {
+	// the IP and ICMP headers around the payload
+	header, lo := ipv4.HeaderLen+8, 68
+	if dst.IP.To4() == nil {
+		header, lo = ipv6.HeaderLen+8, 1280
+	}
+
+	// fits reports whether a packet of size bytes makes it there and back,
+	// and the next-hop MTU if a router said it does not
+	fits := func(size int) (bool, int) {
+		s.Size = size - header
+		for try := 0; try < 2; try++ {
+			_, error := s.Probe(dst)
+			var icmpError *ICMPError
+			switch {
+			case error == nil:
+				return true, 0
+			case errors.As(error, &icmpError):
+				return false, icmpError.MTU
+			case errors.Is(error, syscall.EMSGSIZE):
+				// bigger than the interface, or than a path MTU the
+				// kernel already learned
+				return false, 0
+			}
+		}
+		return false, 0
+	}
+
+	return searchPMTU(lo, routeMTU(dst.IP), fits)
+}
+
+// searchPMTU finds the largest size between lo and hi that fits, by binary
+// search. fits also returns the next-hop MTU a router reported, if any.
+func searchPMTU(lo, hi int, fits func(size int) (bool, int)) (int, error) {
+	if hi < lo {
+		hi = lo
+	}
+	if ok, _ := fits(lo); !ok {
+		return 0, fmt.Errorf("even a %d byte probe got no reply", lo)
+	}
+	ok, next := fits(hi)
+	if ok {
+		return hi, nil
+	}
+	// lo fits and hi does not; a router's hint is tried next when it falls
+	// in between, and if it fits, the size just above it, since routers
+	// report their MTU exactly
+	confirm := false
+	for hi-lo > 1 {
+		size := (lo + hi) / 2
+		switch {
+		case confirm:
+			size = lo + 1
+		case next > lo && next < hi:
+			size = next
+		}
+		hinted := !confirm && size == next
+		ok, hint := fits(size)
+		if ok {
+			lo, confirm = size, hinted
+		} else {
+			hi, next, confirm = size, hint, false
+		}
+	}
+	return lo, nil
+}
+
+// routeMTU is the MTU of the interface the route to ip leaves through, or
+// 1500 when it cannot be told.
+func routeMTU(ip net.IP) int {
+	// connecting a UDP socket picks the route without sending anything
+	c, error := net.DialUDP("udp", nil, &net.UDPAddr{IP: ip, Port: 9})
+	if error != nil {
+		return 1500
+	}
+	local := c.LocalAddr().(*net.UDPAddr).IP
+	c.Close()
+
+	interfaces, error := net.Interfaces()
+	if error != nil {
+		return 1500
+	}
+	for _, i := range interfaces {
+		addrs, error := i.Addrs()
+		if error != nil {
+			continue
+		}
+		for _, a := range addrs {
+			if n, ok := a.(*net.IPNet); ok && n.IP.Equal(local) {
+				return i.MTU
+			}
+		}
+	}
+	return 1500
+}
+
+// traceroute sends queries probes to dst for each TTL from 1 until dst
+// answers, a router reports it unreachable, or maxHops. Five silent hops in
+// a row end it early, as the rest of the path is most likely filtered too.
+// It needs a raw socket session of its own, since it changes the TTL.
+// stopped, if not nil, is asked before every probe whether to give up, in
+// which case the hops so far are returned with errInterrupted.
+func traceroute(s *Session, dst *net.IPAddr, maxHops, queries int, stopped func() bool) ([]Hop, error) {
+	const maxSilent = 5
+	var hops []Hop
+	silent := 0
+	for ttl := 1; ttl <= maxHops; ttl++ {
+		if error := s.SetTTL(ttl); error != nil {
+			return hops, error
+		}
+		hop := Hop{TTL: ttl}
+		done := false
+		for q := 0; q < queries; q++ {
+			if stopped != nil && stopped() {
+				if len(hop.RTTs) > 0 {
+					hops = append(hops, hop)
+				}
+				return hops, errInterrupted
+			}
+			reply, error := s.Probe(dst)
+			var icmpError *ICMPError
+			switch {
+			case error == nil:
+				hop.Address = dst.IP.String()
+				hop.RTTs = append(hop.RTTs, reply.RTT)
+				done = true
+			case errors.As(error, &icmpError):
+				hop.Address = icmpError.From.String()
+				hop.RTTs = append(hop.RTTs, reply.RTT)
+				if !isTimeExceeded(icmpError) {
+					hop.Error = icmpError.Error()
+					done = true
+				}
+			default:
+				hop.RTTs = append(hop.RTTs, -1)
+			}
+		}
+		if hop.Address != "" {
+			if names, error := net.LookupAddr(hop.Address); error == nil && len(names) > 0 {
+				hop.Name = names[0]
+			}
+			silent = 0
+		} else {
+			silent++
+		}
+		hops = append(hops, hop)
+		if done {
+			return hops, nil
+		}
+		if silent >= maxSilent {
+			return hops, fmt.Errorf("no answer from %d hops in a row", silent)
+		}
+	}
+	return hops, fmt.Errorf("%v not reached in %d hops", dst, maxHops)
+}
+
+func isTimeExceeded(e *ICMPError) bool {
+	return e.Type == ipv4.ICMPTypeTimeExceeded || e.Type == ipv6.ICMPTypeTimeExceeded
+}
+
+// checkPort connects to ip:port, telling a refused connection (the host is
+// there, the port is closed) from one that times out (something drops it).
+func checkPort(ip net.IP, port int, timeout time.Duration) PortCheck {
+	r := PortCheck{Port: port}
+	start := time.Now()
+	c, error := net.DialTimeout("tcp", net.JoinHostPort(ip.String(), strconv.Itoa(port)), timeout)
+	r.Time = time.Since(start)
+	var netError net.Error
+	switch {
+	case error == nil:
+		c.Close()
+		r.State = "open"
+	case errors.Is(error, syscall.ECONNREFUSED):
+		r.State = "closed"
+	case errors.As(error, &netError) && netError.Timeout():
+		r.State = "filtered"
+	default:
+		r.State = error.Error()
+	}
+	return r
+}
+
+func printDiagnosis(w io.Writer, d Diagnosis) {
+	fmt.Fprintf(w, "Diagnosis of %s from %s at %s\n", d.Host, d.From, d.Time.Format(time.RFC3339))
+
+	fmt.Fprintf(w, "\nDNS (%.3f ms)\n", milliseconds(d.DNS.Duration))
+	field := func(name string, values ...string) {
+		if len(values) > 0 {
+			fmt.Fprintf(w, "  %-8s %s\n", name, strings.Join(values, ", "))
+		}
+	}
+	field("address", d.DNS.Addresses...)
+	if d.DNS.CNAME != "" {
+		field("CNAME", d.DNS.CNAME)
+	}
+	field("MX", d.DNS.MX...)
+	field("NS", d.DNS.NS...)
+	for _, txt := range d.DNS.TXT {
+		field("TXT", strconv.Quote(txt))
+	}
+	addresses := make([]string, 0, len(d.DNS.PTR))
+	for address := range d.DNS.PTR {
+		addresses = append(addresses, address)
+	}
+	sort.Slice(addresses, func(i, j int) bool {
+		return compareIPs(net.ParseIP(addresses[i]), net.ParseIP(addresses[j])) < 0
+	})
+	for _, address := range addresses {
+		field("PTR", address+" -> "+strings.Join(d.DNS.PTR[address], ", "))
+	}
+	kinds := make([]string, 0, len(d.DNS.Errors))
+	for kind := range d.DNS.Errors {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	for _, kind := range kinds {
+		field("error", kind+": "+d.DNS.Errors[kind])
+	}
+	if len(d.Families) == 0 {
+		fmt.Fprintln(w, "  no addresses to check")
+	}
+
+	for _, f := range d.Families {
+		if f.Geo != nil {
+			fmt.Fprintf(w, "\n%s %s [%s]\n", f.Family, f.Address, f.Geo)
+		} else {
+			fmt.Fprintf(w, "\n%s %s\n", f.Family, f.Address)
+		}
+
+		p := f.Ping
+		fmt.Fprintf(w, "  ping     %d sent, %d received, %.1f%% loss", p.Sent, p.Received, p.Loss)
+		if p.Received > 0 {
+			fmt.Fprintf(w, ", rtt min/avg/max/stddev = %.3f/%.3f/%.3f/%.3f ms", milliseconds(p.Min),
+				milliseconds(p.Avg), milliseconds(p.Max), milliseconds(p.Stddev))
+		}
+		if p.Error != "" {
+			fmt.Fprintf(w, " (%s)", p.Error)
+		}
+		fmt.Fprintln(w)
+
+		if f.PMTU.Error != "" {
+			fmt.Fprintf(w, "  pmtu     unknown: %s\n", f.PMTU.Error)
+		} else {
+			fmt.Fprintf(w, "  pmtu     %d bytes\n", f.PMTU.MTU)
+		}
+
+		fmt.Fprintln(w, "  route")
+		for _, hop := range f.Route.Hops {
+			fmt.Fprintf(w, "    %s\n", hop)
+		}
+		if f.Route.Error != "" {
+			fmt.Fprintf(w, "    %s\n", f.Route.Error)
+		}
+
+		var checks []string
+		for _, c := range f.TCP {
+			checks = append(checks, fmt.Sprintf("%d %s (%.3f ms)", c.Port, c.State, milliseconds(c.Time)))
+		}
+		fmt.Fprintf(w, "  tcp      %s\n", strings.Join(checks, ", "))
+	}
+}
+
+// String renders the hop the way traceroute lists it: the TTL, the address
+// (and name) that answered, the RTT of every query with * for lost ones, and
+// any annotation or error.
+func (hop Hop) String() string {
+	line := fmt.Sprintf("%2d  ", hop.TTL)
+	if hop.Address == "" {
+		line += "*"
+	} else if hop.Name != "" {
+		line += fmt.Sprintf("%s (%s)", hop.Name, hop.Address)
+	} else {
+		line += hop.Address
+	}
+	for _, rtt := range hop.RTTs {
+		if rtt < 0 {
+			line += "  *"
+		} else {
+			line += fmt.Sprintf("  %.3f ms", milliseconds(rtt))
+		}
+	}
+	if hop.Geo != nil {
+		line += "  [" + hop.Geo.String() + "]"
+	}
+	if hop.Error != "" {
+		line += "  " + hop.Error
+	}
+	return line
+}
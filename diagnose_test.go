@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSearchPMTU(t *testing.T) {
+	tests := []struct {
+		name   string
+		lo, hi int
+		mtu    int // of the path, 0 when nothing gets through
+		hint   int // the next-hop MTU routers report, 0 for none
+		want   int
+		probes int // at most
+	}{
+		{name: "interface MTU fits", lo: 68, hi: 1500, mtu: 1500, want: 1500, probes: 2},
+		{name: "binary search", lo: 68, hi: 1500, mtu: 1400, want: 1400, probes: 13},
+		{name: "router hint", lo: 68, hi: 1500, mtu: 1400, hint: 1400, want: 1400, probes: 4},
+		{name: "bogus router hint", lo: 68, hi: 1500, mtu: 1400, hint: 1499, want: 1400, probes: 14},
+		{name: "router hint too low", lo: 68, hi: 1500, mtu: 1400, hint: 1300, want: 1400, probes: 12},
+		{name: "IPv6 minimum", lo: 1280, hi: 1500, mtu: 1280, want: 1280, probes: 10},
+		{name: "route MTU below minimum", lo: 1280, hi: 1000, mtu: 1500, want: 1280, probes: 2},
+		{name: "nothing fits", lo: 68, hi: 1500, want: 0, probes: 1},
+	}
+	for _, test := range tests {
+		probes := 0
+		fits := func(size int) (bool, int) {
+			probes++
+			if size <= test.mtu {
+				return true, 0
+			}
+			if test.mtu == 0 {
+				return false, 0
+			}
+			return false, test.hint
+		}
+		got, error := searchPMTU(test.lo, test.hi, fits)
+		if got != test.want || (error != nil) != (test.want == 0) {
+			t.Errorf("%s: got %d, %v, want %d", test.name, got, error, test.want)
+		}
+		if probes > test.probes {
+			t.Errorf("%s: %d probes, want at most %d", test.name, probes, test.probes)
+		}
+	}
+}
+
+func TestHopString(t *testing.T) {
+	tests := []struct {
+		hop  Hop
+		want string
+	}{
+		{Hop{TTL: 1, RTTs: []time.Duration{-1, -1}}, " 1  *  *  *"},
+		{Hop{TTL: 2, Address: "192.0.2.1", RTTs: []time.Duration{1500 * time.Microsecond, -1}}, " 2  192.0.2.1  1.500 ms  *"},
+		{
+			Hop{TTL: 12, Address: "192.0.2.1", Name: "gw.example.", RTTs: []time.Duration{time.Millisecond}, Geo: &GeoInfo{Country: "NL"}, Error: "host unreachable"},
+			"12  gw.example. (192.0.2.1)  1.000 ms  [NL]  host unreachable",
+		},
+	}
+	for _, test := range tests {
+		if got := test.hop.String(); got != test.want {
+			t.Errorf("got %q, want %q", got, test.want)
+		}
+	}
+}
+
+func TestCheckPort(t *testing.T) {
+	l, error := net.Listen("tcp", "127.0.0.1:0")
+	if error != nil {
+		t.Fatal(error)
+	}
+	defer l.Close()
+	open := l.Addr().(*net.TCPAddr).Port
+
+	// a port that was just free is most likely still closed
+	c, error := net.Listen("tcp", "127.0.0.1:0")
+	if error != nil {
+		t.Fatal(error)
+	}
+	closed := c.Addr().(*net.TCPAddr).Port
+	c.Close()
+
+	for _, test := range []struct {
+		port int
+		want string
+	}{{open, "open"}, {closed, "closed"}} {
+		r := checkPort(net.IPv4(127, 0, 0, 1), test.port, time.Second)
+		if r.Port != test.port || r.State != test.want || r.Time <= 0 {
+			t.Errorf("port %d: got %+v, want %s", test.port, r, test.want)
+		}
+	}
+}
+
+func TestPrintDiagnosisOrder(t *testing.T) {
+	d := Diagnosis{DNS: DNSReport{
+		PTR:    map[string][]string{"2001:db8::1": {"b."}, "192.0.2.10": {"c."}, "192.0.2.9": {"a."}},
+		Errors: map[string]string{"TXT": "timeout", "MX": "timeout", "NS": "timeout"},
+	}}
+	var w bytes.Buffer
+	printDiagnosis(&w, d)
+	out := w.String()
+	order := []string{"192.0.2.9 ->", "192.0.2.10 ->", "2001:db8::1 ->", "MX:", "NS:", "TXT:"}
+	last := -1
+	for _, s := range order {
+		i := strings.Index(out, s)
+		if i < last {
+			t.Errorf("%q out of order in\n%s", s, out)
+		}
+		last = i
+	}
+}
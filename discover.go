@@ -0,0 +1,318 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// maxSweepHosts bounds how many addresses a single range may expand to.
+const maxSweepHosts = 65536
+
+// HostResult is what discovery found out about one address.
+type HostResult struct {
+	Address string        `json:"address"`
+	Alive   bool          `json:"alive"`
+	Methods []string      `json:"methods,omitempty"` // the methods that got an answer
+	MAC     string        `json:"mac,omitempty"`     // from the ARP/NDP table, when on-link
+	RTT     time.Duration `json:"rtt_ns,omitempty"`  // of the echo reply, if there was one
+}
+
+// discoveryMethods are the methods discover knows, in the order they run.
+var discoveryMethods = []string{"echo", "timestamp", "tcp", "arp"}
+
+// discoverCommand decides which hosts are alive using several probe methods
+// at once, since networks that filter plain echo requests often still let a
+// timestamp request, a TCP handshake or ARP/NDP through. Any one method
+// answering makes a host alive, and the report says which ones did.
+func discoverCommand(args []string) error {
+	flags := flag.NewFlagSet("discover", flag.ExitOnError)
+	privileged := flags.Bool("privileged", false, "use raw sockets (needs root or CAP_NET_RAW; required for timestamp)")
+	methods := flags.String("methods", strings.Join(discoveryMethods, ","), "comma-separated methods to try: echo, timestamp, tcp, arp (ARP or NDP, on-link hosts only)")
+	ports := flags.String("ports", "22,80,443,3389", "comma-separated TCP ports for the tcp method")
+	timeout := flags.Duration("W", time.Second, "time to wait for each method")
+	workers := flags.Int("workers", 64, "number of hosts probed in parallel")
+	jsonOutput := flags.Bool("json", false, "print every host's result as JSON")
+	all := flags.Bool("all", false, "also list hosts that did not answer")
+	save := flags.String("save", "", "store the alive hosts in this file, or in a new time-stamped file in this directory, for ping diff")
+	flags.Usage = func() {
+		fmt.Println("Usage: ping discover [-privileged] [-methods list] [-ports list] [-W timeout] [-workers n] [-json] [-all] [-save path] <host|cidr> ...")
+	}
+	flags.Parse(args)
+	if flags.NArg() < 1 {
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	d := &discoverer{timeout: *timeout, methods: make(map[string]bool)}
+	for _, m := range strings.Split(*methods, ",") {
+		if !contains(discoveryMethods, m) {
+			return fmt.Errorf("unknown discovery method %q", m)
+		}
+		d.methods[m] = true
+	}
+	for _, p := range strings.Split(*ports, ",") {
+		port, error := strconv.Atoi(p)
+		if error != nil || port <= 0 || port > 65535 {
+			return fmt.Errorf("bad TCP port %q", p)
+		}
+		d.ports = append(d.ports, port)
+	}
+	hosts, swept, error := expandTargets(flags.Args())
+	if error != nil {
+		return error
+	}
+
+	if d.methods["timestamp"] && !*privileged {
+		log.Println("skipping the timestamp method: it needs -privileged")
+		delete(d.methods, "timestamp")
+	}
+	if d.methods["echo"] || d.methods["timestamp"] {
+		session, error := NewSession(*privileged)
+		if error != nil {
+			return error
+		}
+		defer session.Close()
+		session.Timeout = *timeout
+		d.session = session
+	}
+
+	results := d.sweep(hosts, *workers)
+	if *save != "" {
+		path, error := saveSweep(*save, flags.Args(), swept, results)
+		if error != nil {
+			return error
+		}
+		fmt.Fprintf(os.Stderr, "Sweep saved to %s\n", path)
+	}
+	if *jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(results)
+	}
+	printHostResults(results, *all)
+	return nil
+}
+
+func printHostResults(results []HostResult, all bool) {
+	alive := 0
+	for _, r := range results {
+		if r.Alive {
+			alive++
+		}
+		if !r.Alive && !all {
+			continue
+		}
+		line := r.Address
+		if r.Alive {
+			line += " alive: " + strings.Join(r.Methods, ", ")
+		} else {
+			line += " no answer"
+		}
+		if r.MAC != "" {
+			line += " [" + r.MAC + "]"
+		}
+		if r.RTT > 0 {
+			line += fmt.Sprintf(" (echo %.3f ms)", milliseconds(r.RTT))
+		}
+		fmt.Println(line)
+	}
+	fmt.Printf("%d of %d hosts alive\n", alive, len(results))
+}
+
+// discoverer runs the enabled methods against hosts.
+type discoverer struct {
+	session *Session
+	methods map[string]bool
+	ports   []int
+	timeout time.Duration
+}
+
+// sweep probes hosts with up to workers at a time, returning the results in
+// address order.
+func (d *discoverer) sweep(hosts []net.IP, workers int) []HostResult {
+	results := make([]HostResult, len(hosts))
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				results[i] = d.probe(hosts[i])
+			}
+		}()
+	}
+	for i := range hosts {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	return results
+}
+
+func (d *discoverer) probe(ip net.IP) HostResult {
+	r := HostResult{Address: ip.String()}
+	dst := &net.IPAddr{IP: ip}
+
+	if d.methods["echo"] {
+		if reply, error := d.session.Probe(dst); error == nil {
+			r.Methods = append(r.Methods, "echo")
+			r.RTT = reply.RTT
+		}
+	}
+	if d.methods["timestamp"] && ip.To4() != nil {
+		if _, error := d.session.Timestamp(dst); error == nil {
+			r.Methods = append(r.Methods, "timestamp")
+		}
+	}
+	if d.methods["tcp"] {
+		for _, port := range d.ports {
+			if tcpAnswers(ip, port, d.timeout) {
+				r.Methods = append(r.Methods, "tcp/"+strconv.Itoa(port))
+			}
+		}
+	}
+	if d.methods["arp"] && onLink(ip) {
+		// any packet to the host makes the kernel resolve it; the UDP
+		// discard port is as good as any
+		if c, error := net.DialUDP("udp", nil, &net.UDPAddr{IP: ip, Port: 9}); error == nil {
+			c.Write([]byte{0})
+			c.Close()
+		}
+		deadline := time.Now().Add(d.timeout)
+		for {
+			mac, ok, error := lookupNeighbor(ip)
+			if error != nil {
+				break
+			}
+			if ok {
+				method := "arp"
+				if ip.To4() == nil {
+					method = "ndp"
+				}
+				r.Methods = append(r.Methods, method)
+				r.MAC = mac.String()
+				break
+			}
+			if time.Now().After(deadline) {
+				break
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+
+	r.Alive = len(r.Methods) > 0
+	return r
+}
+
+// tcpAnswers reports whether the host completes a TCP handshake on port or
+// refuses it with a reset. Either way something is there.
+func tcpAnswers(ip net.IP, port int, timeout time.Duration) bool {
+	c, error := net.DialTimeout("tcp", net.JoinHostPort(ip.String(), strconv.Itoa(port)), timeout)
+	if error == nil {
+		c.Close()
+		return true
+	}
+	return errors.Is(error, syscall.ECONNREFUSED)
+}
+
+// onLink reports whether ip is in a subnet directly attached to one of the
+// host's interfaces, where ARP or NDP can reach it.
+func onLink(ip net.IP) bool {
+	addrs, error := net.InterfaceAddrs()
+	if error != nil {
+		return false
+	}
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok && !n.IP.IsLoopback() && n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// expandTargets turns host names, addresses and CIDR ranges into a sorted,
+// de-duplicated list of addresses. IPv4 ranges leave out their network and
+// broadcast addresses. It also returns args with host names replaced by the
+// address they resolved to, which is what a stored sweep records as swept.
+func expandTargets(args []string) ([]net.IP, []string, error) {
+	seen := make(map[string]bool)
+	var hosts []net.IP
+	var swept []string
+	add := func(ip net.IP) {
+		if !seen[string(ip)] {
+			seen[string(ip)] = true
+			hosts = append(hosts, ip)
+		}
+	}
+
+	for _, arg := range args {
+		if !strings.Contains(arg, "/") {
+			dst, error := net.ResolveIPAddr("ip", arg)
+			if error != nil {
+				return nil, nil, error
+			}
+			add(normalizeIP(dst.IP))
+			swept = append(swept, normalizeIP(dst.IP).String())
+			continue
+		}
+		_, n, error := net.ParseCIDR(arg)
+		if error != nil {
+			return nil, nil, error
+		}
+		ones, bits := n.Mask.Size()
+		if bits-ones > 16 {
+			return nil, nil, fmt.Errorf("%s: more than %d addresses", arg, maxSweepHosts)
+		}
+		swept = append(swept, n.String())
+		first := normalizeIP(n.IP)
+		size := 1 << uint(bits-ones)
+		for i := 0; i < size; i++ {
+			if bits == 32 && size > 2 && (i == 0 || i == size-1) {
+				continue
+			}
+			add(addToIP(first, i))
+		}
+	}
+	sort.Slice(hosts, func(i, j int) bool { return compareIPs(hosts[i], hosts[j]) < 0 })
+	return hosts, swept, nil
+}
+
+// normalizeIP returns IPv4 addresses in their 4 byte form, so they compare
+// and sort consistently.
+func normalizeIP(ip net.IP) net.IP {
+	if v4 := ip.To4(); v4 != nil {
+		return v4
+	}
+	return ip
+}
+
+func addToIP(ip net.IP, n int) net.IP {
+	out := append(net.IP(nil), ip...)
+	for i := len(out) - 1; i >= 0 && n > 0; i-- {
+		sum := int(out[i]) + n
+		out[i] = byte(sum)
+		n = sum >> 8
+	}
+	return out
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
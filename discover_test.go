@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestExpandTargets(t *testing.T) {
+	tests := []struct {
+		name  string
+		args  []string
+		want  []string
+		error bool
+	}{
+		{name: "address", args: []string{"192.0.2.1"}, want: []string{"192.0.2.1"}},
+		{name: "without network and broadcast", args: []string{"192.0.2.0/30"}, want: []string{"192.0.2.1", "192.0.2.2"}},
+		{name: "point to point", args: []string{"192.0.2.0/31"}, want: []string{"192.0.2.0", "192.0.2.1"}},
+		{name: "single host", args: []string{"192.0.2.7/32"}, want: []string{"192.0.2.7"}},
+		{name: "across octets", args: []string{"192.0.2.254/31", "192.0.3.0/31"}, want: []string{"192.0.2.254", "192.0.2.255", "192.0.3.0", "192.0.3.1"}},
+		{name: "IPv6 keeps every address", args: []string{"2001:db8::/126"}, want: []string{"2001:db8::", "2001:db8::1", "2001:db8::2", "2001:db8::3"}},
+		{name: "sorted and de-duplicated", args: []string{"2001:db8::1", "192.0.2.2", "192.0.2.0/30", "::ffff:192.0.2.1"}, want: []string{"192.0.2.1", "192.0.2.2", "2001:db8::1"}},
+		{name: "largest range", args: []string{"10.0.0.0/16"}},
+		{name: "too large", args: []string{"10.0.0.0/15"}, error: true},
+		{name: "bad range", args: []string{"192.0.2.0/33"}, error: true},
+	}
+	for _, test := range tests {
+		hosts, _, error := expandTargets(test.args)
+		if test.error {
+			if error == nil {
+				t.Errorf("%s: got %d addresses, want an error", test.name, len(hosts))
+			}
+			continue
+		}
+		if error != nil {
+			t.Errorf("%s: %v", test.name, error)
+			continue
+		}
+		if test.want == nil {
+			if len(hosts) != maxSweepHosts-2 {
+				t.Errorf("%s: got %d addresses, want %d", test.name, len(hosts), maxSweepHosts-2)
+			}
+			continue
+		}
+		got := make([]string, len(hosts))
+		for i, ip := range hosts {
+			got[i] = ip.String()
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestAddToIP(t *testing.T) {
+	tests := []struct {
+		ip   string
+		n    int
+		want string
+	}{
+		{"192.0.2.1", 0, "192.0.2.1"},
+		{"192.0.2.255", 1, "192.0.3.0"},
+		{"10.0.0.0", 65535, "10.0.255.255"},
+		{"2001:db8::ffff", 1, "2001:db8::1:0"},
+	}
+	for _, test := range tests {
+		ip := normalizeIP(net.ParseIP(test.ip))
+		if got := addToIP(ip, test.n).String(); got != test.want {
+			t.Errorf("%s + %d: got %s, want %s", test.ip, test.n, got, test.want)
+		}
+		if ip.String() != test.ip {
+			t.Errorf("%s + %d: modified the address", test.ip, test.n)
+		}
+	}
+}
+
+func TestExpandTargetsSwept(t *testing.T) {
+	_, swept, error := expandTargets([]string{"192.0.2.1/30", "::ffff:198.51.100.7", "localhost"})
+	if error != nil {
+		t.Fatal(error)
+	}
+	want := []string{"192.0.2.0/30", "198.51.100.7"}
+	if len(swept) != 3 || !reflect.DeepEqual(swept[:2], want) || net.ParseIP(swept[2]) == nil || !net.ParseIP(swept[2]).IsLoopback() {
+		t.Errorf("got %v, want %v and localhost's address", swept, want)
+	}
+}
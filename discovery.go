@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// readTargetFile reads the targets in path, in format or, when that is
+// empty, the format its name suggests.
+func readTargetFile(path, format string) ([]TargetSpec, error) {
+	f, error := os.Open(path)
+	if error != nil {
+		return nil, error
+	}
+	defer f.Close()
+
+	if format == "" {
+		format = guessTargetFormat(path)
+	}
+	specs, error := parseInventory(f, format, path)
+	if error != nil {
+		return nil, fmt.Errorf("%s: %v", path, error)
+	}
+	return specs, nil
+}
+
+// parseTargetList reads the native format: one target per line, ignoring
+// blank lines and everything after a '#'. Words of the form key=value are
+// labels for the targets on their line:
+//
+//	192.0.2.1 site=ams role=core owner=netops
+func parseTargetList(r io.Reader) ([]TargetSpec, error) {
+	var specs []TargetSpec
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		var addresses []string
+		var labels map[string]string
+		for _, field := range strings.Fields(line) {
+			if strings.Contains(field, "=") {
+				if error := addLabel(&labels, field); error != nil {
+					return nil, error
+				}
+			} else {
+				addresses = append(addresses, field)
+			}
+		}
+		for _, a := range addresses {
+			specs = append(specs, TargetSpec{Address: a, Labels: labels})
+		}
+	}
+	return specs, scanner.Err()
+}
+
+// readTargets reads path, which is either a target file or a directory whose
+// regular, non-hidden files are all target files, in format if one is given.
+// It also returns a fingerprint of the names, sizes and modification times
+// involved, which changes whenever the targets might have.
+func readTargets(path, format string) ([]TargetSpec, string, error) {
+	info, error := os.Stat(path)
+	if error != nil {
+		return nil, "", error
+	}
+	files := []string{path}
+	if info.IsDir() {
+		entries, error := os.ReadDir(path)
+		if error != nil {
+			return nil, "", error
+		}
+		files = files[:0]
+		for _, e := range entries {
+			if e.Type().IsRegular() && !strings.HasPrefix(e.Name(), ".") {
+				files = append(files, filepath.Join(path, e.Name()))
+			}
+		}
+	}
+
+	var specs []TargetSpec
+	var fingerprint strings.Builder
+	for _, name := range files {
+		info, error := os.Stat(name)
+		if error != nil {
+			return nil, "", error
+		}
+		fmt.Fprintf(&fingerprint, "%s|%s|%d\n", name, info.ModTime(), info.Size())
+		list, error := readTargetFile(name, format)
+		if error != nil {
+			return nil, "", error
+		}
+		specs = append(specs, list...)
+	}
+	return specs, fingerprint.String(), nil
+}
+
+// watchTargets keeps the targets of set that come from the file or
+// directory at path in step with its contents, checking for changes every
+// interval. The path may carry a format prefix, as in csv:targets.txt. A
+// file that can't be read keeps the targets it last provided. The first read
+// happens before watchTargets returns, so the first round of probes already
+// includes the targets.
+func watchTargets(set *TargetSet, path string, interval time.Duration) {
+	source := "file:" + path
+	format, path := splitTargetFormat(path)
+	last := ""
+	refresh := func() {
+		specs, fingerprint, error := readTargets(path, format)
+		if error != nil {
+			log.Println(error)
+		} else if fingerprint != last {
+			last = fingerprint
+			added, removed := set.Sync(source, specs)
+			logChanges(source, added, removed)
+		}
+	}
+	refresh()
+	go func() {
+		for range time.Tick(interval) {
+			refresh()
+		}
+	}()
+}
+
+// lookupTargets resolves a DNS name into targets. Names starting with an
+// underscore, like _ping._icmp.example.com, are looked up as SRV records and
+// give the host names they point at. Any other name gives its A and AAAA
+// addresses.
+func lookupTargets(name string) ([]string, error) {
+	var addresses []string
+	if strings.HasPrefix(name, "_") {
+		_, srvs, error := net.LookupSRV("", "", name)
+		if error != nil {
+			return nil, error
+		}
+		for _, srv := range srvs {
+			addresses = append(addresses, strings.TrimSuffix(srv.Target, "."))
+		}
+	} else {
+		ips, error := net.LookupIP(name)
+		if error != nil {
+			return nil, error
+		}
+		for _, ip := range ips {
+			addresses = append(addresses, ip.String())
+		}
+	}
+	sort.Strings(addresses)
+	return addresses, nil
+}
+
+// watchDNS refreshes the targets of set that come from the DNS name in spec
+// every interval, giving them the spec's labels. A failed lookup keeps the
+// targets it last provided. Like watchTargets, it returns after the first
+// lookup.
+func watchDNS(set *TargetSet, spec TargetSpec, interval time.Duration) {
+	source := "dns:" + spec.Address
+	refresh := func() {
+		addresses, error := lookupTargets(spec.Address)
+		if error != nil {
+			log.Println(error)
+		} else {
+			specs := make([]TargetSpec, len(addresses))
+			for i, a := range addresses {
+				specs[i] = TargetSpec{Address: a, Labels: spec.Labels}
+			}
+			added, removed := set.Sync(source, specs)
+			logChanges(source, added, removed)
+		}
+	}
+	refresh()
+	go func() {
+		for range time.Tick(interval) {
+			refresh()
+		}
+	}()
+}
+
+func logChanges(source string, added, removed []string) {
+	for _, a := range added {
+		log.Printf("Target added: %s (from %s)\n", a, source)
+	}
+	for _, a := range removed {
+		log.Printf("Target removed: %s (from %s)\n", a, source)
+	}
+}
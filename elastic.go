@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	elasticBatchSize     = 500             // documents per bulk request
+	elasticFlushInterval = 5 * time.Second // longest a document waits to be sent
+	elasticMaxPending    = 50000           // documents kept while the cluster is unreachable
+	elasticAttempts      = 4               // tries per bulk request
+	elasticBackoff       = 500 * time.Millisecond
+	elasticCloseTimeout  = 10 * time.Second // longest the last flush may take
+)
+
+// elasticOutput indexes a document per probe, and one whenever a target goes
+// down or comes back, through the Elasticsearch bulk API (which OpenSearch
+// speaks too). Documents are batched, go to one index per day, and are
+// retried with backoff when the cluster is unreachable or pushes back.
+type elasticOutput struct {
+	url    string
+	index  string // prefix of the daily index names
+	client *http.Client
+
+	mu      sync.Mutex
+	pending []elasticDoc
+	down    map[string]time.Time // outage start of the targets that are down
+
+	kick chan struct{}
+	send sync.Mutex // one flush at a time
+
+	// stop ends the periodic flushes, cutting short a request or a backoff
+	// in progress so Close doesn't wait for it
+	ctx  context.Context
+	stop context.CancelFunc
+}
+
+// elasticDoc is one bulk index action: the index and the document source.
+type elasticDoc struct {
+	index  string
+	source []byte
+}
+
+// elasticProbe and elasticEvent are the documents indexed.
+type elasticProbe struct {
+	Timestamp time.Time         `json:"@timestamp"`
+	Type      string            `json:"type"` // "probe"
+	Target    string            `json:"target"`
+	Address   string            `json:"address,omitempty"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	Seq       int               `json:"seq"`
+	Success   bool              `json:"success"`
+	RTT       float64           `json:"rtt_ms,omitempty"`
+	TTL       int               `json:"ttl,omitempty"`
+	Size      int               `json:"size,omitempty"`
+	Error     string            `json:"error,omitempty"`
+}
+
+type elasticEvent struct {
+	Timestamp time.Time         `json:"@timestamp"`
+	Type      string            `json:"type"` // "outage_start" or "outage_end"
+	Target    string            `json:"target"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	DownSince time.Time         `json:"down_since"`
+	Duration  float64           `json:"duration_ms,omitempty"` // of the outage that ended
+}
+
+func newElasticOutput(url, index string) *elasticOutput {
+	o := &elasticOutput{
+		url:    strings.TrimSuffix(url, "/"),
+		index:  index,
+		client: &http.Client{Timeout: 30 * time.Second},
+		down:   make(map[string]time.Time),
+		kick:   make(chan struct{}, 1),
+	}
+	o.ctx, o.stop = context.WithCancel(context.Background())
+	go o.run()
+	return o
+}
+
+func (o *elasticOutput) Probe(r ProbeResult) {
+	doc := elasticProbe{
+		Timestamp: r.Time,
+		Type:      "probe",
+		Target:    r.Target,
+		Address:   r.Address,
+		Labels:    r.Labels,
+		Seq:       r.Seq,
+		Success:   r.Error == "",
+		Error:     r.Error,
+	}
+	if doc.Success {
+		doc.RTT = milliseconds(r.RTT)
+		doc.TTL = r.TTL
+		doc.Size = r.Size
+	}
+	o.add(r.Time, doc)
+
+	o.mu.Lock()
+	since, wasDown := o.down[r.Target]
+	switch {
+	case r.Down && !wasDown:
+		o.down[r.Target] = r.DownSince
+		o.mu.Unlock()
+		o.add(r.Time, elasticEvent{Timestamp: r.Time, Type: "outage_start", Target: r.Target, Labels: r.Labels, DownSince: r.DownSince})
+	case !r.Down && wasDown:
+		delete(o.down, r.Target)
+		o.mu.Unlock()
+		o.add(r.Time, elasticEvent{Timestamp: r.Time, Type: "outage_end", Target: r.Target, Labels: r.Labels,
+			DownSince: since, Duration: milliseconds(r.Time.Sub(since))})
+	default:
+		o.mu.Unlock()
+	}
+}
+
+func (o *elasticOutput) Summary(s Summary) {}
+
+func (o *elasticOutput) Final(s Summary) {}
+
+// Close sends whatever is still pending, as the pinger is about to exit,
+// giving up after elasticCloseTimeout rather than holding up the exit for
+// a cluster that isn't there.
+func (o *elasticOutput) Close() {
+	o.stop()
+	ctx, cancel := context.WithTimeout(context.Background(), elasticCloseTimeout)
+	defer cancel()
+	o.flush(ctx)
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if len(o.pending) > 0 {
+		log.Printf("Elasticsearch: giving up on %d documents\n", len(o.pending))
+	}
+}
+
+// add queues a document for the index of the day t falls on.
+func (o *elasticOutput) add(t time.Time, doc interface{}) {
+	source, error := json.Marshal(doc)
+	if error != nil {
+		log.Println(error)
+		return
+	}
+	o.mu.Lock()
+	o.pending = append(o.pending, elasticDoc{index: o.index + "-" + t.UTC().Format("2006.01.02"), source: source})
+	if n := len(o.pending) - elasticMaxPending; n > 0 {
+		o.pending = o.pending[n:]
+		log.Printf("Elasticsearch: dropped %d documents, too many pending\n", n)
+	}
+	full := len(o.pending) >= elasticBatchSize
+	o.mu.Unlock()
+	if full {
+		select {
+		case o.kick <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// run flushes every elasticFlushInterval, or as soon as a batch is full.
+func (o *elasticOutput) run() {
+	tick := time.NewTicker(elasticFlushInterval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+		case <-o.kick:
+		case <-o.ctx.Done():
+			return
+		}
+		o.flush(o.ctx)
+	}
+}
+
+// flush sends the pending documents in batches until ctx is done. A batch
+// that fails for good is put back to be tried on the next flush.
+func (o *elasticOutput) flush(ctx context.Context) {
+	o.send.Lock()
+	defer o.send.Unlock()
+	for {
+		o.mu.Lock()
+		n := len(o.pending)
+		if n > elasticBatchSize {
+			n = elasticBatchSize
+		}
+		batch := o.pending[:n:n]
+		o.pending = o.pending[n:]
+		o.mu.Unlock()
+		if len(batch) == 0 {
+			return
+		}
+
+		for attempt := 1; ; attempt++ {
+			retry, error := o.bulk(ctx, batch)
+			if error == nil && len(retry) == 0 {
+				break
+			}
+			if error == nil {
+				error = fmt.Errorf("%d documents rejected", len(retry))
+				batch = retry
+			}
+			keep := func() {
+				o.mu.Lock()
+				o.pending = append(batch, o.pending...)
+				o.mu.Unlock()
+			}
+			if ctx.Err() != nil {
+				keep()
+				return
+			}
+			if attempt == elasticAttempts {
+				log.Printf("Elasticsearch: %v, keeping %d documents for later\n", error, len(batch))
+				keep()
+				return
+			}
+			select {
+			case <-time.After(elasticBackoff << uint(attempt-1)):
+			case <-ctx.Done():
+				keep()
+				return
+			}
+		}
+	}
+}
+
+// bulk sends one bulk request. It returns the documents worth retrying:
+// all of them when the request as a whole failed, or those the cluster
+// turned down for being overloaded. Documents rejected for good, say for
+// not matching the mapping, are logged and dropped.
+func (o *elasticOutput) bulk(ctx context.Context, docs []elasticDoc) ([]elasticDoc, error) {
+	var body bytes.Buffer
+	for _, d := range docs {
+		action, _ := json.Marshal(map[string]map[string]string{"index": {"_index": d.index}})
+		body.Write(action)
+		body.WriteByte('\n')
+		body.Write(d.source)
+		body.WriteByte('\n')
+	}
+	req, error := http.NewRequestWithContext(ctx, http.MethodPost, o.url+"/_bulk", &body)
+	if error != nil {
+		return docs, error
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	resp, error := o.client.Do(req)
+	if error != nil {
+		return docs, error
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+		return docs, fmt.Errorf("bulk request: %s", resp.Status)
+	}
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		log.Printf("Elasticsearch: bulk request: %s: %s, dropping %d documents\n", resp.Status, strings.TrimSpace(string(msg)), len(docs))
+		return nil, nil
+	}
+
+	var result struct {
+		Errors bool `json:"errors"`
+		Items  []map[string]struct {
+			Status int             `json:"status"`
+			Error  json.RawMessage `json:"error"`
+		} `json:"items"`
+	}
+	if error := json.NewDecoder(resp.Body).Decode(&result); error != nil {
+		return docs, fmt.Errorf("bulk response: %v", error)
+	}
+	if !result.Errors {
+		return nil, nil
+	}
+	var retry []elasticDoc
+	dropped := 0
+	var reason json.RawMessage
+	for i, item := range result.Items {
+		for _, r := range item {
+			switch {
+			case r.Status < 300 || i >= len(docs):
+			case r.Status == http.StatusTooManyRequests || r.Status >= 500:
+				retry = append(retry, docs[i])
+			default:
+				dropped++
+				reason = r.Error
+			}
+		}
+	}
+	if dropped > 0 {
+		log.Printf("Elasticsearch: %d documents rejected: %s\n", dropped, reason)
+	}
+	return retry, nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestElasticClose checks that the last flush sends what is pending even when no
+// target ever reached Final, and that a cluster that doesn't answer holds
+// up the last flush only until its deadline.
+func TestElasticClose(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		hang    bool
+		docs    int
+		sent    int
+		pending int
+	}{
+		{name: "sent", status: http.StatusOK, docs: 3, sent: 3},
+		{name: "nothing pending", status: http.StatusOK},
+		{name: "overloaded", status: http.StatusServiceUnavailable, docs: 2, pending: 2},
+		{name: "no answer", hang: true, docs: 2, pending: 2},
+	}
+	for _, test := range tests {
+		var mu sync.Mutex
+		sent := 0
+		release := make(chan struct{})
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if test.hang {
+				<-release
+				return
+			}
+			if test.status == http.StatusOK {
+				lines := 0
+				for scanner := bufio.NewScanner(r.Body); scanner.Scan(); lines++ {
+				}
+				mu.Lock()
+				sent += lines / 2
+				mu.Unlock()
+			}
+			w.WriteHeader(test.status)
+			w.Write([]byte(`{"errors":false,"items":[]}`))
+		}))
+
+		o := newElasticOutput(server.URL, "ping")
+		o.stop()
+		for i := 0; i < test.docs; i++ {
+			o.Probe(ProbeResult{Target: "192.0.2.1", Time: time.Now(), Seq: i + 1})
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+		start := time.Now()
+		o.flush(ctx)
+		elapsed := time.Since(start)
+		cancel()
+		close(release)
+		server.Close()
+
+		if elapsed > 2*time.Second {
+			t.Errorf("%s: flush took %v past its deadline", test.name, elapsed)
+		}
+		if sent != test.sent || len(o.pending) != test.pending {
+			t.Errorf("%s: sent %d, %d pending, want %d and %d", test.name, sent, len(o.pending), test.sent, test.pending)
+		}
+	}
+}
+
+func TestCloseOutput(t *testing.T) {
+	var closed []string
+	out := multiOutput{logOutput{}, multiOutput{closeRecorder{"a", &closed}}, closeRecorder{"b", &closed}}
+	closeOutput(out)
+	if strings.Join(closed, ",") != "a,b" {
+		t.Errorf("closed %v, want [a b]", closed)
+	}
+}
+
+type closeRecorder struct {
+	name   string
+	closed *[]string
+}
+
+func (closeRecorder) Probe(r ProbeResult) {}
+func (closeRecorder) Summary(s Summary)   {}
+func (closeRecorder) Final(s Summary)     {}
+func (c closeRecorder) Close()            { *c.closed = append(*c.closed, c.name) }
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+)
+
+// GeoInfo is where an address is and which network it belongs to, as far as
+// the local GeoIP databases know.
+type GeoInfo struct {
+	Country string `json:"country,omitempty"` // ISO 3166 code
+	City    string `json:"city,omitempty"`
+	ASN     uint64 `json:"asn,omitempty"`
+	Org     string `json:"as_org,omitempty"`
+}
+
+// String renders the info compactly for hop listings, e.g.
+// "AS1136 KPN B.V., NL Amsterdam".
+func (g GeoInfo) String() string {
+	var parts []string
+	if g.ASN != 0 {
+		parts = append(parts, strings.TrimSpace(fmt.Sprintf("AS%d %s", g.ASN, g.Org)))
+	}
+	if place := strings.TrimSpace(g.Country + " " + g.City); place != "" {
+		parts = append(parts, place)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// labels returns the info as target labels.
+func (g GeoInfo) labels() map[string]string {
+	labels := make(map[string]string)
+	if g.Country != "" {
+		labels["country"] = g.Country
+	}
+	if g.City != "" {
+		labels["city"] = g.City
+	}
+	if g.ASN != 0 {
+		labels["asn"] = fmt.Sprintf("AS%d", g.ASN)
+	}
+	if g.Org != "" {
+		labels["as_org"] = g.Org
+	}
+	return labels
+}
+
+// geoDB is the set of MaxMind DB files given with -geoip. City (or Country)
+// and ASN data come in separate files, so every lookup consults them all.
+type geoDB []*mmdb
+
+func openGeoDB(paths []string) (geoDB, error) {
+	var db geoDB
+	for _, path := range paths {
+		m, error := openMMDB(path)
+		if error != nil {
+			return nil, error
+		}
+		db = append(db, m)
+	}
+	return db, nil
+}
+
+// lookup merges what the databases know about ip. Addresses the databases
+// have no record for, such as private ones, get an empty GeoInfo.
+func (db geoDB) lookup(ip net.IP) GeoInfo {
+	var g GeoInfo
+	for _, m := range db {
+		record, error := m.lookup(ip)
+		if error != nil {
+			continue
+		}
+		if s, ok := mmdbPath(record, "country", "iso_code").(string); ok {
+			g.Country = s
+		}
+		if s, ok := mmdbPath(record, "city", "names", "en").(string); ok {
+			g.City = s
+		}
+		if n, ok := mmdbPath(record, "autonomous_system_number").(uint64); ok {
+			g.ASN = n
+		}
+		if s, ok := mmdbPath(record, "autonomous_system_organization").(string); ok {
+			g.Org = s
+		}
+	}
+	return g
+}
+
+// mmdbPath digs the value at the path of map keys out of a decoded record.
+func mmdbPath(record interface{}, keys ...string) interface{} {
+	for _, key := range keys {
+		m, ok := record.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		record = m[key]
+	}
+	return record
+}
+
+// geoLabels labels targets with the location and network of the address they
+// currently resolve to, through the "geoip" source.
+type geoLabels struct {
+	db geoDB
+
+	mu      sync.Mutex
+	targets map[string]map[string]string // by target address
+}
+
+func newGeoLabels(db geoDB) *geoLabels {
+	return &geoLabels{db: db, targets: make(map[string]map[string]string)}
+}
+
+// observe looks up the address target resolved to and returns its labels.
+func (g *geoLabels) observe(target string, ip net.IP) map[string]string {
+	labels := g.db.lookup(ip).labels()
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if len(labels) == 0 {
+		delete(g.targets, target)
+	} else {
+		g.targets[target] = labels
+	}
+	return labels
+}
+
+// sync brings the "geoip" source of set up to date, forgetting targets that
+// no other source lists any more. It runs after the "nat64" source's sync,
+// so it never keeps a target alive that nat64 just let go of.
+func (g *geoLabels) sync(set *TargetSet) {
+	g.mu.Lock()
+	var specs []TargetSpec
+	for target, labels := range g.targets {
+		if !set.ListedBy(target, "geoip") {
+			delete(g.targets, target)
+			continue
+		}
+		specs = append(specs, TargetSpec{Address: target, Labels: labels})
+	}
+	g.mu.Unlock()
+	set.Sync("geoip", specs)
+}
@@ -4,4 +4,4 @@ go 1.17
 
 require golang.org/x/net v0.0.0-20220403103023-749bd193bc2b
 
-require golang.org/x/sys v0.0.0-20211216021012-1d35b9e2eb4e // indirect
+require golang.org/x/sys v0.0.0-20211216021012-1d35b9e2eb4e
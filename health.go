@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// healthStale is how old a target's last probe may be before its figures
+// are no longer trusted, as when the probe loop is stuck.
+const healthStale = 30 * time.Second
+
+// healthPolicy decides whether targets, and the groups they form, are
+// healthy, for load balancers and keepalived to fail over on. A target is
+// healthy when it is not down and its recent loss and RTT are within the
+// limits. A group is healthy when enough of its targets are.
+type healthPolicy struct {
+	Label      string        // the label naming a target's group
+	MaxLoss    float64       // percent of the recent probes
+	MaxRTT     time.Duration // of the recent probes on average, 0 for no limit
+	MinHealthy float64       // percent of the group's targets
+}
+
+// healthReport is the body of a health response.
+type healthReport struct {
+	Group   string         `json:"group,omitempty"`
+	Healthy bool           `json:"healthy"`
+	Up      int            `json:"healthy_targets"`
+	Total   int            `json:"targets"`
+	Targets []targetHealth `json:"details"`
+}
+
+type targetHealth struct {
+	Target     string  `json:"target"`
+	Healthy    bool    `json:"healthy"`
+	Reason     string  `json:"reason,omitempty"`
+	RecentLoss float64 `json:"recent_loss_percent"`
+	RecentRTT  float64 `json:"recent_avg_rtt_ms"`
+}
+
+// check tells whether a target with the statistics s is healthy, and if
+// not, why.
+func (p healthPolicy) check(s StatsSnapshot, now time.Time) (bool, string) {
+	switch {
+	case s.Sent == 0:
+		return false, "not probed yet"
+	case now.Sub(s.LastProbe) > healthStale:
+		return false, fmt.Sprintf("last probed %s ago", now.Sub(s.LastProbe).Round(time.Second))
+	case s.Down:
+		return false, "down"
+	case s.RecentLoss > p.MaxLoss:
+		return false, fmt.Sprintf("%.0f%% loss", s.RecentLoss)
+	case p.MaxRTT > 0 && s.RecentRTT > p.MaxRTT:
+		return false, fmt.Sprintf("%.3f ms RTT", milliseconds(s.RecentRTT))
+	}
+	return true, ""
+}
+
+// report checks the targets of set in group, or all of them when group is
+// empty. A target can be in several groups, as Ansible inventories put it,
+// by listing them comma-separated in its group label.
+func (p healthPolicy) report(set *TargetSet, group string) healthReport {
+	now := time.Now()
+	r := healthReport{Group: group, Targets: []targetHealth{}}
+	for _, t := range set.List() {
+		if group != "" && !contains(strings.Split(t.Labels()[p.Label], ","), group) {
+			continue
+		}
+		s := t.Stats.Snapshot()
+		healthy, reason := p.check(s, now)
+		r.Targets = append(r.Targets, targetHealth{
+			Target: t.Address, Healthy: healthy, Reason: reason,
+			RecentLoss: s.RecentLoss, RecentRTT: milliseconds(s.RecentRTT),
+		})
+		r.Total++
+		if healthy {
+			r.Up++
+		}
+	}
+	r.Healthy = r.Total > 0 && float64(r.Up) >= p.MinHealthy/100*float64(r.Total)
+	return r
+}
+
+// serveHealth answers /health and /health/<group> with 200 when the group is
+// healthy and 503 when it is not, which is all HAProxy's httpchk and
+// keepalived's HTTP_GET look at. The body has the details. A group with no
+// targets is 404.
+func (p healthPolicy) serveHealth(set *TargetSet) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		group := strings.Trim(strings.TrimPrefix(r.URL.Path, "/health"), "/")
+		report := p.report(set, group)
+		status := http.StatusOK
+		switch {
+		case report.Total == 0:
+			status = http.StatusNotFound
+		case !report.Healthy:
+			status = http.StatusServiceUnavailable
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(report)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHealthCheck(t *testing.T) {
+	now := time.Now()
+	p := healthPolicy{MaxLoss: 20, MaxRTT: 50 * time.Millisecond}
+	tests := []struct {
+		name    string
+		stats   StatsSnapshot
+		healthy bool
+		reason  string
+	}{
+		{"healthy", StatsSnapshot{Sent: 10, LastProbe: now, RecentLoss: 10, RecentRTT: 20 * time.Millisecond}, true, ""},
+		{"not probed", StatsSnapshot{}, false, "not probed yet"},
+		{"stale", StatsSnapshot{Sent: 10, LastProbe: now.Add(-time.Minute)}, false, "last probed 1m0s ago"},
+		{"down", StatsSnapshot{Sent: 10, LastProbe: now, Down: true, RecentLoss: 100}, false, "down"},
+		{"lossy", StatsSnapshot{Sent: 10, LastProbe: now, RecentLoss: 30}, false, "30% loss"},
+		{"slow", StatsSnapshot{Sent: 10, LastProbe: now, RecentRTT: 60 * time.Millisecond}, false, "60.000 ms RTT"},
+	}
+	for _, test := range tests {
+		healthy, reason := p.check(test.stats, now)
+		if healthy != test.healthy || reason != test.reason {
+			t.Errorf("%s: got %v, %q, want %v, %q", test.name, healthy, reason, test.healthy, test.reason)
+		}
+	}
+}
+
+func TestHealthGroups(t *testing.T) {
+	set := NewTargetSet()
+	set.Sync("test", []TargetSpec{
+		{Address: "192.0.2.1", Labels: map[string]string{"group": "webservers"}},
+		{Address: "192.0.2.2", Labels: map[string]string{"group": "dbservers,webservers"}},
+		{Address: "192.0.2.3", Labels: map[string]string{"group": "dbservers"}},
+		{Address: "192.0.2.4", Labels: map[string]string{"group": "web"}},
+		{Address: "192.0.2.5"},
+	})
+	for _, target := range set.List() {
+		var error error
+		if target.Address == "192.0.2.3" {
+			error = errors.New("timeout")
+		}
+		target.Stats.Record(time.Millisecond, error)
+	}
+
+	p := healthPolicy{Label: "group", MaxLoss: 20, MinHealthy: 50}
+	tests := []struct {
+		group     string
+		up, total int
+		healthy   bool
+		status    int
+	}{
+		{"", 4, 5, true, http.StatusOK},
+		{"webservers", 2, 2, true, http.StatusOK},
+		{"dbservers", 1, 2, true, http.StatusOK},
+		{"web", 1, 1, true, http.StatusOK},
+		{"servers", 0, 0, false, http.StatusNotFound},
+	}
+	for _, test := range tests {
+		r := p.report(set, test.group)
+		if r.Up != test.up || r.Total != test.total || r.Healthy != test.healthy {
+			t.Errorf("group %q: %d of %d healthy (%v), want %d of %d (%v)", test.group, r.Up, r.Total, r.Healthy, test.up, test.total, test.healthy)
+		}
+		w := httptest.NewRecorder()
+		p.serveHealth(set)(w, httptest.NewRequest(http.MethodGet, "/health/"+test.group, nil))
+		if w.Code != test.status {
+			t.Errorf("group %q: status %d, want %d", test.group, w.Code, test.status)
+		}
+	}
+
+	p.MinHealthy = 100
+	if r := p.report(set, "dbservers"); r.Healthy {
+		t.Error("dbservers healthy with one of two targets failing and -health-min-healthy 100")
+	}
+}
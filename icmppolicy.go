@@ -0,0 +1,494 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// policyMagic marks the token in policy test messages, so the receiving side
+// can pick them out of all the ICMP a raw socket sees.
+const policyMagic = "icmp-policy:"
+
+// policyCase is one ICMP type and code to try through the firewall, with
+// what the recommendations say should happen to it in transit.
+type policyCase struct {
+	v6        bool
+	typ, code int
+	name      string
+	expect    string // pass, drop, or policy when it is up to the site
+	reference string
+}
+
+// policyCases follow RFC 4890 section 4.3 for ICMPv6. IPv4 has no such
+// document, so its cases follow the RFCs that define or deprecate each type.
+var policyCases = []policyCase{
+	{false, 8, 0, "echo request", "pass", "RFC 792"},
+	{false, 3, 0, "net unreachable", "pass", "RFC 1122"},
+	{false, 3, 1, "host unreachable", "pass", "RFC 1122"},
+	{false, 3, 3, "port unreachable", "pass", "RFC 1122"},
+	{false, 3, 4, "fragmentation needed", "pass", "RFC 1191"},
+	{false, 3, 13, "administratively prohibited", "pass", "RFC 1812"},
+	{false, 4, 0, "source quench", "drop", "RFC 6633"},
+	{false, 11, 0, "TTL exceeded in transit", "pass", "RFC 1122"},
+	{false, 11, 1, "fragment reassembly time exceeded", "pass", "RFC 1122"},
+	{false, 12, 0, "parameter problem", "pass", "RFC 1122"},
+	{false, 13, 0, "timestamp request", "policy", "RFC 792"},
+	{false, 15, 0, "information request", "drop", "RFC 6918"},
+	{false, 17, 0, "address mask request", "drop", "RFC 6918"},
+
+	{true, 128, 0, "echo request", "pass", "RFC 4890 4.3.1"},
+	{true, 1, 0, "no route to destination", "pass", "RFC 4890 4.3.1"},
+	{true, 1, 1, "administratively prohibited", "pass", "RFC 4890 4.3.1"},
+	{true, 1, 3, "address unreachable", "pass", "RFC 4890 4.3.1"},
+	{true, 1, 4, "port unreachable", "pass", "RFC 4890 4.3.1"},
+	{true, 2, 0, "packet too big", "pass", "RFC 4890 4.3.1"},
+	{true, 3, 0, "hop limit exceeded in transit", "pass", "RFC 4890 4.3.1"},
+	{true, 3, 1, "fragment reassembly time exceeded", "pass", "RFC 4890 4.3.2"},
+	{true, 4, 0, "erroneous header field", "pass", "RFC 4890 4.3.2"},
+	{true, 4, 1, "unrecognized next header", "pass", "RFC 4890 4.3.1"},
+	{true, 4, 2, "unrecognized IPv6 option", "pass", "RFC 4890 4.3.1"},
+	{true, 5, 0, "unallocated error type", "policy", "RFC 4890 4.3.4"},
+	{true, 100, 0, "private experimentation (error)", "drop", "RFC 4890 4.3.5"},
+	{true, 138, 0, "router renumbering", "drop", "RFC 4890 4.3.5"},
+	{true, 139, 0, "node information query", "drop", "RFC 4890 4.3.5"},
+	{true, 200, 0, "private experimentation (informational)", "drop", "RFC 4890 4.3.5"},
+}
+
+// PolicyResult says whether one ICMP type and code made it through in each
+// direction.
+type PolicyResult struct {
+	Family        string `json:"family"`
+	Type          int    `json:"type"`
+	Code          int    `json:"code"`
+	Name          string `json:"name"`
+	Expect        string `json:"expect"`
+	Reference     string `json:"reference"`
+	ToReflector   bool   `json:"to_reflector"`
+	FromReflector bool   `json:"from_reflector"`
+}
+
+// verdict is empty when the result agrees with the recommendation.
+func (r PolicyResult) verdict() string {
+	switch {
+	case r.Expect == "pass" && !(r.ToReflector && r.FromReflector):
+		return "should pass"
+	case r.Expect == "drop" && (r.ToReflector || r.FromReflector):
+		return "should be dropped"
+	}
+	return ""
+}
+
+// icmpPolicyCommand sends every ICMP type and code in policyCases to a
+// reflector on the far side of a firewall and has the reflector send each of
+// them back, then reports which got through in which direction and where
+// that differs from the recommendations.
+func icmpPolicyCommand(args []string) error {
+	flags := flag.NewFlagSet("icmp-policy", flag.ExitOnError)
+	port := flags.Int("port", 7777, "TCP port the reflector listens on")
+	timeout := flags.Duration("W", time.Second, "time to wait for each message to arrive")
+	jsonOutput := flags.Bool("json", false, "print the results as JSON")
+	flags.Usage = func() {
+		fmt.Println("Usage: ping icmp-policy [-port 7777] [-W timeout] [-json] <reflector>")
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	ips := []net.IP{net.ParseIP(flags.Arg(0))}
+	if ips[0] == nil {
+		var error error
+		if ips, error = net.LookupIP(flags.Arg(0)); error != nil {
+			return error
+		}
+	}
+	var results []PolicyResult
+	for _, v6 := range []bool{false, true} {
+		for _, ip := range ips {
+			if (ip.To4() == nil) == v6 {
+				r, error := testPolicy(ip, *port, *timeout)
+				if error != nil {
+					return error
+				}
+				results = append(results, r...)
+				break
+			}
+		}
+	}
+
+	violations := 0
+	for _, r := range results {
+		if r.verdict() != "" {
+			violations++
+		}
+	}
+	if *jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if error := enc.Encode(results); error != nil {
+			return error
+		}
+	} else {
+		printPolicyResults(results)
+		fmt.Printf("%d of %d messages handled against the recommendations\n", violations, len(results))
+	}
+	if violations > 0 {
+		os.Exit(1)
+	}
+	return nil
+}
+
+func printPolicyResults(results []PolicyResult) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "family\ttype/code\tmessage\tto reflector\tfrom reflector\texpected\t")
+	passed := map[bool]string{true: "passed", false: "blocked"}
+	for _, r := range results {
+		expect := r.Expect + " (" + r.Reference + ")"
+		if v := r.verdict(); v != "" {
+			expect += "  <- " + v
+		}
+		fmt.Fprintf(w, "%s\t%d/%d\t%s\t%s\t%s\t%s\t\n", r.Family, r.Type, r.Code, r.Name,
+			passed[r.ToReflector], passed[r.FromReflector], expect)
+	}
+	w.Flush()
+}
+
+// testPolicy runs the cases for ip's family against the reflector at ip.
+func testPolicy(ip net.IP, port int, timeout time.Duration) ([]PolicyResult, error) {
+	v6 := ip.To4() == nil
+	family := "IPv4"
+	if v6 {
+		family = "IPv6"
+	}
+
+	c, error := net.DialTimeout("tcp", net.JoinHostPort(ip.String(), strconv.Itoa(port)), 5*time.Second)
+	if error != nil {
+		return nil, fmt.Errorf("reflector: %v", error)
+	}
+	defer c.Close()
+	raw, error := listenPolicy(v6)
+	if error != nil {
+		return nil, error
+	}
+	defer raw.Close()
+	tokens := newTokenSet()
+	go tokens.collect(raw)
+
+	control := bufio.NewReader(c)
+
+	var results []PolicyResult
+	for _, pc := range policyCases {
+		if pc.v6 != v6 {
+			continue
+		}
+		r := PolicyResult{Family: family, Type: pc.typ, Code: pc.code, Name: pc.name, Expect: pc.expect, Reference: pc.reference}
+
+		// errors quote a packet of the control connection as the
+		// receiving side sent it, so that stateful firewalls see them as
+		// related to an existing flow, as real errors would be
+		token := newPolicyToken()
+		m := policyMessage(v6, pc.typ, pc.code, token, c.RemoteAddr().(*net.TCPAddr), c.LocalAddr().(*net.TCPAddr))
+		if _, error := raw.WriteTo(m, &net.IPAddr{IP: ip}); error == nil {
+			answer, error := askReflector(c, control, fmt.Sprintf("SEEN %s %d", token, timeout.Milliseconds()))
+			if error != nil {
+				return nil, fmt.Errorf("reflector: %v", error)
+			}
+			r.ToReflector = answer == "YES"
+		}
+
+		token = newPolicyToken()
+		answer, error := askReflector(c, control, fmt.Sprintf("SEND %d %d %s", pc.typ, pc.code, token))
+		if error != nil {
+			return nil, fmt.Errorf("reflector: %v", error)
+		}
+		if answer == "OK" {
+			r.FromReflector = tokens.wait(token, timeout)
+		}
+		results = append(results, r)
+	}
+	return results, nil
+}
+
+// askReflector sends one request line and returns the answer line.
+func askReflector(c net.Conn, r *bufio.Reader, request string) (string, error) {
+	if _, error := fmt.Fprintln(c, request); error != nil {
+		return "", error
+	}
+	line, error := r.ReadString('\n')
+	return strings.TrimSpace(line), error
+}
+
+// reflectorCommand is the far side of icmp-policy. It reports which test
+// messages it received and sends the ones it is asked for back to the
+// tester.
+func reflectorCommand(args []string) error {
+	flags := flag.NewFlagSet("reflector", flag.ExitOnError)
+	listen := flags.String("listen", ":7777", "address to accept icmp-policy testers on")
+	flags.Parse(args)
+
+	tokens := newTokenSet()
+	var raw [2]net.PacketConn
+	for i, v6 := range []bool{false, true} {
+		c, error := listenPolicy(v6)
+		if error != nil {
+			if v6 {
+				log.Printf("No IPv6: %v", error)
+				continue
+			}
+			return error
+		}
+		raw[i] = c
+		go tokens.collect(c)
+	}
+
+	l, error := net.Listen("tcp", *listen)
+	if error != nil {
+		return error
+	}
+	log.Printf("Reflecting ICMP for testers on %s", l.Addr())
+	for {
+		c, error := l.Accept()
+		if error != nil {
+			return error
+		}
+		go serveReflector(c, raw, tokens)
+	}
+}
+
+func serveReflector(c net.Conn, raw [2]net.PacketConn, tokens *tokenSet) {
+	defer c.Close()
+	remote, local := c.RemoteAddr().(*net.TCPAddr), c.LocalAddr().(*net.TCPAddr)
+	v6 := remote.IP.To4() == nil
+	conn := raw[0]
+	if v6 {
+		conn = raw[1]
+	}
+	log.Printf("Tester connected from %s", remote)
+
+	scanner := bufio.NewScanner(c)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		switch {
+		case len(fields) == 3 && fields[0] == "SEEN":
+			ms, _ := strconv.Atoi(fields[2])
+			if tokens.wait(fields[1], time.Duration(ms)*time.Millisecond) {
+				fmt.Fprintln(c, "YES")
+			} else {
+				fmt.Fprintln(c, "NO")
+			}
+		case len(fields) == 4 && fields[0] == "SEND":
+			typ, error1 := strconv.Atoi(fields[1])
+			code, error2 := strconv.Atoi(fields[2])
+			if error1 != nil || error2 != nil || conn == nil {
+				fmt.Fprintln(c, "ERR bad request")
+				continue
+			}
+			m := policyMessage(v6, typ, code, fields[3], remote, local)
+			if _, error := conn.WriteTo(m, &net.IPAddr{IP: remote.IP}); error != nil {
+				fmt.Fprintf(c, "ERR %v\n", error)
+				continue
+			}
+			fmt.Fprintln(c, "OK")
+		default:
+			fmt.Fprintln(c, "ERR bad request")
+		}
+	}
+	log.Printf("Tester %s done", remote)
+}
+
+// listenPolicy opens the raw socket test messages are sent and seen on.
+func listenPolicy(v6 bool) (net.PacketConn, error) {
+	if v6 {
+		return listenICMP("ip6:ipv6-icmp", "::", SocketOptions{})
+	}
+	return listenICMP("ip4:icmp", "0.0.0.0", SocketOptions{})
+}
+
+func newPolicyToken() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// policyMessage builds an ICMP message of the given type and code carrying
+// token. Error messages quote a TCP packet from the recipient's address
+// from to the sender's address to, informational ones just carry the token.
+// IPv6 checksums are left to the kernel, which fills them in for raw
+// ICMPv6 sockets.
+func policyMessage(v6 bool, typ, code int, token string, from, to *net.TCPAddr) []byte {
+	data := []byte(policyMagic + token)
+	m := []byte{byte(typ), byte(code), 0, 0, 0, 0, 0, 0}
+	isError := typ < 128
+	if !v6 {
+		isError = typ == 3 || typ == 4 || typ == 5 || typ == 11 || typ == 12
+	}
+	switch {
+	case !v6 && typ == 3 && code == 4:
+		// the next-hop MTU
+		binary.BigEndian.PutUint16(m[6:8], 1280)
+	case v6 && typ == 2:
+		binary.BigEndian.PutUint32(m[4:8], 1280)
+	case !v6 && typ == 13:
+		// originate, receive and transmit timestamps
+		m = append(m, make([]byte, 12)...)
+	}
+	if isError {
+		data = quotedTCP(v6, from, to, data)
+	}
+	m = append(m, data...)
+	if !v6 {
+		binary.BigEndian.PutUint16(m[2:4], checksum(m))
+	}
+	return m
+}
+
+// quotedTCP builds the start of a TCP packet from from to to carrying data,
+// as an ICMP error quotes the packet that caused it.
+func quotedTCP(v6 bool, from, to *net.TCPAddr, data []byte) []byte {
+	tcp := make([]byte, 20)
+	binary.BigEndian.PutUint16(tcp[0:2], uint16(from.Port))
+	binary.BigEndian.PutUint16(tcp[2:4], uint16(to.Port))
+	tcp[12] = 5 << 4 // data offset
+	tcp[13] = 0x18   // PSH, ACK
+	tcp = append(tcp, data...)
+
+	if v6 {
+		ip := make([]byte, 40)
+		ip[0] = 6 << 4
+		binary.BigEndian.PutUint16(ip[4:6], uint16(len(tcp)))
+		ip[6], ip[7] = 6, 64 // next header TCP, hop limit
+		copy(ip[8:24], from.IP.To16())
+		copy(ip[24:40], to.IP.To16())
+		return append(ip, tcp...)
+	}
+	ip := make([]byte, 20)
+	ip[0] = 4<<4 | 5
+	binary.BigEndian.PutUint16(ip[2:4], uint16(20+len(tcp)))
+	ip[6] = 0x40         // DF
+	ip[8], ip[9] = 64, 6 // TTL, protocol TCP
+	copy(ip[12:16], from.IP.To4())
+	copy(ip[16:20], to.IP.To4())
+	binary.BigEndian.PutUint16(ip[10:12], checksum(ip))
+	return append(ip, tcp...)
+}
+
+// checksum is the Internet checksum of RFC 1071.
+func checksum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
+
+// maxTokenAge is how long a token that turned up is kept for a tester to ask
+// about it. Tokens nobody asks about, from testers that went away or from
+// stray packets, are dropped after that.
+const maxTokenAge = time.Minute
+
+// tokenSet remembers the test tokens seen on raw sockets and lets one wait
+// for a token to turn up.
+type tokenSet struct {
+	mu      sync.Mutex
+	seen    map[string]*policyToken
+	expired time.Time // when old tokens were last dropped
+}
+
+type policyToken struct {
+	ch   chan struct{} // closed when the token turns up
+	seen time.Time
+}
+
+func newTokenSet() *tokenSet {
+	return &tokenSet{seen: make(map[string]*policyToken)}
+}
+
+func (t *tokenSet) token(token string) *policyToken {
+	p := t.seen[token]
+	if p == nil {
+		p = &policyToken{ch: make(chan struct{})}
+		t.seen[token] = p
+	}
+	return p
+}
+
+// collect reads c until it is closed, marking every token it finds.
+func (t *tokenSet) collect(c net.PacketConn) {
+	buf := make([]byte, 65536)
+	tokenLen := len(newPolicyToken())
+	for {
+		n, _, error := c.ReadFrom(buf)
+		if error != nil {
+			return
+		}
+		i := bytes.Index(buf[:n], []byte(policyMagic))
+		if i < 0 || i+len(policyMagic)+tokenLen > n {
+			continue
+		}
+		t.mark(string(buf[i+len(policyMagic):i+len(policyMagic)+tokenLen]), time.Now())
+	}
+}
+
+// mark records that token turned up at now, waking up whoever waits for it,
+// and drops the tokens that turned up more than maxTokenAge ago without
+// anyone asking. Tokens still being waited for have not turned up and stay.
+func (t *tokenSet) mark(token string, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	p := t.token(token)
+	if p.seen.IsZero() {
+		p.seen = now
+		close(p.ch)
+	}
+	if now.Sub(t.expired) < maxTokenAge/2 {
+		return
+	}
+	t.expired = now
+	for token, p := range t.seen {
+		if !p.seen.IsZero() && now.Sub(p.seen) > maxTokenAge {
+			delete(t.seen, token)
+		}
+	}
+}
+
+// wait reports whether token turns up within timeout, and forgets it.
+func (t *tokenSet) wait(token string, timeout time.Duration) bool {
+	t.mu.Lock()
+	ch := t.token(token).ch
+	t.mu.Unlock()
+	defer func() {
+		t.mu.Lock()
+		delete(t.seen, token)
+		t.mu.Unlock()
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-ch:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestChecksum(t *testing.T) {
+	tests := []struct {
+		name string
+		in   []byte
+		want uint16
+	}{
+		{"empty", nil, 0xffff},
+		{"RFC 1071 example", []byte{0x00, 0x01, 0xf2, 0x03, 0xf4, 0xf5, 0xf6, 0xf7}, 0x220d},
+		{"odd length", []byte{0x00, 0x01, 0xf2}, ^uint16(0xf201)},
+		{"carry", []byte{0xff, 0xff, 0x00, 0x01}, 0xfffe},
+		{"echo request", []byte{8, 0, 0, 0, 0x12, 0x34, 0, 1}, 0xe5ca},
+	}
+	for _, test := range tests {
+		if got := checksum(test.in); got != test.want {
+			t.Errorf("%s: got %#04x, want %#04x", test.name, got, test.want)
+		}
+	}
+}
+
+func TestQuotedTCP(t *testing.T) {
+	from := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 40000}
+	to := &net.TCPAddr{IP: net.ParseIP("198.51.100.2"), Port: 7777}
+	from6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 40000}
+	to6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 7777}
+	data := []byte("payload")
+	tests := []struct {
+		name     string
+		v6       bool
+		from, to *net.TCPAddr
+		header   int
+	}{
+		{"IPv4", false, from, to, 20},
+		{"IPv6", true, from6, to6, 40},
+	}
+	for _, test := range tests {
+		p := quotedTCP(test.v6, test.from, test.to, data)
+		if len(p) != test.header+20+len(data) {
+			t.Errorf("%s: %d bytes", test.name, len(p))
+			continue
+		}
+		var src, dst net.IP
+		if test.v6 {
+			if p[0]>>4 != 6 || p[6] != 6 || int(binary.BigEndian.Uint16(p[4:6])) != 20+len(data) {
+				t.Errorf("%s: bad header % x", test.name, p[:40])
+			}
+			src, dst = net.IP(p[8:24]), net.IP(p[24:40])
+		} else {
+			if p[0] != 0x45 || p[9] != 6 || int(binary.BigEndian.Uint16(p[2:4])) != len(p) || checksum(p[:20]) != 0 {
+				t.Errorf("%s: bad header % x", test.name, p[:20])
+			}
+			src, dst = net.IP(p[12:16]), net.IP(p[16:20])
+		}
+		if !src.Equal(test.from.IP) || !dst.Equal(test.to.IP) {
+			t.Errorf("%s: quoted %v -> %v", test.name, src, dst)
+		}
+		tcp := p[test.header:]
+		if binary.BigEndian.Uint16(tcp[0:2]) != 40000 || binary.BigEndian.Uint16(tcp[2:4]) != 7777 || tcp[12] != 0x50 {
+			t.Errorf("%s: bad TCP header % x", test.name, tcp[:20])
+		}
+		if !bytes.Equal(tcp[20:], data) {
+			t.Errorf("%s: TCP payload %q", test.name, tcp[20:])
+		}
+	}
+}
+
+func TestPolicyMessage(t *testing.T) {
+	from := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 40000}
+	to := &net.TCPAddr{IP: net.ParseIP("198.51.100.2"), Port: 7777}
+	from6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 40000}
+	to6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 7777}
+	const token = "0123456789abcdef"
+	tests := []struct {
+		name      string
+		v6        bool
+		typ, code int
+		rest      uint32 // the second word of the header
+		quoted    int    // bytes of quoted IP and TCP header, 0 for none
+		extra     int    // bytes between the header and the token
+	}{
+		{name: "echo request", typ: 8},
+		{name: "host unreachable", typ: 3, code: 1, quoted: 40},
+		{name: "fragmentation needed", typ: 3, code: 4, rest: 1280, quoted: 40},
+		{name: "TTL exceeded", typ: 11, quoted: 40},
+		{name: "timestamp request", typ: 13, extra: 12},
+		{name: "address mask request", typ: 17},
+		{name: "IPv6 echo request", v6: true, typ: 128},
+		{name: "IPv6 packet too big", v6: true, typ: 2, rest: 1280, quoted: 60},
+		{name: "IPv6 unallocated error", v6: true, typ: 5, quoted: 60},
+		{name: "IPv6 node information", v6: true, typ: 139},
+	}
+	for _, test := range tests {
+		f, tt := from, to
+		if test.v6 {
+			f, tt = from6, to6
+		}
+		m := policyMessage(test.v6, test.typ, test.code, token, f, tt)
+		if want := 8 + test.extra + test.quoted + len(policyMagic+token); len(m) != want {
+			t.Errorf("%s: %d bytes, want %d", test.name, len(m), want)
+			continue
+		}
+		if int(m[0]) != test.typ || int(m[1]) != test.code || binary.BigEndian.Uint32(m[4:8]) != test.rest {
+			t.Errorf("%s: header % x", test.name, m[:8])
+		}
+		if got := string(m[8+test.extra+test.quoted:]); got != policyMagic+token {
+			t.Errorf("%s: carries %q", test.name, got)
+		}
+		switch {
+		case test.v6 && binary.BigEndian.Uint16(m[2:4]) != 0:
+			t.Errorf("%s: checksum set, the kernel fills it in", test.name)
+		case !test.v6 && checksum(m) != 0:
+			t.Errorf("%s: bad checksum", test.name)
+		}
+		if test.quoted > 0 {
+			q := quotedTCP(test.v6, f, tt, []byte(policyMagic+token))
+			if !bytes.Equal(m[8:], q) {
+				t.Errorf("%s: doesn't quote the TCP packet", test.name)
+			}
+		}
+	}
+}
+
+func TestTokenSet(t *testing.T) {
+	tokens := newTokenSet()
+	now := time.Now()
+
+	tokens.mark("early", now)
+	if !tokens.wait("early", time.Second) {
+		t.Errorf("a token that turned up before the question was missed")
+	}
+	if _, ok := tokens.seen["early"]; ok {
+		t.Errorf("a token asked about was kept")
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		tokens.mark("late", time.Now())
+	}()
+	if !tokens.wait("late", 5*time.Second) {
+		t.Errorf("a token that turned up while waiting was missed")
+	}
+	if tokens.wait("never", 10*time.Millisecond) {
+		t.Errorf("a token that never turned up was reported")
+	}
+
+	// tokens nobody asks about expire, those still awaited don't
+	tokens = newTokenSet()
+	tokens.mark("unasked", now)
+	tokens.token("awaited")
+	tokens.mark("recent", now.Add(maxTokenAge))
+	tokens.mark("next", now.Add(2*maxTokenAge))
+	for token, want := range map[string]bool{"unasked": false, "awaited": true, "recent": true, "next": true} {
+		if _, ok := tokens.seen[token]; ok != want {
+			t.Errorf("%s: kept %v, want %v", token, ok, want)
+		}
+	}
+}
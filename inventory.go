@@ -0,0 +1,474 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Target files come in several formats. The native one (one target per line
+// with key=value labels) is the default; inventories kept for other tools
+// are recognised by extension or named with a "format:" prefix on -targets.
+const (
+	formatList    = "list"
+	formatCSV     = "csv"
+	formatAnsible = "ansible" // INI or YAML, told apart by extension
+	formatHosts   = "hosts"   // /etc/hosts style
+)
+
+var targetFormats = []string{formatList, formatCSV, formatAnsible, formatHosts}
+
+// splitTargetFormat splits "csv:path" into its format and path. Without a
+// recognised prefix the format is left empty, to be guessed from the file.
+func splitTargetFormat(s string) (string, string) {
+	if i := strings.IndexByte(s, ':'); i > 0 && contains(targetFormats, s[:i]) {
+		return s[:i], s[i+1:]
+	}
+	return "", s
+}
+
+// guessTargetFormat picks a format from the file name when none was given.
+func guessTargetFormat(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".csv":
+		return formatCSV
+	case ".ini", ".yml", ".yaml":
+		return formatAnsible
+	}
+	if filepath.Base(path) == "hosts" && filepath.Dir(path) == "/etc" {
+		return formatHosts
+	}
+	return formatList
+}
+
+// parseInventory reads targets from r in the given format. name is used for
+// error messages and, for Ansible inventories, to tell YAML from INI.
+func parseInventory(r io.Reader, format, name string) ([]TargetSpec, error) {
+	switch format {
+	case formatCSV:
+		return parseCSVInventory(r)
+	case formatAnsible:
+		if ext := strings.ToLower(filepath.Ext(name)); ext == ".yml" || ext == ".yaml" {
+			return parseAnsibleYAML(r)
+		}
+		return parseAnsibleINI(r)
+	case formatHosts:
+		return parseHostsFile(r)
+	}
+	return parseTargetList(r)
+}
+
+// addressColumns are the CSV headers an address is taken from, most
+// preferred first.
+var addressColumns = []string{"address", "ip", "host", "hostname"}
+
+// parseCSVInventory reads a CSV file with a header row. The address comes
+// from the column named address, ip, host or hostname, preferred in that
+// order (the first column if there is none of those), and every other
+// non-empty column becomes a label named after its header.
+func parseCSVInventory(r io.Reader) ([]TargetSpec, error) {
+	cr := csv.NewReader(r)
+	cr.Comment = '#'
+	cr.FieldsPerRecord = -1
+	header, error := cr.Read()
+	if error != nil {
+		return nil, error
+	}
+	addressColumn, priority := 0, len(addressColumns)
+	for i, h := range header {
+		header[i] = strings.TrimSpace(h)
+		for p, name := range addressColumns[:priority] {
+			if strings.EqualFold(header[i], name) {
+				addressColumn, priority = i, p
+				break
+			}
+		}
+	}
+
+	var specs []TargetSpec
+	for {
+		record, error := cr.Read()
+		if error == io.EOF {
+			return specs, nil
+		}
+		if error != nil {
+			return nil, error
+		}
+		if addressColumn >= len(record) || strings.TrimSpace(record[addressColumn]) == "" {
+			continue
+		}
+		spec := TargetSpec{Address: strings.TrimSpace(record[addressColumn])}
+		for i, value := range record {
+			value = strings.TrimSpace(value)
+			if i == addressColumn || i >= len(header) || value == "" || header[i] == "" {
+				continue
+			}
+			if spec.Labels == nil {
+				spec.Labels = make(map[string]string)
+			}
+			spec.Labels[header[i]] = value
+		}
+		specs = append(specs, spec)
+	}
+}
+
+// parseHostsFile reads an /etc/hosts style file: an address followed by its
+// canonical name and aliases, which become the name and aliases labels.
+func parseHostsFile(r io.Reader) ([]TargetSpec, error) {
+	var specs []TargetSpec
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		spec := TargetSpec{Address: fields[0]}
+		if len(fields) > 1 {
+			spec.Labels = map[string]string{"name": fields[1]}
+			if len(fields) > 2 {
+				spec.Labels["aliases"] = strings.Join(fields[2:], ",")
+			}
+		}
+		specs = append(specs, spec)
+	}
+	return specs, scanner.Err()
+}
+
+// ansibleInventory is the part of an Ansible inventory that matters here:
+// groups with their hosts, variables and child groups.
+type ansibleInventory struct {
+	groups map[string]*ansibleGroup
+}
+
+type ansibleGroup struct {
+	hosts    map[string]map[string]string // host name to host variables
+	vars     map[string]string
+	children []string
+}
+
+func newAnsibleInventory() *ansibleInventory {
+	return &ansibleInventory{groups: make(map[string]*ansibleGroup)}
+}
+
+func (inv *ansibleInventory) group(name string) *ansibleGroup {
+	g := inv.groups[name]
+	if g == nil {
+		g = &ansibleGroup{hosts: make(map[string]map[string]string), vars: make(map[string]string)}
+		inv.groups[name] = g
+	}
+	return g
+}
+
+func (inv *ansibleInventory) addHost(group, host string, vars map[string]string) {
+	g := inv.group(group)
+	if g.hosts[host] == nil {
+		g.hosts[host] = make(map[string]string)
+	}
+	for k, v := range vars {
+		g.hosts[host][k] = v
+	}
+}
+
+// targets flattens the inventory. Each host is pinged at its ansible_host if
+// it has one, is labelled with the groups it belongs to (directly or through
+// child groups) as a comma-separated "group" label, and gets the scalar
+// variables of those groups and its own as labels. Ansible's own ansible_*
+// variables are left out.
+func (inv *ansibleInventory) targets() []TargetSpec {
+	parents := make(map[string][]string)
+	for name, g := range inv.groups {
+		for _, child := range g.children {
+			parents[child] = append(parents[child], name)
+		}
+	}
+	// ancestors lists a group and every group above it, outermost first, so
+	// variables of inner groups win
+	var ancestors func(name string, seen map[string]bool) []string
+	ancestors = func(name string, seen map[string]bool) []string {
+		if seen[name] {
+			return nil
+		}
+		seen[name] = true
+		var list []string
+		for _, p := range parents[name] {
+			list = append(list, ancestors(p, seen)...)
+		}
+		return append(list, name)
+	}
+
+	type host struct {
+		groups map[string]bool
+		order  []string
+		vars   map[string]string
+	}
+	hosts := make(map[string]*host)
+	names := make([]string, 0, len(inv.groups))
+	for name := range inv.groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for hostname, vars := range inv.groups[name].hosts {
+			h := hosts[hostname]
+			if h == nil {
+				h = &host{groups: make(map[string]bool), vars: make(map[string]string)}
+				hosts[hostname] = h
+			}
+			for _, group := range ancestors(name, make(map[string]bool)) {
+				if !h.groups[group] {
+					h.groups[group] = true
+					h.order = append(h.order, group)
+				}
+			}
+			for k, v := range vars {
+				h.vars[k] = v
+			}
+		}
+	}
+
+	var specs []TargetSpec
+	for hostname, h := range hosts {
+		labels := make(map[string]string)
+		var groups []string
+		for _, group := range h.order {
+			for k, v := range inv.groups[group].vars {
+				labels[k] = v
+			}
+			if group != "all" && group != "ungrouped" {
+				groups = append(groups, group)
+			}
+		}
+		for k, v := range h.vars {
+			labels[k] = v
+		}
+		address := hostname
+		if a := labels["ansible_host"]; a != "" {
+			address = a
+			labels["name"] = hostname
+		}
+		for k := range labels {
+			if strings.HasPrefix(k, "ansible_") {
+				delete(labels, k)
+			}
+		}
+		if len(groups) > 0 {
+			sort.Strings(groups)
+			labels["group"] = strings.Join(groups, ",")
+		}
+		specs = append(specs, TargetSpec{Address: address, Labels: labels})
+	}
+	sort.Slice(specs, func(i, j int) bool { return specs[i].Address < specs[j].Address })
+	return specs
+}
+
+// ansibleRange matches the numeric host ranges of INI inventories, as in
+// www[01:50].example.com.
+var ansibleRange = regexp.MustCompile(`\[(\d+):(\d+)\]`)
+
+func expandAnsibleHost(pattern string) []string {
+	m := ansibleRange.FindStringSubmatchIndex(pattern)
+	if m == nil {
+		return []string{pattern}
+	}
+	from, _ := strconv.Atoi(pattern[m[2]:m[3]])
+	to, _ := strconv.Atoi(pattern[m[4]:m[5]])
+	width := m[3] - m[2]
+	var hosts []string
+	for i := from; i <= to && len(hosts) < maxSweepHosts; i++ {
+		n := fmt.Sprintf("%0*d", width, i)
+		hosts = append(hosts, expandAnsibleHost(pattern[:m[0]]+n+pattern[m[1]:])...)
+	}
+	return hosts
+}
+
+// parseAnsibleINI reads an INI inventory: host lines with key=value
+// variables, [group] sections, [group:vars] and [group:children].
+func parseAnsibleINI(r io.Reader) ([]TargetSpec, error) {
+	inv := newAnsibleInventory()
+	section, kind := "ungrouped", ""
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || text[0] == '#' || text[0] == ';' {
+			continue
+		}
+		if text[0] == '[' && text[len(text)-1] == ']' {
+			section, kind = text[1:len(text)-1], ""
+			if i := strings.IndexByte(section, ':'); i >= 0 {
+				section, kind = section[:i], section[i+1:]
+			}
+			inv.group(section)
+			continue
+		}
+		fields := strings.Fields(text)
+		switch kind {
+		case "vars":
+			k, v, ok := cutString(text, "=")
+			if !ok {
+				return nil, fmt.Errorf("line %d: expected key=value", line)
+			}
+			inv.group(section).vars[strings.TrimSpace(k)] = unquote(strings.TrimSpace(v))
+		case "children":
+			inv.group(fields[0])
+			g := inv.group(section)
+			g.children = append(g.children, fields[0])
+		case "":
+			vars := make(map[string]string)
+			for _, field := range fields[1:] {
+				if k, v, ok := cutString(field, "="); ok {
+					vars[k] = unquote(v)
+				}
+			}
+			for _, host := range expandAnsibleHost(fields[0]) {
+				inv.addHost(section, host, vars)
+			}
+		}
+	}
+	if error := scanner.Err(); error != nil {
+		return nil, error
+	}
+	return inv.targets(), nil
+}
+
+// parseAnsibleYAML reads a YAML inventory. Only the shape Ansible uses is
+// understood: nested mappings of groups with hosts, vars and children keys.
+func parseAnsibleYAML(r io.Reader) ([]TargetSpec, error) {
+	root, error := parseYAMLMapping(r)
+	if error != nil {
+		return nil, error
+	}
+	inv := newAnsibleInventory()
+	var walk func(name string, node map[string]interface{})
+	walk = func(name string, node map[string]interface{}) {
+		g := inv.group(name)
+		if hosts, ok := node["hosts"].(map[string]interface{}); ok {
+			for host, vars := range hosts {
+				hostVars := make(map[string]string)
+				if m, ok := vars.(map[string]interface{}); ok {
+					for k, v := range m {
+						if s, ok := v.(string); ok {
+							hostVars[k] = s
+						}
+					}
+				}
+				for _, h := range expandAnsibleHost(host) {
+					inv.addHost(name, h, hostVars)
+				}
+			}
+		}
+		if vars, ok := node["vars"].(map[string]interface{}); ok {
+			for k, v := range vars {
+				if s, ok := v.(string); ok {
+					g.vars[k] = s
+				}
+			}
+		}
+		if children, ok := node["children"].(map[string]interface{}); ok {
+			for child, sub := range children {
+				g.children = append(g.children, child)
+				m, _ := sub.(map[string]interface{})
+				walk(child, m)
+			}
+		}
+	}
+	for name, node := range root {
+		m, _ := node.(map[string]interface{})
+		walk(name, m)
+	}
+	return inv.targets(), nil
+}
+
+// parseYAMLMapping parses the block-mapping subset of YAML: "key:" opening a
+// nested mapping, "key: value" scalars and comments. Sequences, flow style
+// and multi-line scalars are not supported.
+func parseYAMLMapping(r io.Reader) (map[string]interface{}, error) {
+	type level struct {
+		indent int
+		node   map[string]interface{}
+	}
+	root := make(map[string]interface{})
+	// the root's indent is set by its first key
+	stack := []level{{indent: -1, node: root}}
+	var pendingKey string // the last "key:" without a value
+	var pendingParent map[string]interface{}
+
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		raw := scanner.Text()
+		text := strings.TrimSpace(raw)
+		if text == "" || text[0] == '#' || text == "---" || text == "..." {
+			continue
+		}
+		if i := strings.Index(text, " #"); i >= 0 {
+			text = strings.TrimSpace(text[:i])
+		}
+		indent := len(raw) - len(strings.TrimLeft(raw, " "))
+		if raw[indent] == '\t' {
+			return nil, fmt.Errorf("line %d: YAML doesn't allow tabs for indentation", line)
+		}
+		if strings.HasPrefix(text, "- ") {
+			return nil, fmt.Errorf("line %d: YAML sequences are not supported in inventories", line)
+		}
+		// the key ends at a colon followed by a space or the end of the
+		// line, so host ranges like web[01:50] stay whole
+		key, value, ok := cutString(text, ": ")
+		if !ok && strings.HasSuffix(text, ":") {
+			key, ok = text[:len(text)-1], true
+		}
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected key: value", line)
+		}
+		key, value = unquote(strings.TrimSpace(key)), unquote(strings.TrimSpace(value))
+
+		// a deeper line opens the mapping of the pending key
+		if pendingParent != nil && indent > stack[len(stack)-1].indent {
+			child := make(map[string]interface{})
+			pendingParent[pendingKey] = child
+			stack = append(stack, level{indent: indent, node: child})
+		}
+		pendingParent = nil
+		for len(stack) > 1 && indent < stack[len(stack)-1].indent {
+			stack = stack[:len(stack)-1]
+		}
+		if len(stack) == 1 && stack[0].indent < 0 {
+			stack[0].indent = indent
+		}
+		if indent != stack[len(stack)-1].indent {
+			return nil, fmt.Errorf("line %d: inconsistent indentation", line)
+		}
+		node := stack[len(stack)-1].node
+
+		if value == "" || value == "~" || value == "null" {
+			node[key] = nil
+			pendingKey, pendingParent = key, node
+		} else {
+			node[key] = value
+		}
+	}
+	return root, scanner.Err()
+}
+
+// cutString is strings.Cut, which needs a newer Go than this module targets.
+func cutString(s, sep string) (string, string, bool) {
+	if i := strings.Index(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+	return s, "", false
+}
+
+func unquote(s string) string {
+	if len(s) >= 2 && (s[0] == '"' || s[0] == '\'') && s[len(s)-1] == s[0] {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
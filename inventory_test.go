@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseInventory(t *testing.T) {
+	tests := []struct {
+		name    string
+		format  string
+		file    string
+		input   string
+		want    []TargetSpec
+		wantErr bool
+	}{
+		{
+			name:   "csv with address column",
+			format: formatCSV,
+			input:  "name, address ,site\nweb1,192.0.2.1,ams\n# comment\ndb1, 192.0.2.2 ,\n,,\n",
+			want: []TargetSpec{
+				{Address: "192.0.2.1", Labels: map[string]string{"name": "web1", "site": "ams"}},
+				{Address: "192.0.2.2", Labels: map[string]string{"name": "db1"}},
+			},
+		},
+		{
+			name:   "csv without address column",
+			format: formatCSV,
+			input:  "target,role\n192.0.2.1,web\n192.0.2.2\n",
+			want: []TargetSpec{
+				{Address: "192.0.2.1", Labels: map[string]string{"role": "web"}},
+				{Address: "192.0.2.2"},
+			},
+		},
+		{
+			name:   "csv ip before hostname",
+			format: formatCSV,
+			input:  "ip,hostname\n192.0.2.1,web1\n",
+			want:   []TargetSpec{{Address: "192.0.2.1", Labels: map[string]string{"hostname": "web1"}}},
+		},
+		{
+			name:   "csv address before ip and host",
+			format: formatCSV,
+			input:  "Host,IP,Address\nweb1,192.0.2.1,web1.example.com\n",
+			want:   []TargetSpec{{Address: "web1.example.com", Labels: map[string]string{"Host": "web1", "IP": "192.0.2.1"}}},
+		},
+		{
+			name:   "csv host before hostname",
+			format: formatCSV,
+			input:  "hostname,host\nweb1.example.com,web1\n",
+			want:   []TargetSpec{{Address: "web1", Labels: map[string]string{"hostname": "web1.example.com"}}},
+		},
+		{
+			name:    "csv without header",
+			format:  formatCSV,
+			input:   "",
+			wantErr: true,
+		},
+		{
+			name:   "hosts file",
+			format: formatHosts,
+			input:  "# static hosts\n127.0.0.1 localhost\n192.0.2.1 web1.example.com web1 www # front\n\n2001:db8::1\n",
+			want: []TargetSpec{
+				{Address: "127.0.0.1", Labels: map[string]string{"name": "localhost"}},
+				{Address: "192.0.2.1", Labels: map[string]string{"name": "web1.example.com", "aliases": "web1,www"}},
+				{Address: "2001:db8::1"},
+			},
+		},
+		{
+			name:   "ansible ini",
+			format: formatAnsible,
+			file:   "hosts.ini",
+			input: `mail.example.com
+
+[webservers]
+web[1:2].example.com http_port=80
+db1.example.com ansible_host=192.0.2.10
+
+[dbservers]
+db1.example.com
+
+[dbservers:vars]
+role="database"
+
+[prod:children]
+webservers
+`,
+			want: []TargetSpec{
+				{Address: "192.0.2.10", Labels: map[string]string{"name": "db1.example.com", "group": "dbservers,prod,webservers", "role": "database"}},
+				{Address: "mail.example.com", Labels: map[string]string{}},
+				{Address: "web1.example.com", Labels: map[string]string{"group": "prod,webservers", "http_port": "80"}},
+				{Address: "web2.example.com", Labels: map[string]string{"group": "prod,webservers", "http_port": "80"}},
+			},
+		},
+		{
+			name:    "ansible ini vars without value",
+			format:  formatAnsible,
+			file:    "hosts.ini",
+			input:   "[web:vars]\nport\n",
+			wantErr: true,
+		},
+		{
+			name:   "ansible yaml",
+			format: formatAnsible,
+			file:   "hosts.yml",
+			input: `---
+all:
+  hosts:
+    mail.example.com:
+  children:
+    webservers:
+      hosts:
+        web[01:02].example.com:
+          http_port: '8080'  # alternate port
+      vars:
+        site: ams
+    dbservers:
+      hosts:
+        db1.example.com:
+          ansible_host: 192.0.2.10
+`,
+			want: []TargetSpec{
+				{Address: "192.0.2.10", Labels: map[string]string{"name": "db1.example.com", "group": "dbservers"}},
+				{Address: "mail.example.com", Labels: map[string]string{}},
+				{Address: "web01.example.com", Labels: map[string]string{"group": "webservers", "http_port": "8080", "site": "ams"}},
+				{Address: "web02.example.com", Labels: map[string]string{"group": "webservers", "http_port": "8080", "site": "ams"}},
+			},
+		},
+		{
+			name:    "ansible yaml sequence",
+			format:  formatAnsible,
+			file:    "hosts.yaml",
+			input:   "all:\n  hosts:\n    - web1\n",
+			wantErr: true,
+		},
+		{
+			name:   "native list",
+			format: formatList,
+			input:  "192.0.2.1 site=ams\n",
+			want:   []TargetSpec{{Address: "192.0.2.1", Labels: map[string]string{"site": "ams"}}},
+		},
+	}
+	for _, test := range tests {
+		got, error := parseInventory(strings.NewReader(test.input), test.format, test.file)
+		if (error != nil) != test.wantErr {
+			t.Errorf("%s: error %v, want error %v", test.name, error, test.wantErr)
+			continue
+		}
+		if !test.wantErr && !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestSplitTargetFormat(t *testing.T) {
+	tests := []struct {
+		in, format, path string
+	}{
+		{"csv:targets.txt", formatCSV, "targets.txt"},
+		{"ansible:/etc/ansible/hosts", formatAnsible, "/etc/ansible/hosts"},
+		{"targets.csv", "", "targets.csv"},
+		{"c:/targets.txt", "", "c:/targets.txt"},
+	}
+	for _, test := range tests {
+		if format, path := splitTargetFormat(test.in); format != test.format || path != test.path {
+			t.Errorf("splitTargetFormat(%q) = %q, %q, want %q, %q", test.in, format, path, test.format, test.path)
+		}
+	}
+}
+
+func TestExpandAnsibleHost(t *testing.T) {
+	tests := []struct {
+		pattern string
+		want    []string
+	}{
+		{"web.example.com", []string{"web.example.com"}},
+		{"web[8:10]", []string{"web8", "web9", "web10"}},
+		{"web[08:10]", []string{"web08", "web09", "web10"}},
+		{"r[1:2]s[1:2]", []string{"r1s1", "r1s2", "r2s1", "r2s2"}},
+	}
+	for _, test := range tests {
+		if got := expandAnsibleHost(test.pattern); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("expandAnsibleHost(%q) = %v, want %v", test.pattern, got, test.want)
+		}
+	}
+}
+
+func TestParseYAMLMappingIndentation(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		line  int // of the error, 0 for none
+	}{
+		{"consistent", "all:\n  hosts:\n    web1:\n  vars:\n    site: ams\nother:\n", 0},
+		{"indented root", "  all:\n    hosts:\n  other:\n", 0},
+		{"nested under a key without value", "all:\n  hosts:\n    web1:\n     ansible_host: 192.0.2.1\n", 0},
+		{"sibling indented deeper", "all:\n  hosts:\n    web1: a\n     web2: b\n", 4},
+		{"sibling indented less", "all:\n  hosts:\n    web1:\n   web2:\n", 4},
+		{"dedent between levels", "all:\n    hosts:\n      web1:\n  vars:\n", 4},
+		{"deeper under a scalar", "all:\n  site: ams\n    role: web\n", 3},
+		{"root dedented", "  all:\n    hosts:\nother:\n", 3},
+		{"tab", "all:\n\thosts:\n", 2},
+	}
+	for _, test := range tests {
+		_, error := parseYAMLMapping(strings.NewReader(test.input))
+		switch {
+		case test.line == 0 && error != nil:
+			t.Errorf("%s: %v", test.name, error)
+		case test.line != 0 && (error == nil || !strings.HasPrefix(error.Error(), fmt.Sprintf("line %d:", test.line))):
+			t.Errorf("%s: got error %v, want one on line %d", test.name, error, test.line)
+		}
+	}
+}
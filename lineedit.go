@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode"
+)
+
+// errInterrupted is returned by readLine when the user presses Ctrl-C.
+var errInterrupted = fmt.Errorf("interrupted")
+
+// lineEditor reads command lines with history and tab completion when
+// standard input is a terminal, and plain lines when it is not, so scripts
+// can be piped in.
+type lineEditor struct {
+	in       *bufio.Reader
+	out      io.Writer
+	terminal bool
+
+	history     []string
+	historyFile string
+	maxHistory  int
+
+	// complete returns the candidates for the word being typed, given the
+	// words before it.
+	complete func(words []string, word string) []string
+}
+
+func newLineEditor(historyFile string, complete func(words []string, word string) []string) *lineEditor {
+	e := &lineEditor{
+		in:          bufio.NewReader(os.Stdin),
+		out:         os.Stdout,
+		historyFile: historyFile,
+		maxHistory:  1000,
+		complete:    complete,
+	}
+	if restore, error := makeRaw(int(os.Stdin.Fd())); error == nil {
+		restore()
+		e.terminal = true
+	}
+	e.history = loadHistory(historyFile, e.maxHistory)
+	return e
+}
+
+// loadHistory reads the last max lines of the history file. remember only
+// appends to the file, so a longer one is rewritten with just those lines.
+func loadHistory(path string, max int) []string {
+	if path == "" {
+		return nil
+	}
+	b, error := os.ReadFile(path)
+	if error != nil {
+		return nil
+	}
+	var history []string
+	for _, line := range strings.Split(string(b), "\n") {
+		if line != "" {
+			history = append(history, line)
+		}
+	}
+	if len(history) > max {
+		history = history[len(history)-max:]
+		os.WriteFile(path, []byte(strings.Join(history, "\n")+"\n"), 0600)
+	}
+	return history
+}
+
+// readLine prompts for and reads one line. It returns io.EOF at the end of
+// input or on Ctrl-D at an empty line, and errInterrupted on Ctrl-C.
+func (e *lineEditor) readLine(prompt string) (string, error) {
+	if !e.terminal {
+		line, error := e.in.ReadString('\n')
+		if error != nil && (error != io.EOF || line == "") {
+			return "", error
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+
+	restore, error := makeRaw(int(os.Stdin.Fd()))
+	if error != nil {
+		return "", error
+	}
+	defer restore()
+
+	var line []rune
+	pos := 0
+	browse := len(e.history) // the history entry shown, len(history) for the new line
+	draft := ""              // the new line, kept while browsing history
+	redraw := func() {
+		fmt.Fprintf(e.out, "\r%s%s\x1b[K", prompt, string(line))
+		if n := len(line) - pos; n > 0 {
+			fmt.Fprintf(e.out, "\x1b[%dD", n)
+		}
+	}
+	show := func(i int) {
+		if browse == len(e.history) {
+			draft = string(line)
+		}
+		browse = i
+		if i == len(e.history) {
+			line = []rune(draft)
+		} else {
+			line = []rune(e.history[i])
+		}
+		pos = len(line)
+		redraw()
+	}
+	redraw()
+
+	for {
+		r, _, error := e.in.ReadRune()
+		if error != nil {
+			return "", error
+		}
+		switch r {
+		case '\r', '\n':
+			fmt.Fprint(e.out, "\r\n")
+			s := string(line)
+			e.remember(s)
+			return s, nil
+		case 3: // Ctrl-C
+			fmt.Fprint(e.out, "^C\r\n")
+			return "", errInterrupted
+		case 4: // Ctrl-D
+			if len(line) == 0 {
+				fmt.Fprint(e.out, "\r\n")
+				return "", io.EOF
+			}
+			if pos < len(line) {
+				line = append(line[:pos], line[pos+1:]...)
+			}
+		case 127, 8: // Backspace
+			if pos > 0 {
+				line = append(line[:pos-1], line[pos:]...)
+				pos--
+			}
+		case 1: // Ctrl-A
+			pos = 0
+		case 5: // Ctrl-E
+			pos = len(line)
+		case 21: // Ctrl-U
+			line, pos = line[pos:], 0
+		case 11: // Ctrl-K
+			line = line[:pos]
+		case 23: // Ctrl-W
+			start := pos
+			for start > 0 && line[start-1] == ' ' {
+				start--
+			}
+			for start > 0 && line[start-1] != ' ' {
+				start--
+			}
+			line, pos = append(line[:start], line[pos:]...), start
+		case 12: // Ctrl-L
+			fmt.Fprint(e.out, "\x1b[H\x1b[2J")
+		case '\t':
+			line, pos = e.completeLine(prompt, line, pos)
+		case 27: // escape sequences: arrows, Home, End, Delete
+			key := e.escape()
+			switch key {
+			case "[A", "OA":
+				if browse > 0 {
+					show(browse - 1)
+				}
+				continue
+			case "[B", "OB":
+				if browse < len(e.history) {
+					show(browse + 1)
+				}
+				continue
+			case "[C", "OC":
+				if pos < len(line) {
+					pos++
+				}
+			case "[D", "OD":
+				if pos > 0 {
+					pos--
+				}
+			case "[H", "OH", "[1~", "[7~":
+				pos = 0
+			case "[F", "OF", "[4~", "[8~":
+				pos = len(line)
+			case "[3~":
+				if pos < len(line) {
+					line = append(line[:pos], line[pos+1:]...)
+				}
+			}
+		default:
+			if unicode.IsPrint(r) {
+				line = append(line[:pos], append([]rune{r}, line[pos:]...)...)
+				pos++
+			}
+		}
+		redraw()
+	}
+}
+
+// escape reads the rest of an escape sequence: "[" or "O", then any
+// parameters, then the final character.
+func (e *lineEditor) escape() string {
+	r, _, error := e.in.ReadRune()
+	if error != nil || r != '[' && r != 'O' {
+		return ""
+	}
+	seq := string(r)
+	for {
+		r, _, error := e.in.ReadRune()
+		if error != nil {
+			return seq
+		}
+		seq += string(r)
+		if r >= 0x40 && r <= 0x7e {
+			return seq
+		}
+	}
+}
+
+// completeLine completes the word before the cursor. A single candidate is
+// filled in, several are filled in as far as they agree and listed when
+// that adds nothing.
+func (e *lineEditor) completeLine(prompt string, line []rune, pos int) ([]rune, int) {
+	if e.complete == nil {
+		return line, pos
+	}
+	start := pos
+	for start > 0 && line[start-1] != ' ' {
+		start--
+	}
+	word := string(line[start:pos])
+	candidates := e.complete(strings.Fields(string(line[:start])), word)
+	if len(candidates) == 0 {
+		return line, pos
+	}
+
+	common := candidates[0]
+	for _, c := range candidates[1:] {
+		for !strings.HasPrefix(c, common) {
+			common = common[:len(common)-1]
+		}
+	}
+	if len(candidates) == 1 {
+		common += " "
+	}
+	if len(common) > len(word) {
+		insert := []rune(common[len(word):])
+		line = append(line[:pos], append(insert, line[pos:]...)...)
+		return line, pos + len(insert)
+	}
+	fmt.Fprintf(e.out, "\r\n%s\r\n", strings.Join(candidates, "  "))
+	return line, pos
+}
+
+// remember adds line to the history and appends it to the history file.
+// Blank lines and repeats of the previous line are left out.
+func (e *lineEditor) remember(line string) {
+	if strings.TrimSpace(line) == "" || len(e.history) > 0 && e.history[len(e.history)-1] == line {
+		return
+	}
+	e.history = append(e.history, line)
+	if len(e.history) > e.maxHistory {
+		e.history = e.history[len(e.history)-e.maxHistory:]
+	}
+	if e.historyFile == "" {
+		return
+	}
+	f, error := os.OpenFile(e.historyFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if error != nil {
+		return
+	}
+	defer f.Close()
+	fmt.Fprintln(f, line)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLoadHistory(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name    string
+		content string
+		want    []string
+		file    string // afterwards
+	}{
+		{name: "missing"},
+		{name: "short", content: "a\n\nb\n", want: []string{"a", "b"}, file: "a\n\nb\n"},
+		{name: "at the limit", content: "a\nb\nc\n", want: []string{"a", "b", "c"}, file: "a\nb\nc\n"},
+		{name: "trimmed", content: "a\nb\nc\nd\ne", want: []string{"c", "d", "e"}, file: "c\nd\ne\n"},
+	}
+	for i, test := range tests {
+		path := filepath.Join(dir, fmt.Sprint(i))
+		if test.content != "" {
+			if error := os.WriteFile(path, []byte(test.content), 0600); error != nil {
+				t.Fatal(error)
+			}
+		}
+		if got := loadHistory(path, 3); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+		if b, _ := os.ReadFile(path); string(b) != test.file {
+			t.Errorf("%s: file holds %q, want %q", test.name, b, test.file)
+		}
+	}
+	if got := loadHistory("", 3); got != nil {
+		t.Errorf("no file: got %q", got)
+	}
+}
+
+func TestRemember(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history")
+	e := &lineEditor{historyFile: path, maxHistory: 3}
+	for _, line := range []string{"a", "", "  ", "b", "b", "c", "d"} {
+		e.remember(line)
+	}
+	if want := []string{"b", "c", "d"}; !reflect.DeepEqual(e.history, want) {
+		t.Errorf("history %q, want %q", e.history, want)
+	}
+	if b, _ := os.ReadFile(path); string(b) != "a\nb\nc\nd\n" {
+		t.Errorf("file holds %q", b)
+	}
+	// the next start reads back no more than maxHistory lines
+	if got := loadHistory(path, e.maxHistory); !reflect.DeepEqual(got, e.history) {
+		t.Errorf("reloaded %q, want %q", got, e.history)
+	}
+}
+
+func TestCompleteLine(t *testing.T) {
+	candidates := []string{"reset", "remove", "ping"}
+	complete := func(words []string, word string) []string {
+		var out []string
+		for _, c := range candidates {
+			if len(words) == 0 && strings.HasPrefix(c, word) {
+				out = append(out, c)
+			}
+		}
+		return out
+	}
+	tests := []struct {
+		line   string
+		pos    int
+		want   string
+		wantAt int
+		listed bool
+	}{
+		{"p", 1, "ping ", 5, false},
+		{"r", 1, "re", 2, false},
+		{"re", 2, "re", 2, true},
+		{"x", 1, "x", 1, false},
+		{"ping p", 6, "ping p", 6, false},
+		{"p 192.0.2.1", 1, "ping  192.0.2.1", 5, false},
+	}
+	for _, test := range tests {
+		var out bytes.Buffer
+		e := &lineEditor{out: &out, complete: complete}
+		line, pos := e.completeLine("> ", []rune(test.line), test.pos)
+		if string(line) != test.want || pos != test.wantAt || (out.Len() > 0) != test.listed {
+			t.Errorf("%q at %d: got %q at %d, listed %q", test.line, test.pos, string(line), pos, out.String())
+		}
+	}
+}
@@ -0,0 +1,83 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+func setSocketOptions(fd int, opts SocketOptions) error {
+	if opts.Interface != "" {
+		if error := unix.SetsockoptString(fd, unix.SOL_SOCKET, unix.SO_BINDTODEVICE, opts.Interface); error != nil {
+			return os.NewSyscallError("setsockopt(SO_BINDTODEVICE)", error)
+		}
+	}
+	if opts.Mark != 0 {
+		if error := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_MARK, opts.Mark); error != nil {
+			return os.NewSyscallError("setsockopt(SO_MARK)", error)
+		}
+	}
+	if opts.DontFragment {
+		family, error := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_DOMAIN)
+		if error != nil {
+			return os.NewSyscallError("getsockopt(SO_DOMAIN)", error)
+		}
+		if family == unix.AF_INET6 {
+			if error := unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_MTU_DISCOVER, unix.IPV6_PMTUDISC_PROBE); error != nil {
+				return os.NewSyscallError("setsockopt(IPV6_MTU_DISCOVER)", error)
+			}
+			if error := unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_DONTFRAG, 1); error != nil {
+				return os.NewSyscallError("setsockopt(IPV6_DONTFRAG)", error)
+			}
+		} else if error := unix.SetsockoptInt(fd, unix.IPPROTO_IP, unix.IP_MTU_DISCOVER, unix.IP_PMTUDISC_PROBE); error != nil {
+			return os.NewSyscallError("setsockopt(IP_MTU_DISCOVER)", error)
+		}
+	}
+	return nil
+}
+
+// listenICMPWithOptions opens the socket itself so the options are in place
+// before the first packet. Raw sockets go through net.ListenConfig; the
+// unprivileged datagram sockets are created the way icmp.ListenPacket does.
+func listenICMPWithOptions(network, address string, opts SocketOptions) (net.PacketConn, error) {
+	switch network {
+	case "udp4", "udp6":
+	default:
+		lc := net.ListenConfig{Control: func(_, _ string, rc syscall.RawConn) error {
+			var error error
+			if e := rc.Control(func(fd uintptr) { error = setSocketOptions(int(fd), opts) }); e != nil {
+				return e
+			}
+			return error
+		}}
+		return lc.ListenPacket(context.Background(), network, address)
+	}
+
+	family, proto := unix.AF_INET, unix.IPPROTO_ICMP
+	var sa unix.Sockaddr = &unix.SockaddrInet4{}
+	if network == "udp6" {
+		family, proto = unix.AF_INET6, unix.IPPROTO_ICMPV6
+		sa = &unix.SockaddrInet6{}
+	}
+	fd, error := unix.Socket(family, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, proto)
+	if error != nil {
+		return nil, os.NewSyscallError("socket", error)
+	}
+	if error := setSocketOptions(fd, opts); error != nil {
+		unix.Close(fd)
+		return nil, error
+	}
+	if error := unix.Bind(fd, sa); error != nil {
+		unix.Close(fd)
+		return nil, os.NewSyscallError("bind", error)
+	}
+	f := os.NewFile(uintptr(fd), "icmp")
+	defer f.Close()
+	return net.FilePacketConn(f)
+}
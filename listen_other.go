@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+func listenICMPWithOptions(network, address string, opts SocketOptions) (net.PacketConn, error) {
+	return nil, fmt.Errorf("binding to an interface, setting a firewall mark or DF is only supported on Linux")
+}
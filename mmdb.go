@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/big"
+	"net"
+	"os"
+)
+
+// mmdbMetadataMarker precedes the metadata map at the end of a MaxMind DB.
+var mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// mmdb is a MaxMind DB file (the format of GeoLite2 and GeoIP2), read
+// according to https://maxmind.github.io/MaxMind-DB/. The whole file is
+// kept in memory.
+type mmdb struct {
+	Type string // the database_type from the metadata, e.g. GeoLite2-City
+
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	tree       []byte
+	data       mmdbDecoder
+	ipv4Start  uint // the node IPv4 addresses start from in an IPv6 tree
+}
+
+func openMMDB(path string) (*mmdb, error) {
+	b, error := os.ReadFile(path)
+	if error != nil {
+		return nil, error
+	}
+	i := bytes.LastIndex(b, mmdbMetadataMarker)
+	if i < 0 {
+		return nil, fmt.Errorf("%s: not a MaxMind DB file", path)
+	}
+	meta, _, error := mmdbDecoder(b[i+len(mmdbMetadataMarker):]).decode(0, 0)
+	if error != nil {
+		return nil, fmt.Errorf("%s: metadata: %v", path, error)
+	}
+	m, ok := meta.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s: metadata is not a map", path)
+	}
+	db := &mmdb{}
+	db.Type, _ = m["database_type"].(string)
+	nodeCount, _ := m["node_count"].(uint64)
+	recordSize, _ := m["record_size"].(uint64)
+	ipVersion, _ := m["ip_version"].(uint64)
+	db.nodeCount, db.recordSize, db.ipVersion = uint(nodeCount), uint(recordSize), uint(ipVersion)
+	switch db.recordSize {
+	case 24, 28, 32:
+	default:
+		return nil, fmt.Errorf("%s: unsupported record size %d", path, db.recordSize)
+	}
+
+	treeSize := db.nodeCount * db.recordSize / 4
+	if treeSize+16 > uint(i) {
+		return nil, fmt.Errorf("%s: search tree larger than the file", path)
+	}
+	db.tree = b[:treeSize]
+	db.data = mmdbDecoder(b[treeSize+16 : i])
+
+	// IPv4 addresses live under ::/96 in an IPv6 tree
+	if db.ipVersion == 6 {
+		node := uint(0)
+		for bit := 0; bit < 96 && node < db.nodeCount; bit++ {
+			node = db.record(node, 0)
+		}
+		db.ipv4Start = node
+	}
+	return db, nil
+}
+
+// record returns the left (0) or right (1) record of node.
+func (db *mmdb) record(node uint, side int) uint {
+	n := db.tree[node*db.recordSize/4:]
+	switch db.recordSize {
+	case 24:
+		if side == 0 {
+			return uint(n[0])<<16 | uint(n[1])<<8 | uint(n[2])
+		}
+		return uint(n[3])<<16 | uint(n[4])<<8 | uint(n[5])
+	case 28:
+		if side == 0 {
+			return uint(n[3]&0xf0)<<20 | uint(n[0])<<16 | uint(n[1])<<8 | uint(n[2])
+		}
+		return uint(n[3]&0x0f)<<24 | uint(n[4])<<16 | uint(n[5])<<8 | uint(n[6])
+	}
+	return uint(binary.BigEndian.Uint32(n[side*4:]))
+}
+
+// lookup returns the record for ip, or nil when the database has none.
+func (db *mmdb) lookup(ip net.IP) (interface{}, error) {
+	node := uint(0)
+	addr := ip.To16()
+	if v4 := ip.To4(); v4 != nil {
+		addr = v4
+		node = db.ipv4Start
+	} else if db.ipVersion == 4 {
+		return nil, nil
+	}
+
+	for bit := 0; bit < len(addr)*8 && node < db.nodeCount; bit++ {
+		node = db.record(node, int(addr[bit/8]>>(7-uint(bit%8))&1))
+	}
+	switch {
+	case node == db.nodeCount:
+		return nil, nil
+	case node < db.nodeCount:
+		return nil, fmt.Errorf("search tree deeper than the address")
+	}
+	value, _, error := db.data.decode(int(node-db.nodeCount-16), 0)
+	return value, error
+}
+
+// mmdbDecoder decodes values from a data section, which pointers are
+// relative to.
+type mmdbDecoder []byte
+
+// decode decodes the value at offset and returns it with the offset of the
+// value that follows. Maps decode to map[string]interface{}, arrays to
+// []interface{}, unsigned integers to uint64 (or *big.Int for uint128),
+// int32 to int64, and doubles and floats to float64.
+func (d mmdbDecoder) decode(offset, depth int) (interface{}, int, error) {
+	if depth > 64 {
+		return nil, 0, fmt.Errorf("data nested too deeply")
+	}
+	if offset < 0 || offset >= len(d) {
+		return nil, 0, fmt.Errorf("offset %d outside the data section", offset)
+	}
+	ctrl := d[offset]
+	offset++
+	typ := int(ctrl >> 5)
+
+	if typ == 1 {
+		// pointer: the size bits give its length, the rest its top bits
+		ss := int(ctrl>>3) & 3
+		if offset+ss+1 > len(d) {
+			return nil, 0, fmt.Errorf("truncated pointer")
+		}
+		p := int(ctrl & 7)
+		if ss == 3 {
+			p = 0
+		}
+		for _, b := range d[offset : offset+ss+1] {
+			p = p<<8 | int(b)
+		}
+		p += [...]int{0, 2048, 526336, 0}[ss]
+		value, _, error := d.decode(p, depth+1)
+		return value, offset + ss + 1, error
+	}
+	if typ == 0 {
+		if offset >= len(d) {
+			return nil, 0, fmt.Errorf("truncated extended type")
+		}
+		typ = 7 + int(d[offset])
+		offset++
+	}
+
+	size := int(ctrl & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		if offset+n > len(d) {
+			return nil, 0, fmt.Errorf("truncated size")
+		}
+		extra := 0
+		for _, b := range d[offset : offset+n] {
+			extra = extra<<8 | int(b)
+		}
+		size = [...]int{29, 285, 65821}[n-1] + extra
+		offset += n
+	}
+
+	switch typ {
+	case 7: // map
+		m := make(map[string]interface{}, size)
+		for i := 0; i < size; i++ {
+			key, next, error := d.decode(offset, depth+1)
+			if error != nil {
+				return nil, 0, error
+			}
+			k, ok := key.(string)
+			if !ok {
+				return nil, 0, fmt.Errorf("map key is not a string")
+			}
+			value, next, error := d.decode(next, depth+1)
+			if error != nil {
+				return nil, 0, error
+			}
+			m[k] = value
+			offset = next
+		}
+		return m, offset, nil
+	case 11: // array
+		a := make([]interface{}, 0, size)
+		for i := 0; i < size; i++ {
+			value, next, error := d.decode(offset, depth+1)
+			if error != nil {
+				return nil, 0, error
+			}
+			a = append(a, value)
+			offset = next
+		}
+		return a, offset, nil
+	case 14: // boolean, held in the size
+		return size != 0, offset, nil
+	}
+
+	if offset+size > len(d) {
+		return nil, 0, fmt.Errorf("value of type %d runs past the data section", typ)
+	}
+	b := d[offset : offset+size]
+	offset += size
+	switch typ {
+	case 2: // UTF-8 string
+		return string(b), offset, nil
+	case 3: // double
+		if size != 8 {
+			return nil, 0, fmt.Errorf("double of %d bytes", size)
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), offset, nil
+	case 4: // bytes
+		return append([]byte(nil), b...), offset, nil
+	case 5, 6, 9: // uint16, uint32, uint64
+		if size > 8 {
+			return nil, 0, fmt.Errorf("unsigned integer of %d bytes", size)
+		}
+		var u uint64
+		for _, c := range b {
+			u = u<<8 | uint64(c)
+		}
+		return u, offset, nil
+	case 10: // uint128
+		return new(big.Int).SetBytes(b), offset, nil
+	case 8: // int32
+		if size > 4 {
+			return nil, 0, fmt.Errorf("int32 of %d bytes", size)
+		}
+		var u uint32
+		for _, c := range b {
+			u = u<<8 | uint32(c)
+		}
+		if size == 4 {
+			return int64(int32(u)), offset, nil
+		}
+		return int64(u), offset, nil
+	case 15: // float
+		if size != 4 {
+			return nil, 0, fmt.Errorf("float of %d bytes", size)
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), offset, nil
+	}
+	return nil, 0, fmt.Errorf("unknown data type %d", typ)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMMDBDecode(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		offset  int
+		want    interface{}
+		next    int
+		wantErr bool
+	}{
+		{name: "string", data: "\x42hi", want: "hi", next: 3},
+		{name: "long string", data: "\x5d\x01" + strings.Repeat("a", 30), want: strings.Repeat("a", 30), next: 32},
+		{name: "double", data: "\x68\x3f\xf8\x00\x00\x00\x00\x00\x00", want: 1.5, next: 9},
+		{name: "bytes", data: "\x82\x01\x02", want: []byte{1, 2}, next: 3},
+		{name: "empty uint16", data: "\xa0", want: uint64(0), next: 1},
+		{name: "uint32", data: "\xc2\x01\x02", want: uint64(258), next: 3},
+		{name: "uint64", data: "\x01\x02\x05", want: uint64(5), next: 3},
+		{name: "uint128", data: "\x01\x03\xff", want: big.NewInt(255), next: 3},
+		{name: "negative int32", data: "\x04\x01\xff\xff\xff\xff", want: int64(-1), next: 6},
+		{name: "short int32", data: "\x01\x01\x7f", want: int64(127), next: 3},
+		{name: "boolean", data: "\x01\x07", want: true, next: 2},
+		{name: "float", data: "\x04\x08\x3f\xc0\x00\x00", want: 1.5, next: 6},
+		{name: "array", data: "\x02\x04\xa1\x01\x41a", want: []interface{}{uint64(1), "a"}, next: 6},
+		{
+			name: "map",
+			data: "\xe1\x47country\xe1\x48iso_code\x42NL",
+			want: map[string]interface{}{"country": map[string]interface{}{"iso_code": "NL"}},
+			next: 22,
+		},
+		{name: "pointer", data: "\x42hi\x20\x00", offset: 3, want: "hi", next: 5},
+		{name: "pointer past the data", data: "\x28\x00\x00", wantErr: true},
+		{name: "pointer loop", data: "\x20\x00", wantErr: true},
+		{name: "truncated string", data: "\x43a", wantErr: true},
+		{name: "truncated size", data: "\x5e\x01", wantErr: true},
+		{name: "unknown type", data: "\x00\x09", wantErr: true},
+		{name: "map key not a string", data: "\xe1\xa1\x01\xa1\x01", wantErr: true},
+		{name: "offset outside", data: "\x42hi", offset: 3, wantErr: true},
+	}
+	for _, test := range tests {
+		got, next, error := mmdbDecoder(test.data).decode(test.offset, 0)
+		if (error != nil) != test.wantErr {
+			t.Errorf("%s: error %v, want error %v", test.name, error, test.wantErr)
+			continue
+		}
+		if test.wantErr {
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) || next != test.next {
+			t.Errorf("%s: got %#v, %d, want %#v, %d", test.name, got, next, test.want, test.next)
+		}
+	}
+}
+
+func TestMMDBLookup(t *testing.T) {
+	// one node of 24-bit records: 0.0.0.0/1 points at the first value of the
+	// data section, 128.0.0.0/1 at nothing
+	file := "\x00\x00\x11\x00\x00\x01" +
+		strings.Repeat("\x00", 16) +
+		"\xe1\x47country\xe1\x48iso_code\x42NL" +
+		string(mmdbMetadataMarker) +
+		"\xe4\x4anode_count\xc1\x01\x4brecord_size\xa1\x18\x4aip_version\xa1\x04\x4ddatabase_type\x44Test"
+	path := filepath.Join(t.TempDir(), "test.mmdb")
+	if error := os.WriteFile(path, []byte(file), 0644); error != nil {
+		t.Fatal(error)
+	}
+	db, error := openMMDB(path)
+	if error != nil {
+		t.Fatal(error)
+	}
+	if db.Type != "Test" {
+		t.Errorf("database type %q, want Test", db.Type)
+	}
+
+	nl := map[string]interface{}{"country": map[string]interface{}{"iso_code": "NL"}}
+	tests := []struct {
+		ip   string
+		want interface{}
+	}{
+		{"192.0.2.1", nil},
+		{"10.0.0.1", nl},
+		{"::ffff:10.0.0.1", nl},
+		{"2001:db8::1", nil}, // not in an IPv4 database
+	}
+	for _, test := range tests {
+		got, error := db.lookup(net.ParseIP(test.ip))
+		if error != nil || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("lookup(%s) = %v, %v, want %v", test.ip, got, error, test.want)
+		}
+	}
+}
+
+func TestOpenMMDBErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+	}{
+		{"no metadata", "\x00\x00\x00"},
+		{"metadata not a map", string(mmdbMetadataMarker) + "\x42hi"},
+		{"bad record size", string(mmdbMetadataMarker) + "\xe2\x4anode_count\xc1\x01\x4brecord_size\xa1\x10"},
+		{"tree past the end", string(mmdbMetadataMarker) + "\xe2\x4anode_count\xc1\x64\x4brecord_size\xa1\x18"},
+	}
+	for _, test := range tests {
+		path := filepath.Join(t.TempDir(), "test.mmdb")
+		if error := os.WriteFile(path, []byte(test.file), 0644); error != nil {
+			t.Fatal(error)
+		}
+		if _, error := openMMDB(path); error == nil {
+			t.Errorf("%s: no error", test.name)
+		}
+	}
+}
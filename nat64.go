@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// nat64Prefixes are the prefixes DNS64 synthesizes addresses under unless
+// told otherwise: the RFC 6052 well-known prefix and the RFC 8215 local-use
+// prefix.
+var nat64Prefixes = []*net.IPNet{
+	mustParseCIDR("64:ff9b::/96"),
+	mustParseCIDR("64:ff9b:1::/48"),
+}
+
+func mustParseCIDR(s string) *net.IPNet {
+	_, n, error := net.ParseCIDR(s)
+	if error != nil {
+		panic(error)
+	}
+	return n
+}
+
+// parseNAT64Prefix parses a network-specific NAT64 prefix, which RFC 6052
+// allows to be 32, 40, 48, 56, 64 or 96 bits long.
+func parseNAT64Prefix(s string) (*net.IPNet, error) {
+	ip, n, error := net.ParseCIDR(s)
+	if error != nil {
+		return nil, error
+	}
+	ones, bits := n.Mask.Size()
+	if ip.To4() != nil || bits != 128 {
+		return nil, fmt.Errorf("%s: not an IPv6 prefix", s)
+	}
+	switch ones {
+	case 32, 40, 48, 56, 64, 96:
+		return n, nil
+	}
+	return nil, fmt.Errorf("%s: NAT64 prefixes are 32, 40, 48, 56, 64 or 96 bits long", s)
+}
+
+// translation tells how the address a target resolved to relates to IPv4:
+// "nat64" for an address synthesized under one of prefixes, "mapped" for an
+// IPv4-mapped IPv6 address (::ffff:0:0/96), and "" for anything else. mapped
+// says which of the two an IPv4 address is (see Target.isMapped). v4 is the
+// IPv4 address embedded in it.
+func translation(ip net.IP, mapped bool, prefixes []*net.IPNet) (kind string, v4 net.IP) {
+	if ip.To4() != nil {
+		if mapped {
+			return "mapped", ip.To4()
+		}
+		return "", nil
+	}
+	for _, prefix := range prefixes {
+		if prefix.Contains(ip) {
+			ones, _ := prefix.Mask.Size()
+			return "nat64", extractIPv4(ip, ones)
+		}
+	}
+	return "", nil
+}
+
+// lookupIPv4 returns the addresses of the A records of name.
+var lookupIPv4 = func(name string) ([]net.IP, error) {
+	return net.DefaultResolver.LookupIP(context.Background(), "ip4", name)
+}
+
+// isMapped tells whether ip, the address t resolved to, is an IPv4-mapped
+// IPv6 address. Go keeps IPv4 addresses in the 16-byte mapped form too, so
+// the form alone only settles it in the 4-byte case: a literal is mapped
+// when it was written as IPv6, and a name when the address came from its
+// AAAA records rather than its A records. The answer for a name is kept
+// until it resolves to another address. ok is false when the A records
+// can't be looked up, so it is unknown.
+func (t *Target) isMapped(ip net.IP) (mapped, ok bool) {
+	if len(ip) == net.IPv4len || ip.To4() == nil {
+		return false, true
+	}
+	if net.ParseIP(t.Address) != nil {
+		return strings.Contains(t.Address, ":"), true
+	}
+	t.mu.Lock()
+	if t.resolved.Equal(ip) {
+		mapped = t.mapped
+		t.mu.Unlock()
+		return mapped, true
+	}
+	t.mu.Unlock()
+
+	addrs, error := lookupIPv4(t.Address)
+	var dnsError *net.DNSError
+	if error != nil && !(errors.As(error, &dnsError) && dnsError.IsNotFound) {
+		return false, false
+	}
+	mapped = true
+	for _, addr := range addrs {
+		if addr.Equal(ip) {
+			mapped = false
+		}
+	}
+	t.mu.Lock()
+	t.resolved, t.mapped = ip, mapped
+	t.mu.Unlock()
+	return mapped, true
+}
+
+// extractIPv4 recovers the IPv4 address embedded after a prefix of the given
+// length, skipping bits 64 to 71, which RFC 6052 section 2.2 reserves.
+func extractIPv4(ip net.IP, prefixLen int) net.IP {
+	ip = ip.To16()
+	v4 := make(net.IP, 0, net.IPv4len)
+	for i := prefixLen / 8; len(v4) < net.IPv4len; i++ {
+		if i == 8 {
+			continue
+		}
+		v4 = append(v4, ip[i])
+	}
+	return v4
+}
+
+// withTranslation returns labels plus the translation and ipv4 labels
+// describing kind and v4.
+func withTranslation(labels map[string]string, kind string, v4 net.IP) map[string]string {
+	return mergeLabels(labels, map[string]string{"translation": kind, "ipv4": v4.String()})
+}
+
+// nat64Pairs keeps track of the targets that resolve to translated
+// addresses. Through the "nat64" source it labels them, and optionally adds
+// the IPv4 address behind each NAT64 one as a target of its own, so the
+// translated and the native path can be compared.
+type nat64Pairs struct {
+	native bool // also ping the IPv4 address behind NAT64 targets
+
+	mu      sync.Mutex
+	targets map[string]nat64Pair // by target address
+}
+
+type nat64Pair struct {
+	kind string
+	v4   string
+}
+
+func newNAT64Pairs(native bool) *nat64Pairs {
+	return &nat64Pairs{native: native, targets: make(map[string]nat64Pair)}
+}
+
+// observe records what target resolved to this time.
+func (p *nat64Pairs) observe(target, kind string, v4 net.IP) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if kind == "" {
+		delete(p.targets, target)
+		return
+	}
+	p.targets[target] = nat64Pair{kind: kind, v4: v4.String()}
+}
+
+// sync brings the "nat64" source of set up to date, forgetting targets that
+// no other source lists any more. The "geoip" source only labels targets,
+// so it does not count.
+func (p *nat64Pairs) sync(set *TargetSet) {
+	p.mu.Lock()
+	var specs []TargetSpec
+	for target, pair := range p.targets {
+		if !set.ListedBy(target, "nat64", "geoip") {
+			delete(p.targets, target)
+			continue
+		}
+		specs = append(specs, TargetSpec{Address: target, Labels: map[string]string{"translation": pair.kind, "ipv4": pair.v4}})
+		if p.native && pair.kind == "nat64" {
+			specs = append(specs, TargetSpec{Address: pair.v4, Labels: map[string]string{"translation": "native", "nat64": target}})
+		}
+	}
+	p.mu.Unlock()
+	added, removed := set.Sync("nat64", specs)
+	logChanges("nat64", added, removed)
+}
+
+// report logs how much slower each NAT64 target is than its IPv4 address
+// pinged natively.
+func (p *nat64Pairs) report(set *TargetSet) {
+	if !p.native {
+		return
+	}
+	byAddress := make(map[string]*Target)
+	for _, t := range set.List() {
+		byAddress[t.Address] = t
+	}
+
+	p.mu.Lock()
+	var names []string
+	for target, pair := range p.targets {
+		if pair.kind == "nat64" {
+			names = append(names, target)
+		}
+	}
+	sort.Strings(names)
+	pairs := make(map[string]nat64Pair, len(names))
+	for _, name := range names {
+		pairs[name] = p.targets[name]
+	}
+	p.mu.Unlock()
+
+	for _, name := range names {
+		translated, native := byAddress[name], byAddress[pairs[name].v4]
+		if translated == nil || native == nil {
+			continue
+		}
+		a, b := translated.Stats.Snapshot(), native.Stats.Snapshot()
+		if a.Received == 0 || b.Received == 0 {
+			continue
+		}
+		log.Printf("Translation Overhead: %s: %.3f ms via NAT64, %.3f ms native to %s (%+.3f ms)\n",
+			name, milliseconds(a.AvgRTT), milliseconds(b.AvgRTT), native.Address, milliseconds(a.AvgRTT-b.AvgRTT))
+	}
+}
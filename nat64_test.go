@@ -0,0 +1,113 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestExtractIPv4(t *testing.T) {
+	// the examples of RFC 6052 section 2.4, all embedding 192.0.2.33
+	tests := []struct {
+		address   string
+		prefixLen int
+	}{
+		{"2001:db8:c000:221::", 32},
+		{"2001:db8:1c0:2:21::", 40},
+		{"2001:db8:122:c000:2:2100::", 48},
+		{"2001:db8:122:3c0:0:221::", 56},
+		{"2001:db8:122:344:c0:2:2100:0", 64},
+		{"2001:db8:122:344::192.0.2.33", 96},
+		{"64:ff9b::192.0.2.33", 96},
+	}
+	for _, test := range tests {
+		if got := extractIPv4(net.ParseIP(test.address), test.prefixLen); got.String() != "192.0.2.33" {
+			t.Errorf("extractIPv4(%s, %d) = %s, want 192.0.2.33", test.address, test.prefixLen, got)
+		}
+	}
+}
+
+func TestTranslation(t *testing.T) {
+	// v4.example.com has an A record, mapped.example.com only an AAAA one,
+	// and the A records of broken.example.com can't be looked up
+	defer func(lookup func(string) ([]net.IP, error)) { lookupIPv4 = lookup }(lookupIPv4)
+	lookups := 0
+	lookupIPv4 = func(name string) ([]net.IP, error) {
+		lookups++
+		switch name {
+		case "v4.example.com":
+			return []net.IP{net.ParseIP("192.0.2.1")}, nil
+		case "broken.example.com":
+			return nil, &net.DNSError{Err: "server misbehaving", Name: name, IsTemporary: true}
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+
+	prefixes := append(nat64Prefixes, mustParseCIDR("2001:db8:122::/48"))
+	tests := []struct {
+		address string
+		ip      net.IP
+		kind    string // "?" when it can't be told
+		v4      string
+	}{
+		{"192.0.2.1", net.ParseIP("192.0.2.1").To4(), "", ""},
+		{"192.0.2.1", net.ParseIP("192.0.2.1"), "", ""},
+		{"::ffff:192.0.2.1", net.ParseIP("::ffff:192.0.2.1"), "mapped", "192.0.2.1"},
+		{"v4.example.com", net.ParseIP("192.0.2.1").To4(), "", ""},
+		{"v4.example.com", net.ParseIP("192.0.2.1"), "", ""},
+		{"mapped.example.com", net.ParseIP("::ffff:1.2.3.4"), "mapped", "1.2.3.4"},
+		{"broken.example.com", net.ParseIP("::ffff:1.2.3.4"), "?", ""},
+		{"nat64.example.com", net.ParseIP("64:ff9b::192.0.2.33"), "nat64", "192.0.2.33"},
+		{"local.example.com", net.ParseIP("64:ff9b:1:c000:2:2100::"), "nat64", "192.0.2.33"},
+		{"nsp.example.com", net.ParseIP("2001:db8:122:c000:2:2100::"), "nat64", "192.0.2.33"},
+		{"v6.example.com", net.ParseIP("2001:db8::1"), "", ""},
+	}
+	for _, test := range tests {
+		target := &Target{Address: test.address}
+		mapped, ok := target.isMapped(test.ip)
+		if !ok {
+			if test.kind != "?" {
+				t.Errorf("%s (%s): can't tell, want %q", test.address, test.ip, test.kind)
+			}
+			continue
+		}
+		kind, v4 := translation(test.ip, mapped, prefixes)
+		got := ""
+		if v4 != nil {
+			got = v4.String()
+		}
+		if kind != test.kind || got != test.v4 {
+			t.Errorf("%s (%s): got %q, %q, want %q, %q", test.address, test.ip, kind, got, test.kind, test.v4)
+		}
+	}
+
+	// the A records are looked up once per address the name resolves to
+	target := &Target{Address: "mapped.example.com"}
+	lookups = 0
+	for _, ip := range []string{"::ffff:1.2.3.4", "::ffff:1.2.3.4", "::ffff:1.2.3.5", "::ffff:1.2.3.5"} {
+		if mapped, ok := target.isMapped(net.ParseIP(ip)); !mapped || !ok {
+			t.Errorf("%s: got %v, %v, want mapped", ip, mapped, ok)
+		}
+	}
+	if lookups != 2 {
+		t.Errorf("%d lookups for two addresses", lookups)
+	}
+}
+
+func TestParseNAT64Prefix(t *testing.T) {
+	tests := []struct {
+		prefix string
+		ok     bool
+	}{
+		{"64:ff9b::/96", true},
+		{"2001:db8:122::/48", true},
+		{"2001:db8::/32", true},
+		{"2001:db8::/33", false},
+		{"192.0.2.0/24", false},
+		{"2001:db8::1", false},
+	}
+	for _, test := range tests {
+		if _, error := parseNAT64Prefix(test.prefix); (error == nil) != test.ok {
+			t.Errorf("parseNAT64Prefix(%s): error %v, want ok %v", test.prefix, error, test.ok)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"os"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// ndmsgLen is the size of struct ndmsg, which starts every neighbour
+// message ahead of its attributes.
+const ndmsgLen = 12
+
+// nativeEndian is the host byte order netlink messages are written in
+// (binary.NativeEndian needs Go 1.21).
+var nativeEndian = func() binary.ByteOrder {
+	x := uint16(1)
+	if *(*byte)(unsafe.Pointer(&x)) == 1 {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}()
+
+// lookupNeighbor looks ip up in the kernel's ARP (IPv4) or NDP (IPv6)
+// neighbour table. It returns the link-layer address only when the entry is
+// reachable: a stale, delayed or probing entry is left over from earlier
+// traffic, and a permanent one is configured by hand, so neither says
+// anything about the host being there now.
+func lookupNeighbor(ip net.IP) (net.HardwareAddr, bool, error) {
+	family := unix.AF_INET6
+	if ip.To4() != nil {
+		family = unix.AF_INET
+	}
+	b, error := syscall.NetlinkRIB(unix.RTM_GETNEIGH, family)
+	if error != nil {
+		return nil, false, os.NewSyscallError("netlink", error)
+	}
+	msgs, error := syscall.ParseNetlinkMessage(b)
+	if error != nil {
+		return nil, false, error
+	}
+
+	for _, m := range msgs {
+		if m.Header.Type != unix.RTM_NEWNEIGH {
+			continue
+		}
+		if lladdr, ok := parseNeighbor(m.Data, ip); ok {
+			return lladdr, true, nil
+		}
+	}
+	return nil, false, nil
+}
+
+// parseNeighbor decodes the body of an RTM_NEWNEIGH message (struct ndmsg
+// and its attributes) and returns the link-layer address it gives for ip,
+// if the entry is for ip and reachable.
+func parseNeighbor(data []byte, ip net.IP) (net.HardwareAddr, bool) {
+	if len(data) < ndmsgLen {
+		return nil, false
+	}
+	if nativeEndian.Uint16(data[8:10])&unix.NUD_REACHABLE == 0 {
+		return nil, false
+	}
+	var dst net.IP
+	var lladdr net.HardwareAddr
+	for attrs := data[ndmsgLen:]; len(attrs) >= unix.SizeofRtAttr; {
+		l := int(nativeEndian.Uint16(attrs[0:2]))
+		if l < unix.SizeofRtAttr || l > len(attrs) {
+			break
+		}
+		value := attrs[unix.SizeofRtAttr:l]
+		switch nativeEndian.Uint16(attrs[2:4]) {
+		case unix.NDA_DST:
+			dst = net.IP(value)
+		case unix.NDA_LLADDR:
+			lladdr = net.HardwareAddr(value)
+		}
+		l = (l + unix.RTA_ALIGNTO - 1) &^ (unix.RTA_ALIGNTO - 1)
+		if l > len(attrs) {
+			break
+		}
+		attrs = attrs[l:]
+	}
+	if !dst.Equal(ip) || len(lladdr) == 0 {
+		return nil, false
+	}
+	return lladdr, true
+}
@@ -0,0 +1,64 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"net"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// neighborMessage builds the body of an RTM_NEWNEIGH message: a struct
+// ndmsg with the given state, followed by NDA_DST and NDA_LLADDR attributes
+// when dst and lladdr are set.
+func neighborMessage(state uint16, dst net.IP, lladdr net.HardwareAddr) []byte {
+	b := make([]byte, ndmsgLen)
+	nativeEndian.PutUint16(b[8:10], state)
+	attr := func(kind uint16, value []byte) {
+		a := make([]byte, (unix.SizeofRtAttr+len(value)+unix.RTA_ALIGNTO-1)&^(unix.RTA_ALIGNTO-1))
+		nativeEndian.PutUint16(a[0:2], uint16(unix.SizeofRtAttr+len(value)))
+		nativeEndian.PutUint16(a[2:4], kind)
+		copy(a[unix.SizeofRtAttr:], value)
+		b = append(b, a...)
+	}
+	if dst != nil {
+		attr(unix.NDA_DST, dst)
+	}
+	if lladdr != nil {
+		attr(unix.NDA_LLADDR, lladdr)
+	}
+	return b
+}
+
+func TestParseNeighbor(t *testing.T) {
+	ip4 := net.ParseIP("192.0.2.1").To4()
+	ip6 := net.ParseIP("2001:db8::1")
+	mac := net.HardwareAddr{0x00, 0x00, 0x5e, 0x00, 0x53, 0x01}
+	tests := []struct {
+		name string
+		data []byte
+		ip   net.IP
+		want net.HardwareAddr
+	}{
+		{"reachable", neighborMessage(unix.NUD_REACHABLE, ip4, mac), ip4, mac},
+		{"reachable IPv6", neighborMessage(unix.NUD_REACHABLE, ip6, mac), ip6, mac},
+		{"16 byte form of IPv4", neighborMessage(unix.NUD_REACHABLE, ip4, mac), net.ParseIP("192.0.2.1"), mac},
+		{"stale", neighborMessage(unix.NUD_STALE, ip4, mac), ip4, nil},
+		{"delayed", neighborMessage(unix.NUD_DELAY, ip4, mac), ip4, nil},
+		{"permanent", neighborMessage(unix.NUD_PERMANENT, ip4, mac), ip4, nil},
+		{"failed", neighborMessage(unix.NUD_FAILED, ip4, nil), ip4, nil},
+		{"other address", neighborMessage(unix.NUD_REACHABLE, ip4, mac), net.ParseIP("192.0.2.2"), nil},
+		{"no link-layer address", neighborMessage(unix.NUD_REACHABLE, ip4, nil), ip4, nil},
+		{"no destination", neighborMessage(unix.NUD_REACHABLE, nil, mac), ip4, nil},
+		{"short", neighborMessage(unix.NUD_REACHABLE, nil, nil)[:ndmsgLen-1], ip4, nil},
+		{"truncated attribute", neighborMessage(unix.NUD_REACHABLE, ip4, mac)[:ndmsgLen+6], ip4, nil},
+	}
+	for _, test := range tests {
+		got, ok := parseNeighbor(test.data, test.ip)
+		if ok != (test.want != nil) || got.String() != test.want.String() {
+			t.Errorf("%s: got %v, %v, want %v", test.name, got, ok, test.want)
+		}
+	}
+}
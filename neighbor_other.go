@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+func lookupNeighbor(ip net.IP) (net.HardwareAddr, bool, error) {
+	return nil, false, fmt.Errorf("neighbour table lookups are only supported on Linux")
+}
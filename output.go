@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// ProbeResult is the outcome of one probe, as handed to an Output.
+type ProbeResult struct {
+	Target  string            // the target as configured
+	Address string            // the address it resolved to, if it did
+	Labels  map[string]string // the target's labels
+	Seq     int               // the probe's number for this target, from 1
+	Time    time.Time         // when the probe finished
+	RTT     time.Duration     // the round trip time, when there was a reply
+	Size    int               // ICMP bytes in the reply
+	TTL     int               // the reply's TTL or hop limit, -1 when unknown
+	Error   string            // why there was no reply
+
+	Down      bool      // whether the target counts as down after this probe
+	DownSince time.Time // when the current outage began, while Down
+}
+
+// Summary is the periodic summary of one target, as handed to an Output.
+type Summary struct {
+	Target string
+	Labels map[string]string
+	StatsSnapshot
+}
+
+// Output renders probe results, the periodic summaries and the final
+// summary printed when the pinger stops.
+type Output interface {
+	Probe(r ProbeResult)
+	Summary(s Summary)
+	Final(s Summary)
+}
+
+// multiOutput hands everything to several outputs, such as the console
+// and a remote store.
+type multiOutput []Output
+
+func (m multiOutput) Probe(r ProbeResult) {
+	for _, o := range m {
+		o.Probe(r)
+	}
+}
+
+func (m multiOutput) Summary(s Summary) {
+	for _, o := range m {
+		o.Summary(s)
+	}
+}
+
+func (m multiOutput) Final(s Summary) {
+	for _, o := range m {
+		o.Final(s)
+	}
+}
+
+// closeOutput lets the outputs that hold on to results, like elasticOutput,
+// send them off before the pinger exits.
+func closeOutput(o Output) {
+	switch o := o.(type) {
+	case multiOutput:
+		for _, o := range o {
+			closeOutput(o)
+		}
+	case interface{ Close() }:
+		o.Close()
+	}
+}
+
+// logOutput is the default output, written through the standard logger.
+type logOutput struct{}
+
+func (logOutput) Probe(r ProbeResult) {
+	labels := ""
+	if len(r.Labels) > 0 {
+		labels = " [" + formatLabels(r.Labels) + "]"
+	}
+	if r.Error != "" {
+		log.Printf("Ping: %s (*), RTT: *%s \n", r.Target, labels)
+	} else {
+		log.Printf("Ping: %s (%s), RTT: %s%s\n", r.Target, r.Address, r.RTT, labels)
+	}
+}
+
+func (logOutput) Summary(s Summary) {
+	log.Printf("Packet Loss: %s: %.1f%% (%v packets lost) \n", s.Target, s.Loss, s.Lost)
+}
+
+func (o logOutput) Final(s Summary) {
+	o.Summary(s)
+}
+
+// templateOutput renders probe results with a text/template, and summaries
+// (the final one included) with the template's "summary" definition if it
+// has one. Each rendering is written as one line.
+type templateOutput struct {
+	w        io.Writer
+	probe    *template.Template
+	summary  *template.Template
+	fallback Output
+}
+
+// templateFuncs are available to output templates on top of the builtins.
+var templateFuncs = template.FuncMap{
+	// ms formats a duration as milliseconds with three decimals
+	"ms": func(d time.Duration) string {
+		return fmt.Sprintf("%.3f", float64(d)/float64(time.Millisecond))
+	},
+	// labels formats labels as sorted key=value pairs
+	"labels": formatLabels,
+	"upper":  strings.ToUpper,
+	"lower":  strings.ToLower,
+}
+
+// newTemplateOutput parses text, or the contents of the file it names, as
+// an output template. Summaries fall back to the default format when the
+// template doesn't define "summary".
+func newTemplateOutput(text string) (*templateOutput, error) {
+	if b, error := os.ReadFile(text); error == nil {
+		text = string(b)
+	}
+	t, error := template.New("probe").Funcs(templateFuncs).Parse(text)
+	if error != nil {
+		return nil, error
+	}
+	return &templateOutput{
+		w:        os.Stdout,
+		probe:    t,
+		summary:  t.Lookup("summary"),
+		fallback: logOutput{},
+	}, nil
+}
+
+func (o *templateOutput) Probe(r ProbeResult) {
+	o.execute(o.probe, r)
+}
+
+func (o *templateOutput) Summary(s Summary) {
+	if o.summary == nil {
+		o.fallback.Summary(s)
+		return
+	}
+	o.execute(o.summary, s)
+}
+
+func (o *templateOutput) Final(s Summary) {
+	if o.summary == nil {
+		o.fallback.Final(s)
+		return
+	}
+	o.execute(o.summary, s)
+}
+
+func (o *templateOutput) execute(t *template.Template, data interface{}) {
+	var b bytes.Buffer
+	if error := t.Execute(&b, data); error != nil {
+		log.Println(error)
+		return
+	}
+	if b.Len() == 0 {
+		return
+	}
+	if !bytes.HasSuffix(b.Bytes(), []byte("\n")) {
+		b.WriteByte('\n')
+	}
+	o.w.Write(b.Bytes())
+}
+
+// iputilsOutput mimics the output of Linux iputils ping byte for byte, so
+// scripts and parsers written for it keep working. Like iputils it says
+// nothing about lost probes and prints no periodic summaries, only the
+// statistics block at the end. It counts for itself, in whole microseconds
+// as iputils does, so statistics restored from a state file don't show.
+type iputilsOutput struct {
+	w    io.Writer
+	size int
+
+	mu     sync.Mutex
+	runs   map[string]*iputilsRun
+	failed map[string]bool
+}
+
+// iputilsRun is what iputilsOutput counts for one target.
+type iputilsRun struct {
+	started           time.Time
+	sent, received    int
+	min, max, sum, sq int64 // RTTs in microseconds
+}
+
+func newIputilsOutput(size int) *iputilsOutput {
+	return &iputilsOutput{
+		w:      os.Stdout,
+		size:   size,
+		runs:   make(map[string]*iputilsRun),
+		failed: make(map[string]bool),
+	}
+}
+
+func (o *iputilsOutput) Probe(r ProbeResult) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	run := o.runs[r.Target]
+	if run == nil {
+		if r.Address == "" {
+			if !o.failed[r.Target] {
+				o.failed[r.Target] = true
+				fmt.Fprintf(o.w, "ping: %s: %s\n", r.Target, r.Error)
+			}
+			return
+		}
+		run = &iputilsRun{started: r.Time}
+		o.runs[r.Target] = run
+		if ip := net.ParseIP(r.Address); ip != nil && ip.To4() == nil {
+			fmt.Fprintf(o.w, "PING %s(%s) %d data bytes\n", r.Target, r.Address, o.size)
+		} else {
+			fmt.Fprintf(o.w, "PING %s (%s) %d(%d) bytes of data.\n", r.Target, r.Address, o.size, o.size+8+20)
+		}
+	}
+	run.sent++
+	if r.Error != "" {
+		return
+	}
+
+	us := r.RTT.Microseconds()
+	run.received++
+	if run.received == 1 || us < run.min {
+		run.min = us
+	}
+	if us > run.max {
+		run.max = us
+	}
+	run.sum += us
+	run.sq += us * us
+
+	from := r.Address
+	if net.ParseIP(r.Target) == nil {
+		from = fmt.Sprintf("%s (%s)", r.Target, r.Address)
+	}
+	ttl := ""
+	if r.TTL >= 0 {
+		ttl = fmt.Sprintf(" ttl=%d", r.TTL)
+	}
+	fmt.Fprintf(o.w, "%d bytes from %s: icmp_seq=%d%s time=%s ms\n", r.Size, from, run.sent, ttl, iputilsTime(r.RTT))
+}
+
+func (o *iputilsOutput) Summary(s Summary) {}
+
+func (o *iputilsOutput) Final(s Summary) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	run, ok := o.runs[s.Target]
+	if !ok {
+		return
+	}
+	fmt.Fprintf(o.w, "\n--- %s ping statistics ---\n", s.Target)
+	fmt.Fprintln(o.w, run.statistics(time.Since(run.started)))
+}
+
+// statistics renders the statistics block the way iputils does: averages in
+// integer microseconds, and the deviation as the integer square root of the
+// mean square minus the squared mean.
+func (run *iputilsRun) statistics(elapsed time.Duration) string {
+	loss := 0.0
+	if run.sent > 0 {
+		loss = float64(run.sent-run.received) * 100 / float64(run.sent)
+	}
+	text := fmt.Sprintf("%d packets transmitted, %d received, %s%% packet loss, time %dms",
+		run.sent, run.received, strconv.FormatFloat(loss, 'g', 6, 64), elapsed.Milliseconds())
+	if run.received > 0 {
+		n := int64(run.received)
+		avg := run.sum / n
+		mdev := int64(math.Sqrt(float64(run.sq/n - avg*avg)))
+		text += fmt.Sprintf("\nrtt min/avg/max/mdev = %s/%s/%s/%s ms", iputilsMillis(run.min), iputilsMillis(avg),
+			iputilsMillis(run.max), iputilsMillis(mdev))
+	}
+	return text
+}
+
+// iputilsMillis prints microseconds as milliseconds with three decimals,
+// without going through floating point.
+func iputilsMillis(us int64) string {
+	return fmt.Sprintf("%d.%03d", us/1000, us%1000)
+}
+
+// iputilsTime formats a reply's RTT with the precision iputils uses, which
+// drops decimals as the time grows.
+func iputilsTime(d time.Duration) string {
+	us := d.Microseconds()
+	switch {
+	case us >= 100000-50:
+		return strconv.FormatInt((us+500)/1000, 10)
+	case us >= 10000-5:
+		return fmt.Sprintf("%d.%01d", (us+50)/1000, ((us+50)%1000)/100)
+	case us >= 1000:
+		return fmt.Sprintf("%d.%02d", (us+5)/1000, ((us+5)%1000)/10)
+	}
+	return fmt.Sprintf("%d.%03d", us/1000, us%1000)
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
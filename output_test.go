@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIputilsTime(t *testing.T) {
+	tests := []struct {
+		rtt  time.Duration
+		want string
+	}{
+		{0, "0.000"},
+		{92*time.Microsecond + 900*time.Nanosecond, "0.092"}, // truncated, not rounded
+		{999 * time.Microsecond, "0.999"},
+		{1234 * time.Microsecond, "1.23"},
+		{1235 * time.Microsecond, "1.24"},
+		{9994 * time.Microsecond, "9.99"},
+		{9995 * time.Microsecond, "10.0"},
+		{12345 * time.Microsecond, "12.3"},
+		{99949 * time.Microsecond, "99.9"},
+		{99950 * time.Microsecond, "100"},
+		{123456 * time.Microsecond, "123"},
+	}
+	for _, test := range tests {
+		if got := iputilsTime(test.rtt); got != test.want {
+			t.Errorf("iputilsTime(%v) = %q, want %q", test.rtt, got, test.want)
+		}
+	}
+}
+
+func TestIputilsStatistics(t *testing.T) {
+	tests := []struct {
+		name string
+		rtts []time.Duration // -1 for lost
+		want string
+	}{
+		{
+			name: "all lost",
+			rtts: []time.Duration{-1, -1},
+			want: "2 packets transmitted, 0 received, 100% packet loss, time 1000ms",
+		},
+		{
+			// the summary must agree with the per-reply times, which are
+			// truncated to microseconds
+			name: "sub-microsecond parts dropped",
+			rtts: []time.Duration{92900 * time.Nanosecond, 93100 * time.Nanosecond},
+			want: "2 packets transmitted, 2 received, 0% packet loss, time 1000ms\n" +
+				"rtt min/avg/max/mdev = 0.092/0.092/0.093/0.009 ms",
+		},
+		{
+			name: "loss and deviation",
+			rtts: []time.Duration{1000 * time.Microsecond, -1, 3000 * time.Microsecond},
+			want: "3 packets transmitted, 2 received, 33.3333% packet loss, time 1000ms\n" +
+				"rtt min/avg/max/mdev = 1.000/2.000/3.000/1.000 ms",
+		},
+	}
+	for _, test := range tests {
+		var out bytes.Buffer
+		o := newIputilsOutput(56)
+		o.w = &out
+		for _, rtt := range test.rtts {
+			r := ProbeResult{Target: "192.0.2.1", Address: "192.0.2.1", RTT: rtt, Size: 64, TTL: 64, Time: time.Now()}
+			if rtt < 0 {
+				r.RTT, r.Error = 0, "timeout"
+			}
+			o.Probe(r)
+		}
+		if got := o.runs["192.0.2.1"].statistics(time.Second); got != test.want {
+			t.Errorf("%s: got\n%s\nwant\n%s", test.name, got, test.want)
+		}
+	}
+}
+
+func TestIputilsProbe(t *testing.T) {
+	tests := []struct {
+		name  string
+		probe ProbeResult
+		want  string
+	}{
+		{
+			name:  "address target",
+			probe: ProbeResult{Target: "192.0.2.1", Address: "192.0.2.1", Seq: 41, Size: 64, TTL: 57, RTT: 1234 * time.Microsecond},
+			want:  "PING 192.0.2.1 (192.0.2.1) 56(84) bytes of data.\n64 bytes from 192.0.2.1: icmp_seq=1 ttl=57 time=1.23 ms\n",
+		},
+		{
+			name:  "host name target",
+			probe: ProbeResult{Target: "example.com", Address: "192.0.2.1", Seq: 7, Size: 64, TTL: 57, RTT: 1234 * time.Microsecond},
+			want:  "PING example.com (192.0.2.1) 56(84) bytes of data.\n64 bytes from example.com (192.0.2.1): icmp_seq=1 ttl=57 time=1.23 ms\n",
+		},
+		{
+			name:  "IPv6, unknown TTL",
+			probe: ProbeResult{Target: "2001:db8::1", Address: "2001:db8::1", Seq: 1, Size: 64, TTL: -1, RTT: 500 * time.Microsecond},
+			want:  "PING 2001:db8::1(2001:db8::1) 56 data bytes\n64 bytes from 2001:db8::1: icmp_seq=1 time=0.500 ms\n",
+		},
+	}
+	for _, test := range tests {
+		var out bytes.Buffer
+		o := newIputilsOutput(56)
+		o.w = &out
+		o.Probe(test.probe)
+		if got := out.String(); got != test.want {
+			t.Errorf("%s: got\n%s\nwant\n%s", test.name, got, test.want)
+		}
+	}
+}
+
+// TestIputilsSequence checks that icmp_seq counts from 1 in every run, even
+// when the statistics carried over from a state file put Seq further on.
+func TestIputilsSequence(t *testing.T) {
+	var out bytes.Buffer
+	o := newIputilsOutput(56)
+	o.w = &out
+	for seq := 101; seq <= 103; seq++ {
+		o.Probe(ProbeResult{Target: "192.0.2.1", Address: "192.0.2.1", Seq: seq, Size: 64, TTL: 64, RTT: time.Millisecond})
+	}
+	for i, want := range []string{"icmp_seq=1 ", "icmp_seq=2 ", "icmp_seq=3 "} {
+		if line := strings.Split(out.String(), "\n")[i+1]; !strings.Contains(line, want) {
+			t.Errorf("line %d = %q, want %s", i+1, line, want)
+		}
+	}
+}
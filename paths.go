@@ -0,0 +1,103 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// pathsCommand pings one target over several egress paths at once, each path
+// being an interface, a firewall mark picked up by policy routing, or both,
+// and reports loss and RTT per path side by side. It is meant for comparing
+// the uplinks of multi-WAN routers.
+func pathsCommand(args []string) error {
+	var vias stringList
+	flags := flag.NewFlagSet("paths", flag.ExitOnError)
+	privileged := flags.Bool("privileged", false, "use raw sockets (needs root or CAP_NET_RAW)")
+	flags.Var(&vias, "via", "a path to probe: an interface (eth0), a firewall mark (mark=0x64) or both (eth0,mark=100); repeat for each path")
+	count := flags.Int("c", 20, "number of rounds")
+	interval := flags.Duration("i", time.Second, "time between rounds")
+	timeout := flags.Duration("W", time.Second, "time to wait for each reply")
+	flags.Usage = func() {
+		fmt.Println("Usage: ping paths -via path -via path [...] [-privileged] [-c rounds] [-i interval] [-W timeout] <host>")
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 || len(vias) == 0 {
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	dst, error := net.ResolveIPAddr("ip", flags.Arg(0))
+	if error != nil {
+		return error
+	}
+
+	var sessions []*Session
+	var names []string
+	for _, via := range vias {
+		opts, error := parseSocketOptions(via)
+		if error != nil {
+			return error
+		}
+		session, error := NewSessionVia(*privileged, opts)
+		if error != nil {
+			return fmt.Errorf("%s: %v", opts, error)
+		}
+		defer session.Close()
+		session.Timeout = *timeout
+		sessions = append(sessions, session)
+		names = append(names, opts.String())
+	}
+
+	fmt.Printf("PING %s (%s) via %s\n", flags.Arg(0), dst, strings.Join(names, ", "))
+	rtts := make([][]time.Duration, len(sessions))
+	for round := 1; round <= *count; round++ {
+		start := time.Now()
+		var wg sync.WaitGroup
+		results := make([]time.Duration, len(sessions))
+		for i, session := range sessions {
+			wg.Add(1)
+			go func(i int, session *Session) {
+				defer wg.Done()
+				rtt, error := session.PingIP(dst)
+				if error != nil {
+					rtt = -1
+				}
+				results[i] = rtt
+			}(i, session)
+		}
+		wg.Wait()
+
+		line := fmt.Sprintf("round %d:", round)
+		for i, rtt := range results {
+			rtts[i] = append(rtts[i], rtt)
+			if rtt < 0 {
+				line += fmt.Sprintf("  %s lost", names[i])
+			} else {
+				line += fmt.Sprintf("  %s %.3f ms", names[i], milliseconds(rtt))
+			}
+		}
+		fmt.Println(line)
+		if round < *count {
+			time.Sleep(*interval - time.Since(start))
+		}
+	}
+
+	fmt.Println()
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "path\tsent\trecv\tloss\tmin\tmedian\tmean\tp90\tmax\tstddev\t")
+	for i, name := range names {
+		d := describe(rtts[i])
+		fmt.Fprintf(w, "%s\t%d\t%d\t%.1f%%\t%.3f\t%.3f\t%.3f\t%.3f\t%.3f\t%.3f\t\n", name,
+			len(rtts[i]), d.received, d.loss, milliseconds(d.min), milliseconds(d.median),
+			milliseconds(d.mean), milliseconds(d.p90), milliseconds(d.max), milliseconds(d.stddev))
+	}
+	w.Flush()
+	fmt.Println("(RTTs in ms)")
+	return nil
+}
@@ -0,0 +1,92 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"runtime"
+	"strconv"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// dropPrivileges gives up root and any capabilities once the raw sockets are
+// open, so the long-running probe loop holds nothing it doesn't need. A
+// setuid binary falls back to the invoking user; real root switches to
+// username. With seccomp set, a filter is then installed that refuses the
+// system calls a compromised pinger could use to regain privileges.
+func dropPrivileges(username string, seccomp bool) error {
+	uid, gid := os.Getuid(), os.Getgid()
+	if uid == 0 {
+		u, error := user.Lookup(username)
+		if error != nil {
+			return error
+		}
+		if uid, error = strconv.Atoi(u.Uid); error != nil {
+			return error
+		}
+		if gid, error = strconv.Atoi(u.Gid); error != nil {
+			return error
+		}
+		if uid == 0 {
+			return fmt.Errorf("refusing to drop privileges to root user %q", username)
+		}
+	}
+
+	if os.Geteuid() == 0 {
+		if error := syscall.Setgroups([]int{gid}); error != nil {
+			return fmt.Errorf("setgroups: %v", error)
+		}
+	}
+	// the syscall package applies these to every thread of the process, and
+	// leaving root this way also clears the permitted and effective capabilities
+	if error := syscall.Setresgid(gid, gid, gid); error != nil {
+		return fmt.Errorf("setresgid: %v", error)
+	}
+	if error := syscall.Setresuid(uid, uid, uid); error != nil {
+		return fmt.Errorf("setresuid: %v", error)
+	}
+
+	if error := clearCapabilities(); error != nil {
+		return error
+	}
+
+	if seccomp {
+		return applySeccomp()
+	}
+	return nil
+}
+
+// clearCapabilities empties the capability sets left over after the uid
+// change, which is what a non-root user running a binary with file
+// capabilities (setcap cap_net_raw+ep) ends up holding.
+func clearCapabilities() error {
+	hdr := unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}
+	var data [2]unix.CapUserData
+	if error := unix.Capget(&hdr, &data[0]); error != nil {
+		return fmt.Errorf("capget: %v", error)
+	}
+	if data[0].Permitted == 0 && data[1].Permitted == 0 && data[0].Inheritable == 0 && data[1].Inheritable == 0 {
+		return nil
+	}
+
+	// capset only changes the calling thread, so it has to run on all of
+	// them. The runtime can't do that when cgo is in use (which net and
+	// os/user pull in by default), and clearing the capabilities of one
+	// thread would only look safe, so the pinger refuses to go on.
+	data = [2]unix.CapUserData{}
+	_, _, errno := syscall.AllThreadsSyscall(unix.SYS_CAPSET, uintptr(unsafe.Pointer(&hdr)), uintptr(unsafe.Pointer(&data[0])), 0)
+	if errno == syscall.ENOTSUP {
+		return fmt.Errorf("can't clear capabilities in a cgo build: rebuild with CGO_ENABLED=0 (or -tags netgo,osusergo), or pass -drop-privileges=false to keep them")
+	}
+	if errno != 0 {
+		return fmt.Errorf("capset: %v", errno)
+	}
+	runtime.KeepAlive(&data)
+	return nil
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "fmt"
+
+// dropPrivileges refuses outside Linux, where the pinger doesn't know how to
+// give up its privileges, rather than carry on holding them unannounced.
+func dropPrivileges(username string, seccomp bool) error {
+	return fmt.Errorf("dropping privileges is only supported on Linux; pass -drop-privileges=false to keep them")
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// pushMetrics replaces the metrics of the job/instance group on a Prometheus
+// Pushgateway with the final summaries, so that one-shot runs from cron show
+// up in Prometheus.
+func pushMetrics(gateway, job, instance string, summaries []Summary) error {
+	var body bytes.Buffer
+	writeMetrics(&body, summaries)
+
+	u := strings.TrimSuffix(gateway, "/") + "/metrics/" + groupingPath("job", job) + "/" + groupingPath("instance", instance)
+	req, error := http.NewRequest(http.MethodPut, u, &body)
+	if error != nil {
+		return error
+	}
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, error := client.Do(req)
+	if error != nil {
+		return error
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("pushgateway: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// groupingPath renders one grouping label as a URL path segment pair.
+// Values the path can't carry as they are (empty ones, or ones with a
+// slash) use the base64 form the Pushgateway accepts.
+func groupingPath(name, value string) string {
+	if value == "" || strings.Contains(value, "/") {
+		if value == "" {
+			return name + "@base64/="
+		}
+		return name + "@base64/" + base64.RawURLEncoding.EncodeToString([]byte(value))
+	}
+	return name + "/" + url.PathEscape(value)
+}
+
+// writeMetrics writes summaries in the Prometheus text exposition format,
+// one series per target, labelled with the target and its labels.
+func writeMetrics(w io.Writer, summaries []Summary) {
+	type gauge struct {
+		name, help string
+		value      func(s Summary) float64
+	}
+	gauges := []gauge{
+		{"ping_sent", "Echo requests sent.", func(s Summary) float64 { return float64(s.Sent) }},
+		{"ping_received", "Echo replies received.", func(s Summary) float64 { return float64(s.Received) }},
+		{"ping_loss_ratio", "Share of echo requests lost.", func(s Summary) float64 { return s.Loss / 100 }},
+		{"ping_rtt_min_seconds", "Shortest round trip time.", func(s Summary) float64 { return s.MinRTT.Seconds() }},
+		{"ping_rtt_avg_seconds", "Average round trip time.", func(s Summary) float64 { return s.AvgRTT.Seconds() }},
+		{"ping_rtt_max_seconds", "Longest round trip time.", func(s Summary) float64 { return s.MaxRTT.Seconds() }},
+		{"ping_rtt_mdev_seconds", "Mean deviation of the round trip time.", func(s Summary) float64 { return s.MdevRTT.Seconds() }},
+		{"ping_outages", "Outages, runs of 3 or more lost probes.", func(s Summary) float64 { return float64(s.Outages) }},
+		{"ping_downtime_seconds", "Time spent in outages.", func(s Summary) float64 { return s.Downtime.Seconds() }},
+		{"ping_availability_ratio", "Share of the monitored time the target was not down.", func(s Summary) float64 { return s.Availability / 100 }},
+	}
+	for _, g := range gauges {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", g.name, g.help, g.name)
+		for _, s := range summaries {
+			fmt.Fprintf(w, "%s{%s} %s\n", g.name, metricLabels(s, ""), formatFloat(g.value(s)))
+		}
+	}
+
+	fmt.Fprintf(w, "# HELP ping_rtt_seconds Round trip times.\n# TYPE ping_rtt_seconds histogram\n")
+	for _, s := range summaries {
+		cumulative := 0
+		for _, b := range s.Histogram {
+			cumulative += b.Count
+			le := "+Inf"
+			if b.UpperBound > 0 {
+				le = formatFloat(b.UpperBound.Seconds())
+			}
+			fmt.Fprintf(w, "ping_rtt_seconds_bucket{%s} %d\n", metricLabels(s, le), cumulative)
+		}
+		if len(s.Histogram) == 0 || s.Histogram[len(s.Histogram)-1].UpperBound > 0 {
+			fmt.Fprintf(w, "ping_rtt_seconds_bucket{%s} %d\n", metricLabels(s, "+Inf"), cumulative)
+		}
+		sum := time.Duration(s.Received) * s.AvgRTT
+		fmt.Fprintf(w, "ping_rtt_seconds_sum{%s} %s\n", metricLabels(s, ""), formatFloat(sum.Seconds()))
+		fmt.Fprintf(w, "ping_rtt_seconds_count{%s} %d\n", metricLabels(s, ""), s.Received)
+	}
+}
+
+// metricLabels renders the target and its labels, plus le when given, as a
+// Prometheus label set. Label names are reduced to the characters Prometheus
+// allows. Names the series needs for itself (target, le, and the job and
+// instance grouping labels) or reserved for internal use (__*) get a label_
+// prefix, and names that still collide, like site-a and site_a, a numeric
+// suffix.
+func metricLabels(s Summary, le string) string {
+	names := make([]string, 0, len(s.Labels))
+	for k := range s.Labels {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	used := make(map[string]bool)
+	pairs := []string{`target="` + escapeLabelValue(s.Target) + `"`}
+	for _, k := range names {
+		name := metricName(k)
+		if name == "target" || name == "le" || name == "job" || name == "instance" || strings.HasPrefix(name, "__") {
+			name = "label_" + name
+		}
+		for n, base := 2, name; used[name]; n++ {
+			name = base + "_" + strconv.Itoa(n)
+		}
+		used[name] = true
+		pairs = append(pairs, name+`="`+escapeLabelValue(s.Labels[k])+`"`)
+	}
+	if le != "" {
+		pairs = append(pairs, `le="`+le+`"`)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func metricName(s string) string {
+	b := []byte(s)
+	for i, c := range b {
+		if !(c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || i > 0 && c >= '0' && c <= '9') {
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
+
+func escapeLabelValue(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsNaN(f):
+		return "NaN"
+	}
+	return fmt.Sprintf("%g", f)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPushMetrics(t *testing.T) {
+	var method, path, contentType, body string
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		method, path, contentType, body = r.Method, r.URL.EscapedPath(), r.Header.Get("Content-Type"), string(b)
+		w.WriteHeader(status)
+		io.WriteString(w, "pushed metrics are invalid\n")
+	}))
+	defer server.Close()
+
+	s := Summary{Target: "192.0.2.1", Labels: map[string]string{"site": "ams"}}
+	s.Sent, s.Received, s.AvgRTT = 4, 3, 2*time.Millisecond
+	s.Histogram = []Bucket{{UpperBound: time.Millisecond, Count: 1}, {UpperBound: 5 * time.Millisecond, Count: 2}, {Count: 0}}
+
+	tests := []struct {
+		name, gateway, job, instance string
+		path                         string
+	}{
+		{"plain", server.URL, "ping", "host1", "/metrics/job/ping/instance/host1"},
+		{"trailing slash", server.URL + "/", "ping", "host1", "/metrics/job/ping/instance/host1"},
+		{"slash in value", server.URL, "ping/cron", "host1", "/metrics/job@base64/cGluZy9jcm9u/instance/host1"},
+		{"empty instance", server.URL, "ping", "", "/metrics/job/ping/instance@base64/="},
+		{"escaped", server.URL, "ping", "a b", "/metrics/job/ping/instance/a%20b"},
+	}
+	for _, test := range tests {
+		if error := pushMetrics(test.gateway, test.job, test.instance, []Summary{s}); error != nil {
+			t.Errorf("%s: %v", test.name, error)
+			continue
+		}
+		if method != http.MethodPut || path != test.path || !strings.HasPrefix(contentType, "text/plain; version=0.0.4") {
+			t.Errorf("%s: got %s %s (%s), want PUT %s", test.name, method, path, contentType, test.path)
+		}
+	}
+
+	for _, want := range []string{
+		"# TYPE ping_sent gauge\nping_sent{target=\"192.0.2.1\",site=\"ams\"} 4\n",
+		"ping_loss_ratio{target=\"192.0.2.1\",site=\"ams\"} 0\n",
+		"# TYPE ping_rtt_seconds histogram\n",
+		"ping_rtt_seconds_bucket{target=\"192.0.2.1\",site=\"ams\",le=\"0.001\"} 1\n",
+		"ping_rtt_seconds_bucket{target=\"192.0.2.1\",site=\"ams\",le=\"0.005\"} 3\n",
+		"ping_rtt_seconds_bucket{target=\"192.0.2.1\",site=\"ams\",le=\"+Inf\"} 3\n",
+		"ping_rtt_seconds_sum{target=\"192.0.2.1\",site=\"ams\"} 0.006\n",
+		"ping_rtt_seconds_count{target=\"192.0.2.1\",site=\"ams\"} 3\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("body lacks %q:\n%s", want, body)
+		}
+	}
+	if n := strings.Count(body, "le=\"+Inf\""); n != 1 {
+		t.Errorf("%d +Inf buckets", n)
+	}
+
+	status = http.StatusBadRequest
+	error := pushMetrics(server.URL, "ping", "host1", []Summary{s})
+	if error == nil || !strings.Contains(error.Error(), "400") || !strings.Contains(error.Error(), "pushed metrics are invalid") {
+		t.Errorf("rejected push: got %v", error)
+	}
+}
+
+func TestMetricLabels(t *testing.T) {
+	tests := []struct {
+		name   string
+		labels map[string]string
+		le     string
+		want   string
+	}{
+		{"none", nil, "", `target="t"`},
+		{"le", map[string]string{"b": "2", "a": "1"}, "0.5", `target="t",a="1",b="2",le="0.5"`},
+		{"sanitised", map[string]string{"site-name": "x", "1st": "y"}, "", `target="t",_st="y",site_name="x"`},
+		{"escaped value", map[string]string{"note": "a \"b\"\\\n"}, "", `target="t",note="a \"b\"\\\n"`},
+		{
+			"collision", map[string]string{"site-a": "1", "site_a": "2", "site.a": "3"}, "",
+			`target="t",site_a="1",site_a_2="3",site_a_3="2"`,
+		},
+		{
+			"reserved", map[string]string{"target": "1", "le": "2", "job": "3", "instance": "4", "__name__": "5"}, "",
+			`target="t",label___name__="5",label_instance="4",label_job="3",label_le="2",label_target="1"`,
+		},
+		{"renamed into a collision", map[string]string{"job": "1", "label_job": "2"}, "", `target="t",label_job="1",label_job_2="2"`},
+	}
+	for _, test := range tests {
+		got := metricLabels(Summary{Target: "t", Labels: test.labels}, test.le)
+		if got != test.want {
+			t.Errorf("%s: got %s, want %s", test.name, got, test.want)
+		}
+		names := make(map[string]bool)
+		for _, pair := range strings.Split(got, `",`) {
+			name := pair[:strings.IndexByte(pair, '=')]
+			if names[name] {
+				t.Errorf("%s: label %s twice in %s", test.name, name, got)
+			}
+			names[name] = true
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// rateStep is what one probe rate got back.
+type rateStep struct {
+	rate      float64 // probes per second
+	sent      int
+	desc      description
+	replyRate float64 // replies per second
+}
+
+// rateLimitCommand sends probes at increasing rates and looks for the rate
+// at which replies start to be dropped or delayed. Path loss and congestion
+// do not care how fast one host probes, so loss that only shows up above
+// some rate, with replies levelling off at a fixed rate, points to a router
+// or host policing the ICMP it generates. With -ttl the probes expire at
+// that hop, so it is the router's time exceeded messages that are measured.
+func rateLimitCommand(args []string) error {
+	flags := flag.NewFlagSet("ratelimit", flag.ExitOnError)
+	privileged := flags.Bool("privileged", false, "use raw sockets (needs root or CAP_NET_RAW; required for -ttl)")
+	ttl := flags.Int("ttl", 0, "measure the router this many hops away instead of the host")
+	start := flags.Float64("start", 5, "probes per second of the first step")
+	maxRate := flags.Float64("max", 1000, "highest rate to try")
+	factor := flags.Float64("factor", 2, "rate increase from one step to the next")
+	duration := flags.Duration("duration", 2*time.Second, "how long each step sends for")
+	timeout := flags.Duration("W", time.Second, "time to wait for each reply")
+	flags.Usage = func() {
+		fmt.Println("Usage: ping ratelimit [-privileged] [-ttl hop] [-start 5] [-max 1000] [-factor 2] [-duration 2s] [-W timeout] <host>")
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 || *start <= 0 || *factor <= 1 {
+		flags.Usage()
+		os.Exit(1)
+	}
+	if *ttl > 0 && !*privileged {
+		return fmt.Errorf("-ttl needs -privileged, as only raw sockets see time exceeded messages")
+	}
+
+	dst, error := net.ResolveIPAddr("ip", flags.Arg(0))
+	if error != nil {
+		return error
+	}
+	session, error := NewSession(*privileged)
+	if error != nil {
+		return error
+	}
+	defer session.Close()
+	session.Timeout = *timeout
+	target := dst.String()
+	if *ttl > 0 {
+		if error := session.SetTTL(*ttl); error != nil {
+			return error
+		}
+		target = fmt.Sprintf("hop %d towards %s", *ttl, dst)
+	}
+
+	fmt.Printf("Ramping probes to %s from %g to %g per second\n", target, *start, *maxRate)
+	// rows are printed as each step finishes, so the columns are fixed
+	// rather than left to a tabwriter
+	fmt.Printf("%8s %6s %6s %7s %10s %9s %9s\n", "rate/s", "sent", "recv", "loss", "replies/s", "median", "p90")
+	steps, minLoss := rampRates(*start, *maxRate, *factor, func(rate float64) rateStep {
+		step := measureRate(session, dst, rate, *duration, *ttl > 0)
+		fmt.Printf("%8.0f %6d %6d %6.1f%% %10.1f %9.3f %9.3f\n", step.rate, step.sent, step.desc.received,
+			step.desc.loss, step.replyRate, milliseconds(step.desc.median), milliseconds(step.desc.p90))
+		return step
+	})
+	fmt.Println("(RTTs in ms)")
+
+	fmt.Println()
+	fmt.Println(rateVerdict(steps, minLoss))
+	return nil
+}
+
+// rampRates measures each rate from start, multiplying it by factor up to
+// max, and returns the steps and the lowest loss any of them saw. It stops
+// early after two limited steps in a row: that is enough to tell, and there
+// is no point in hammering the target further.
+func rampRates(start, max, factor float64, measure func(rate float64) rateStep) ([]rateStep, float64) {
+	var steps []rateStep
+	minLoss := 100.0
+	run := 0
+	// the tolerance keeps max itself in when repeated multiplication
+	// overshoots it by a rounding error
+	for rate := start; rate <= max*(1+1e-9); rate *= factor {
+		step := measure(rate)
+		if step.desc.loss < minLoss {
+			minLoss = step.desc.loss
+		}
+		steps = append(steps, step)
+		if step.desc.loss > minLoss+10 {
+			run++
+		} else {
+			run = 0
+		}
+		if run == 2 {
+			break
+		}
+	}
+	return steps, minLoss
+}
+
+// measureRate sends probes to dst at rate for duration, without waiting for
+// one reply before sending the next probe. With hop set, time exceeded
+// messages count as replies.
+func measureRate(s *Session, dst *net.IPAddr, rate float64, duration time.Duration, hop bool) rateStep {
+	step := rateStep{rate: rate}
+	var mu sync.Mutex
+	var rtts []time.Duration
+	var wg sync.WaitGroup
+
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / rate))
+	defer ticker.Stop()
+	deadline := time.Now().Add(duration)
+	for time.Now().Before(deadline) {
+		step.sent++
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			reply, error := s.Probe(dst)
+			var icmpError *ICMPError
+			if error != nil && !(hop && errors.As(error, &icmpError) &&
+				(icmpError.Type == ipv4.ICMPTypeTimeExceeded || icmpError.Type == ipv6.ICMPTypeTimeExceeded)) {
+				reply.RTT = -1
+			}
+			mu.Lock()
+			rtts = append(rtts, reply.RTT)
+			mu.Unlock()
+		}()
+		<-ticker.C
+	}
+	wg.Wait()
+
+	step.desc = describe(rtts)
+	step.replyRate = float64(step.desc.received) / duration.Seconds()
+	return step
+}
+
+// rateVerdict sums up the steps. A step is limited when it lost clearly more
+// than the best step, and delayed when its median RTT is well above the
+// first step's.
+func rateVerdict(steps []rateStep, minLoss float64) string {
+	if len(steps) == 0 {
+		return "Nothing measured; -start is above -max."
+	}
+	base := steps[0]
+	if base.desc.received == 0 {
+		return "No replies at all, even at the lowest rate."
+	}
+
+	firstLimited, firstDelayed := -1, -1
+	var limitedReplies float64
+	limited := 0
+	for i, s := range steps {
+		if s.desc.loss > minLoss+10 {
+			if firstLimited < 0 {
+				firstLimited = i
+			}
+			limitedReplies += s.replyRate
+			limited++
+		}
+		if s.desc.received > 0 && s.desc.median > 2*base.desc.median+time.Millisecond && firstDelayed < 0 {
+			firstDelayed = i
+		}
+	}
+
+	var verdict string
+	switch {
+	case firstLimited < 0 && minLoss > 0:
+		verdict = fmt.Sprintf("No rate limiting up to %.0f probes/s. The %.1f%% loss seen at every rate does not depend on the rate, so it looks like real path loss.", steps[len(steps)-1].rate, minLoss)
+	case firstLimited < 0:
+		verdict = fmt.Sprintf("No rate limiting up to %.0f probes/s.", steps[len(steps)-1].rate)
+	case firstLimited == 0:
+		verdict = fmt.Sprintf("Replies were already dropped at %.0f probes/s, so the limit is below that; try a lower -start.", base.rate)
+	default:
+		verdict = fmt.Sprintf("Replies start being dropped between %.0f and %.0f probes/s, levelling off at about %.0f replies/s: "+
+			"the inferred ICMP rate limit. Loss at higher probe rates is the target policing ICMP, not loss on the path.",
+			steps[firstLimited-1].rate, steps[firstLimited].rate, limitedReplies/float64(limited))
+	}
+	if firstDelayed > 0 {
+		verdict += fmt.Sprintf("\nReplies are delayed from %.0f probes/s on (median RTT %.3f ms against %.3f ms at %.0f probes/s), as ICMP generated in a router's slow path often is.",
+			steps[firstDelayed].rate, milliseconds(steps[firstDelayed].desc.median), milliseconds(base.desc.median), base.rate)
+	}
+	return verdict
+}
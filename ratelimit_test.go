@@ -0,0 +1,150 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// step builds a measured rate step with the given loss, median RTT and reply
+// rate.
+func step(rate, loss float64, median time.Duration, replyRate float64) rateStep {
+	s := rateStep{rate: rate, sent: 100, replyRate: replyRate}
+	s.desc.loss = loss
+	s.desc.received = int(100 - loss)
+	s.desc.median = median
+	return s
+}
+
+func TestRampRates(t *testing.T) {
+	tests := []struct {
+		name               string
+		start, max, factor float64
+		loss               func(rate float64) float64
+		rates              []float64
+		minLoss            float64
+	}{
+		{
+			name: "up to max", start: 5, max: 40, factor: 2,
+			loss:  func(float64) float64 { return 0 },
+			rates: []float64{5, 10, 20, 40},
+		},
+		{
+			name: "max reached despite rounding", start: 0.1, max: 1000, factor: 10,
+			loss:  func(float64) float64 { return 0 },
+			rates: []float64{0.1, 1, 10, 100, 1000},
+		},
+		{
+			name: "start above max", start: 10, max: 5, factor: 2,
+			loss: func(float64) float64 { return 0 }, minLoss: 100,
+		},
+		{
+			name: "stops after two limited steps", start: 5, max: 1000, factor: 2,
+			loss: func(rate float64) float64 {
+				if rate >= 40 {
+					return 50
+				}
+				return 0
+			},
+			rates: []float64{5, 10, 20, 40, 80},
+		},
+		{
+			name: "one limited step is not enough", start: 5, max: 80, factor: 2,
+			loss: func(rate float64) float64 {
+				if rate == 20 {
+					return 50
+				}
+				return 1
+			},
+			rates: []float64{5, 10, 20, 40, 80}, minLoss: 1,
+		},
+		{
+			name: "loss within 10 points is not limiting", start: 5, max: 80, factor: 2,
+			loss:  func(rate float64) float64 { return rate / 10 },
+			rates: []float64{5, 10, 20, 40, 80}, minLoss: 0.5,
+		},
+	}
+	for _, test := range tests {
+		var rates []float64
+		steps, minLoss := rampRates(test.start, test.max, test.factor, func(rate float64) rateStep {
+			rates = append(rates, rate)
+			return step(rate, test.loss(rate), time.Millisecond, rate)
+		})
+		for i := range rates {
+			rates[i] = float64(int(rates[i]*1000+0.5)) / 1000
+		}
+		if !reflect.DeepEqual(rates, test.rates) || len(steps) != len(rates) || minLoss != test.minLoss {
+			t.Errorf("%s: measured %v, min loss %g, want %v, %g", test.name, rates, minLoss, test.rates, test.minLoss)
+		}
+	}
+}
+
+func TestRateVerdict(t *testing.T) {
+	ms := time.Millisecond
+	tests := []struct {
+		name    string
+		steps   []rateStep
+		minLoss float64
+		want    []string // in the verdict
+		not     []string // not in the verdict
+	}{
+		{name: "nothing", want: []string{"Nothing measured"}},
+		{
+			name:  "no replies",
+			steps: []rateStep{step(5, 100, 0, 0)}, minLoss: 100,
+			want: []string{"No replies at all"},
+		},
+		{
+			name:  "no limiting",
+			steps: []rateStep{step(5, 0, ms, 5), step(10, 5, ms, 9.5), step(20, 10, ms, 18)},
+			want:  []string{"No rate limiting up to 20 probes/s."}, not: []string{"path loss", "delayed"},
+		},
+		{
+			name:  "path loss",
+			steps: []rateStep{step(5, 20, ms, 4), step(10, 20, ms, 8)}, minLoss: 20,
+			want: []string{"No rate limiting up to 10 probes/s", "20.0% loss", "real path loss"},
+		},
+		{
+			name:  "limited from the start",
+			steps: []rateStep{step(5, 50, ms, 2.5), step(10, 0, ms, 10)},
+			want:  []string{"already dropped at 5 probes/s"},
+		},
+		{
+			name: "limited",
+			steps: []rateStep{
+				step(5, 0, ms, 5), step(10, 0, ms, 10), step(20, 50, ms, 10), step(40, 75, ms, 10),
+			},
+			want: []string{"between 10 and 20 probes/s", "about 10 replies/s"},
+		},
+		{
+			name:  "delayed",
+			steps: []rateStep{step(5, 0, ms, 5), step(10, 0, 3500*time.Microsecond, 10), step(20, 0, 5*ms, 20)},
+			want:  []string{"No rate limiting", "delayed from 10 probes/s on (median RTT 3.500 ms against 1.000 ms at 5 probes/s)"},
+		},
+		{
+			// twice the first step's median plus 1ms
+			name:  "delay at the threshold",
+			steps: []rateStep{step(5, 0, ms, 5), step(10, 0, 3*ms, 10)},
+			not:   []string{"delayed"},
+		},
+		{
+			name:  "lost steps are not delayed",
+			steps: []rateStep{step(5, 0, ms, 5), step(10, 100, 0, 0), step(20, 100, 0, 0)},
+			want:  []string{"between 5 and 10 probes/s"}, not: []string{"delayed"},
+		},
+	}
+	for _, test := range tests {
+		got := rateVerdict(test.steps, test.minLoss)
+		for _, s := range test.want {
+			if !strings.Contains(got, s) {
+				t.Errorf("%s: %q lacks %q", test.name, got, s)
+			}
+		}
+		for _, s := range test.not {
+			if strings.Contains(got, s) {
+				t.Errorf("%s: %q has %q", test.name, got, s)
+			}
+		}
+	}
+}
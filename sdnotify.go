@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// sdNotify sends a state update such as "READY=1" to systemd when running as
+// a Type=notify service. Outside systemd it does nothing.
+func sdNotify(state string) error {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return nil
+	}
+	if path[0] == '@' {
+		path = "\x00" + path[1:] // abstract namespace socket
+	}
+	c, error := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if error != nil {
+		return error
+	}
+	defer c.Close()
+	_, error = c.Write([]byte(state))
+	return error
+}
+
+// watchdogInterval returns the WatchdogSec systemd configured for this
+// process, or 0 when the watchdog is not enabled.
+func watchdogInterval() time.Duration {
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	usec, error := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if error != nil || usec <= 0 {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// watchdog sends WATCHDOG=1 at half the configured interval, but only while
+// progress keeps moving forward. A probe loop that hangs stops the
+// heartbeats, and systemd restarts the service.
+func watchdog(interval time.Duration, progress func() time.Time) {
+	var last time.Time
+	for range time.Tick(interval / 2) {
+		now := progress()
+		if !now.After(last) {
+			continue
+		}
+		last = now
+		sdNotify("WATCHDOG=1")
+	}
+}
@@ -0,0 +1,86 @@
+//go:build linux && (amd64 || arm64)
+// +build linux
+// +build amd64 arm64
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	seccompSetModeFilter   = 1
+	seccompFilterFlagTsync = 1
+	seccompRetAllow        = 0x7fff0000
+	seccompRetErrno        = 0x00050000
+
+	x32SyscallBit = 0x40000000
+
+	auditArchX8664   = 0xc000003e
+	auditArchAarch64 = 0xc00000b7
+)
+
+// deniedSyscalls are refused with EPERM once the filter is in place. The
+// pinger only needs its sockets, timers and the resolver from here on.
+var deniedSyscalls = []uint32{
+	unix.SYS_EXECVE, unix.SYS_EXECVEAT, unix.SYS_PTRACE,
+	unix.SYS_SETUID, unix.SYS_SETGID, unix.SYS_SETREUID, unix.SYS_SETREGID,
+	unix.SYS_SETRESUID, unix.SYS_SETRESGID, unix.SYS_SETGROUPS, unix.SYS_CAPSET,
+	unix.SYS_MOUNT, unix.SYS_UMOUNT2, unix.SYS_PIVOT_ROOT, unix.SYS_CHROOT,
+	unix.SYS_INIT_MODULE, unix.SYS_FINIT_MODULE, unix.SYS_DELETE_MODULE,
+	unix.SYS_KEXEC_LOAD, unix.SYS_REBOOT, unix.SYS_SWAPON, unix.SYS_SWAPOFF,
+	unix.SYS_BPF, unix.SYS_PERF_EVENT_OPEN,
+}
+
+// applySeccomp installs the deny-list filter on every thread. Calls made
+// under any other architecture's ABI, x32 included, are refused as well,
+// since their syscall numbers would not match the list.
+func applySeccomp() error {
+	arch := uint32(auditArchX8664)
+	if runtime.GOARCH == "arm64" {
+		arch = auditArchAarch64
+	}
+
+	filter := []unix.SockFilter{
+		// load seccomp_data.arch and bail out on a mismatch
+		{Code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, K: 4},
+		{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, K: arch, Jt: 1},
+		{Code: unix.BPF_RET | unix.BPF_K, K: seccompRetErrno | uint32(unix.EPERM)},
+		// load seccomp_data.nr
+		{Code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, K: 0},
+	}
+	if runtime.GOARCH == "amd64" {
+		// x32 calls share AUDIT_ARCH_X86_64 but set a high bit in the
+		// number, which would slip past the list below
+		filter = append(filter,
+			unix.SockFilter{Code: unix.BPF_JMP | unix.BPF_JGE | unix.BPF_K, K: x32SyscallBit, Jf: 1},
+			unix.SockFilter{Code: unix.BPF_RET | unix.BPF_K, K: seccompRetErrno | uint32(unix.EPERM)},
+		)
+	}
+	for _, nr := range deniedSyscalls {
+		filter = append(filter,
+			unix.SockFilter{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, K: nr, Jf: 1},
+			unix.SockFilter{Code: unix.BPF_RET | unix.BPF_K, K: seccompRetErrno | uint32(unix.EPERM)},
+		)
+	}
+	filter = append(filter, unix.SockFilter{Code: unix.BPF_RET | unix.BPF_K, K: seccompRetAllow})
+
+	prog := unix.SockFprog{Len: uint16(len(filter)), Filter: &filter[0]}
+
+	// no_new_privs is set on this thread and carried to the others by TSYNC
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if error := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); error != nil {
+		return fmt.Errorf("prctl(PR_SET_NO_NEW_PRIVS): %v", error)
+	}
+	_, _, errno := unix.Syscall(unix.SYS_SECCOMP, seccompSetModeFilter, seccompFilterFlagTsync, uintptr(unsafe.Pointer(&prog)))
+	if errno != 0 {
+		return fmt.Errorf("seccomp: %v", errno)
+	}
+	runtime.KeepAlive(filter)
+	return nil
+}
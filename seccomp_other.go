@@ -0,0 +1,13 @@
+//go:build linux && !amd64 && !arm64
+// +build linux,!amd64,!arm64
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+)
+
+func applySeccomp() error {
+	return fmt.Errorf("seccomp filtering is not supported on %s", runtime.GOARCH)
+}
@@ -0,0 +1,506 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// cookieLen is the size of the random session cookie carried at the start of
+// every echo payload, followed by an 8 byte send timestamp and, when the
+// session has an AuthKey, a macLen byte HMAC.
+const (
+	cookieLen = 8
+	macLen    = sha256.Size
+)
+
+// Session is one pinger's identity on the wire. Each session picks a random
+// echo ID and cookie, keeps its own sockets open, and only accepts replies
+// that carry both, so several sessions in one process (or several processes
+// sharing raw sockets, where everyone sees every reply) never steal each
+// other's replies.
+type Session struct {
+	ID         int
+	Cookie     [cookieLen]byte
+	Timeout    time.Duration
+	Privileged bool
+
+	// Size is the number of data bytes in each echo request, 56 by default
+	// like iputils ping. The payload never shrinks below what the cookie,
+	// timestamp and HMAC need.
+	Size int
+
+	// AuthKey, when set, makes every probe carry an HMAC-SHA256 over its
+	// sequence number, send time and the session ID, and replies that fail
+	// the check are dropped and counted instead of being trusted.
+	AuthKey []byte
+
+	// Forged and Replayed count replies rejected by the AuthKey check:
+	// a bad HMAC, or a valid one for a probe that was already answered.
+	Forged   uint64
+	Replayed uint64
+
+	seq uint32
+
+	mu      sync.Mutex
+	pending map[uint16]*probe
+	// answered remembers the send time of the last answered probe per
+	// sequence number, to tell a replay from a reply that was merely late
+	answered map[uint16]int64
+
+	conn4, conn6 net.PacketConn
+	err4, err6   error
+}
+
+// probe is an echo request waiting for its reply.
+type probe struct {
+	dst   net.IP
+	sent  time.Time
+	reply chan result
+}
+
+type result struct {
+	reply Reply
+	error error
+}
+
+// Reply describes the echo reply to a probe.
+type Reply struct {
+	Seq  int           // the probe's sequence number on the wire
+	RTT  time.Duration // the round trip time
+	Size int           // ICMP bytes received, header included
+	TTL  int           // the reply's TTL or hop limit, -1 when unknown
+}
+
+// ICMPError is returned for a probe that a router or the destination answered
+// with an ICMP error, such as time exceeded or destination unreachable,
+// instead of a reply. Only raw sockets get to see these.
+type ICMPError struct {
+	Type icmp.Type
+	Code int
+	From net.IP // who sent the error
+	MTU  int    // the next-hop MTU of a "fragmentation needed" or "packet too big" error
+}
+
+func (e *ICMPError) Error() string {
+	if e.MTU > 0 {
+		return fmt.Sprintf("%v (code %d, mtu %d) from %v", e.Type, e.Code, e.MTU, e.From)
+	}
+	return fmt.Sprintf("%v (code %d) from %v", e.Type, e.Code, e.From)
+}
+
+// NewSession opens the session's sockets. With privileged set it uses raw
+// sockets, which needs root or CAP_NET_RAW; otherwise it uses the
+// unprivileged "udp" ICMP sockets. A family that cannot be opened (say, no
+// IPv6 on the host) is only reported when a probe needs it.
+func NewSession(privileged bool) (*Session, error) {
+	return NewSessionVia(privileged, SocketOptions{})
+}
+
+// NewSessionVia is NewSession with sockets that leave through the egress
+// interface or firewall mark in opts.
+func NewSessionVia(privileged bool, opts SocketOptions) (*Session, error) {
+	s := &Session{
+		Timeout:    500 * time.Millisecond,
+		Privileged: privileged,
+		Size:       56,
+		pending:    make(map[uint16]*probe),
+		answered:   make(map[uint16]int64),
+	}
+
+	var id [2]byte
+	if _, error := rand.Read(id[:]); error != nil {
+		return nil, error
+	}
+	s.ID = int(binary.BigEndian.Uint16(id[:]))
+	if _, error := rand.Read(s.Cookie[:]); error != nil {
+		return nil, error
+	}
+
+	network4, network6 := "udp4", "udp6"
+	if privileged {
+		network4, network6 = "ip4:icmp", "ip6:ipv6-icmp"
+	}
+	s.conn4, s.err4 = listenICMP(network4, "0.0.0.0", opts)
+	s.conn6, s.err6 = listenICMP(network6, "::", opts)
+	if s.conn4 == nil && s.conn6 == nil {
+		return nil, s.err4
+	}
+	if s.conn4 != nil {
+		go s.receive(s.conn4, ProtocolICMP)
+	}
+	if s.conn6 != nil {
+		go s.receive(s.conn6, ProtocolIPv6ICMP)
+	}
+	return s, nil
+}
+
+// Close closes the session's sockets. Probes still in flight time out.
+func (s *Session) Close() error {
+	if s.conn4 != nil {
+		s.conn4.Close()
+	}
+	if s.conn6 != nil {
+		s.conn6.Close()
+	}
+	return nil
+}
+
+// SetTTL sets the TTL (or hop limit) of the session's outgoing probes, for
+// tracing the route. It applies to everything the session sends, so probes
+// sent concurrently with different TTLs need separate sessions.
+func (s *Session) SetTTL(ttl int) error {
+	if s.conn4 != nil {
+		if error := ipv4Conn(s.conn4).SetTTL(ttl); error != nil {
+			return error
+		}
+	}
+	if s.conn6 != nil {
+		if error := ipv6Conn(s.conn6).SetHopLimit(ttl); error != nil {
+			return error
+		}
+	}
+	return nil
+}
+
+// Ping resolves address and sends it a single echo request.
+func (s *Session) Ping(address string) (*net.IPAddr, time.Duration, error) {
+	// if the input is a DNS, resolve, then get the real address
+	dst, error := net.ResolveIPAddr("ip", address)
+	if error != nil {
+		return nil, 0, error
+	}
+	rtt, error := s.PingIP(dst)
+	return dst, rtt, error
+}
+
+// PingIP sends one echo request to dst and returns the round trip time.
+func (s *Session) PingIP(dst *net.IPAddr) (time.Duration, error) {
+	reply, error := s.Probe(dst)
+	return reply.RTT, error
+}
+
+// Probe sends one echo request to dst and waits up to s.Timeout for the
+// matching reply.
+func (s *Session) Probe(dst *net.IPAddr) (Reply, error) {
+	typ := icmp.Type(ipv4.ICMPTypeEcho)
+	if dst.IP.To4() == nil {
+		typ = ipv6.ICMPTypeEchoRequest
+	}
+	return s.exchange(dst, func(seq uint16, sent time.Time) icmp.Message {
+		return icmp.Message{
+			Type: typ, Code: 0,
+			Body: &icmp.Echo{
+				ID: s.ID, Seq: int(seq),
+				Data: s.payload(seq, sent),
+			},
+		}
+	})
+}
+
+// Timestamp sends an ICMP timestamp request to dst and waits up to s.Timeout
+// for the timestamp reply. Hosts and firewalls that drop echo requests
+// sometimes still answer these. They only exist in IPv4, and the kernel
+// only lets raw sockets send them.
+func (s *Session) Timestamp(dst *net.IPAddr) (Reply, error) {
+	if dst.IP.To4() == nil {
+		return Reply{}, fmt.Errorf("ICMP timestamp requests only exist in IPv4")
+	}
+	if !s.Privileged {
+		return Reply{}, fmt.Errorf("ICMP timestamp requests need raw sockets")
+	}
+	return s.exchange(dst, func(seq uint16, sent time.Time) icmp.Message {
+		// id, seq, then the originate, receive and transmit timestamps in
+		// milliseconds since midnight UTC
+		b := make([]byte, 16)
+		binary.BigEndian.PutUint16(b[0:2], uint16(s.ID))
+		binary.BigEndian.PutUint16(b[2:4], seq)
+		midnight := sent.UTC().Truncate(24 * time.Hour)
+		binary.BigEndian.PutUint32(b[4:8], uint32(sent.Sub(midnight).Milliseconds()))
+		return icmp.Message{Type: ipv4.ICMPTypeTimestamp, Body: &icmp.RawBody{Data: b}}
+	})
+}
+
+// exchange sends the message build returns for a fresh sequence number and
+// waits up to s.Timeout for the receive loop to match a reply to it.
+func (s *Session) exchange(dst *net.IPAddr, build func(seq uint16, sent time.Time) icmp.Message) (Reply, error) {
+	c := s.conn4
+	if dst.IP.To4() == nil {
+		c = s.conn6
+		if c == nil {
+			return Reply{}, s.err6
+		}
+	} else if c == nil {
+		return Reply{}, s.err4
+	}
+
+	seq := uint16(atomic.AddUint32(&s.seq, 1))
+	p := &probe{dst: dst.IP, reply: make(chan result, 1)}
+
+	s.mu.Lock()
+	s.pending[seq] = p
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.pending, seq)
+		s.mu.Unlock()
+	}()
+
+	p.sent = time.Now()
+	m := build(seq, p.sent)
+	b, error := m.Marshal(nil)
+	if error != nil {
+		return Reply{}, error
+	}
+
+	var to net.Addr = &net.UDPAddr{IP: dst.IP, Zone: dst.Zone}
+	if s.Privileged {
+		to = dst
+	}
+	if _, error := c.WriteTo(b, to); error != nil {
+		return Reply{}, error
+	}
+
+	timer := time.NewTimer(s.Timeout)
+	defer timer.Stop()
+	select {
+	case r := <-p.reply:
+		return r.reply, r.error
+	case <-timer.C:
+		return Reply{Seq: int(seq)}, fmt.Errorf("timeout waiting for reply from %v", dst)
+	}
+}
+
+// payload builds the echo data: the session cookie followed by the send time,
+// and the HMAC when the session is authenticated.
+func (s *Session) payload(seq uint16, sent time.Time) []byte {
+	b := make([]byte, cookieLen+8)
+	copy(b, s.Cookie[:])
+	binary.BigEndian.PutUint64(b[cookieLen:], uint64(sent.UnixNano()))
+	if s.AuthKey != nil {
+		b = append(b, s.mac(seq, b[cookieLen:])...)
+	}
+	// pad with the same incrementing pattern iputils uses
+	for i := len(b); i < s.Size; i++ {
+		b = append(b, byte(i))
+	}
+	return b
+}
+
+// mac is the HMAC over the sequence number, the encoded send time and the
+// session ID.
+func (s *Session) mac(seq uint16, timestamp []byte) []byte {
+	h := hmac.New(sha256.New, s.AuthKey)
+	var hdr [4]byte
+	binary.BigEndian.PutUint16(hdr[0:2], seq)
+	binary.BigEndian.PutUint16(hdr[2:4], uint16(s.ID))
+	h.Write(hdr[:])
+	h.Write(timestamp)
+	h.Write(s.Cookie[:])
+	return h.Sum(nil)
+}
+
+// verify checks an authenticated reply, counting it as forged or replayed
+// when it does not hold up.
+func (s *Session) verify(seq uint16, data []byte) bool {
+	if s.AuthKey == nil {
+		return true
+	}
+	if len(data) < cookieLen+8+macLen {
+		atomic.AddUint64(&s.Forged, 1)
+		return false
+	}
+	timestamp := data[cookieLen : cookieLen+8]
+	if !hmac.Equal(data[cookieLen+8:cookieLen+8+macLen], s.mac(seq, timestamp)) {
+		atomic.AddUint64(&s.Forged, 1)
+		return false
+	}
+	sent := int64(binary.BigEndian.Uint64(timestamp))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if p := s.pending[seq]; p != nil && p.sent.UnixNano() == sent {
+		return true
+	}
+	if s.answered[seq] == sent {
+		atomic.AddUint64(&s.Replayed, 1)
+	}
+	return false
+}
+
+// receive reads replies from c until it is closed, handing each one that
+// belongs to this session to the probe waiting for it.
+func (s *Session) receive(c net.PacketConn, proto int) {
+	read := readWithTTL(c, proto)
+	buf := make([]byte, 65536)
+	for {
+		n, ttl, peer, error := read(buf)
+		if error != nil {
+			return
+		}
+		now := time.Now()
+
+		rm, error := icmp.ParseMessage(proto, buf[:n])
+		if error != nil {
+			continue
+		}
+
+		switch body := rm.Body.(type) {
+		case *icmp.Echo:
+			if rm.Type != ipv4.ICMPTypeEchoReply && rm.Type != ipv6.ICMPTypeEchoReply {
+				continue
+			}
+			// unprivileged sockets have the kernel rewrite the ID, and only
+			// deliver our own replies, so the ID only means something on raw sockets
+			if s.Privileged && body.ID != s.ID {
+				continue
+			}
+			if len(body.Data) < cookieLen+8 || !bytes.Equal(body.Data[:cookieLen], s.Cookie[:]) {
+				continue
+			}
+			if !s.verify(uint16(body.Seq), body.Data) {
+				continue
+			}
+			if p := s.claim(uint16(body.Seq), peer); p != nil {
+				p.reply <- result{reply: Reply{Seq: body.Seq, RTT: now.Sub(p.sent), Size: n, TTL: ttl}}
+			}
+		case *icmp.RawBody:
+			// timestamp replies carry no payload to check, only the ID
+			if rm.Type != ipv4.ICMPTypeTimestampReply || len(body.Data) < 4 {
+				continue
+			}
+			if int(binary.BigEndian.Uint16(body.Data[0:2])) != s.ID {
+				continue
+			}
+			seq := binary.BigEndian.Uint16(body.Data[2:4])
+			if p := s.claim(seq, peer); p != nil {
+				p.reply <- result{reply: Reply{Seq: int(seq), RTT: now.Sub(p.sent), Size: n, TTL: ttl}}
+			}
+		case *icmp.DstUnreach:
+			mtu := 0
+			if proto == ProtocolICMP && rm.Code == 4 && n >= 8 {
+				// "fragmentation needed" carries the next-hop MTU in
+				// the otherwise unused second half of the header
+				mtu = int(binary.BigEndian.Uint16(buf[6:8]))
+			}
+			s.deliverError(rm, body.Data, proto, peer, now, mtu)
+		case *icmp.PacketTooBig:
+			s.deliverError(rm, body.Data, proto, peer, now, body.MTU)
+		case *icmp.TimeExceeded:
+			s.deliverError(rm, body.Data, proto, peer, now, 0)
+		}
+	}
+}
+
+// readWithTTL returns a read function for c that also reports the TTL (or
+// hop limit) of each packet, or -1 where the platform can't tell.
+func readWithTTL(c net.PacketConn, proto int) func([]byte) (int, int, net.Addr, error) {
+	if p := ipv4Conn(c); proto == ProtocolICMP && p != nil && p.SetControlMessage(ipv4.FlagTTL, true) == nil {
+		return func(b []byte) (int, int, net.Addr, error) {
+			n, cm, peer, error := p.ReadFrom(b)
+			if cm == nil {
+				return n, -1, peer, error
+			}
+			return n, cm.TTL, peer, error
+		}
+	}
+	if p := ipv6Conn(c); proto == ProtocolIPv6ICMP && p != nil && p.SetControlMessage(ipv6.FlagHopLimit, true) == nil {
+		return func(b []byte) (int, int, net.Addr, error) {
+			n, cm, peer, error := p.ReadFrom(b)
+			if cm == nil {
+				return n, -1, peer, error
+			}
+			return n, cm.HopLimit, peer, error
+		}
+	}
+	return func(b []byte) (int, int, net.Addr, error) {
+		n, peer, error := c.ReadFrom(b)
+		return n, -1, peer, error
+	}
+}
+
+// deliverError matches an ICMP error to the probe that caused it, using the
+// IP header and the start of the probe quoted back in it. The quoted
+// destination must be the probe's, and a quoted echo request must carry the
+// session cookie, and the HMAC when the session is authenticated, so an
+// error can't be forged by anyone who merely guesses the ID and sequence
+// number. Routers that quote less than the cookie are only believed by
+// sessions without an AuthKey.
+func (s *Session) deliverError(rm *icmp.Message, quoted []byte, proto int, peer net.Addr, now time.Time, mtu int) {
+	hlen, dst := ipv6.HeaderLen, net.IP(nil)
+	if proto == ProtocolICMP {
+		if len(quoted) < ipv4.HeaderLen {
+			return
+		}
+		hlen = int(quoted[0]&0x0f) << 2
+		dst = net.IP(quoted[16:20])
+	} else if len(quoted) >= ipv6.HeaderLen {
+		dst = net.IP(quoted[24:40])
+	}
+	if len(quoted) < hlen+8 {
+		return
+	}
+	echo := quoted[hlen:]
+	id := int(binary.BigEndian.Uint16(echo[4:6]))
+	if id != s.ID {
+		return
+	}
+	seq := binary.BigEndian.Uint16(echo[6:8])
+	if echo[0] == byte(ipv4.ICMPTypeEcho) || echo[0] == byte(ipv6.ICMPTypeEchoRequest) {
+		data := echo[8:]
+		switch {
+		case len(data) >= cookieLen && !bytes.Equal(data[:cookieLen], s.Cookie[:]):
+			return
+		case s.AuthKey != nil && (len(data) < cookieLen || !s.verify(seq, data)):
+			return
+		}
+	}
+
+	s.mu.Lock()
+	p := s.pending[seq]
+	if p == nil || !p.dst.Equal(dst) {
+		s.mu.Unlock()
+		return
+	}
+	delete(s.pending, seq)
+	s.mu.Unlock()
+	p.reply <- result{
+		reply: Reply{Seq: int(seq), RTT: now.Sub(p.sent), TTL: -1},
+		error: &ICMPError{Type: rm.Type, Code: rm.Code, From: addrIP(peer), MTU: mtu},
+	}
+}
+
+// claim removes and returns the probe waiting on seq, provided the reply came
+// from the address it was sent to.
+func (s *Session) claim(seq uint16, peer net.Addr) *probe {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p := s.pending[seq]
+	if p == nil || !p.dst.Equal(addrIP(peer)) {
+		return nil
+	}
+	delete(s.pending, seq)
+	s.answered[seq] = p.sent.UnixNano()
+	return p
+}
+
+func addrIP(a net.Addr) net.IP {
+	switch a := a.(type) {
+	case *net.UDPAddr:
+		return a.IP
+	case *net.IPAddr:
+		return a.IP
+	}
+	return nil
+}
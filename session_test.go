@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+)
+
+// TestDeliverError checks which quoted probes an ICMP error is matched to.
+func TestDeliverError(t *testing.T) {
+	dst := net.ParseIP("192.0.2.1")
+	tests := []struct {
+		name    string
+		authKey []byte
+		dst     net.IP
+		data    func(s *Session, seq uint16, sent time.Time) []byte
+		matched bool
+	}{
+		{"quoted probe", nil, dst, (*Session).payload, true},
+		{"authenticated probe", []byte("key"), dst, (*Session).payload, true},
+		{"other destination", nil, net.ParseIP("192.0.2.2"), (*Session).payload, false},
+		{
+			"other cookie", nil, dst,
+			func(s *Session, seq uint16, sent time.Time) []byte {
+				b := s.payload(seq, sent)
+				b[0] ^= 0xff
+				return b
+			},
+			false,
+		},
+		{
+			"forged HMAC", []byte("key"), dst,
+			func(s *Session, seq uint16, sent time.Time) []byte {
+				b := s.payload(seq, sent)
+				b[cookieLen+8] ^= 0xff
+				return b
+			},
+			false,
+		},
+		{
+			"other send time", []byte("key"), dst,
+			func(s *Session, seq uint16, sent time.Time) []byte { return s.payload(seq, sent.Add(time.Second)) },
+			false,
+		},
+		{
+			"quote without payload", nil, dst,
+			func(s *Session, seq uint16, sent time.Time) []byte { return nil },
+			true,
+		},
+		{
+			"quote without payload, authenticated", []byte("key"), dst,
+			func(s *Session, seq uint16, sent time.Time) []byte { return nil },
+			false,
+		},
+	}
+	for _, test := range tests {
+		s := &Session{ID: 0x1234, Cookie: [cookieLen]byte{1, 2, 3, 4, 5, 6, 7, 8}, AuthKey: test.authKey, Size: 56,
+			pending: make(map[uint16]*probe), answered: make(map[uint16]int64)}
+		p := &probe{dst: dst, sent: time.Now(), reply: make(chan result, 1)}
+		s.pending[7] = p
+
+		echo, error := (&icmp.Message{Type: ipv4.ICMPTypeEcho, Body: &icmp.Echo{ID: s.ID, Seq: 7, Data: test.data(s, 7, p.sent)}}).Marshal(nil)
+		if error != nil {
+			t.Fatal(error)
+		}
+		header := make([]byte, ipv4.HeaderLen)
+		header[0] = 0x45
+		copy(header[16:20], test.dst.To4())
+		rm := &icmp.Message{Type: ipv4.ICMPTypeDestinationUnreachable, Code: 1}
+		s.deliverError(rm, append(header, echo...), ProtocolICMP, &net.IPAddr{IP: net.ParseIP("198.51.100.1")}, time.Now(), 0)
+
+		select {
+		case r := <-p.reply:
+			if !test.matched {
+				t.Errorf("%s: matched, with %v", test.name, r.error)
+			}
+		default:
+			if test.matched {
+				t.Errorf("%s: not matched", test.name)
+			}
+		}
+	}
+}
@@ -0,0 +1,446 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// shellCommand runs an interactive shell around a long-lived session: hosts
+// can be pinged and traced one after another, and targets added to a set
+// that is monitored in the background, without restarting the pinger.
+func shellCommand(args []string) error {
+	flags := flag.NewFlagSet("shell", flag.ExitOnError)
+	privileged := flags.Bool("privileged", false, "use raw sockets (needs root or CAP_NET_RAW); trace needs them")
+	interval := flags.Duration("i", 2*time.Second, "time between rounds of probes to the monitored targets")
+	historyFile := flags.String("history", defaultHistoryFile(), "keep the command history in this file (empty for none)")
+	flags.Usage = func() {
+		fmt.Println("Usage: ping shell [-privileged] [-i interval] [-history file] [target[,key=value...] ...]")
+	}
+	flags.Parse(args)
+
+	session, error := NewSession(*privileged)
+	if error != nil {
+		return error
+	}
+	defer session.Close()
+
+	sh := &shell{
+		privileged: *privileged,
+		session:    session,
+		targets:    NewTargetSet(),
+		out:        os.Stdout,
+		interval:   *interval,
+		wake:       make(chan struct{}, 1),
+		interrupt:  make(chan os.Signal, 1),
+	}
+	for _, arg := range flags.Args() {
+		if error := sh.addTarget(arg); error != nil {
+			return error
+		}
+	}
+	// Ctrl-C stops the command that is running rather than the shell; at
+	// the prompt the line editor sees it as a key instead
+	signal.Notify(sh.interrupt, os.Interrupt)
+	go sh.monitor()
+
+	editor := newLineEditor(*historyFile, sh.complete)
+	if editor.terminal {
+		fmt.Fprintln(sh.out, `Type "help" for the commands, Tab to complete, Ctrl-D to quit.`)
+	}
+	for {
+		line, error := editor.readLine("ping> ")
+		if error == errInterrupted {
+			continue
+		}
+		if error == io.EOF {
+			return nil
+		}
+		if error != nil {
+			return error
+		}
+		words := strings.Fields(line)
+		if len(words) == 0 {
+			continue
+		}
+		if words[0] == "quit" || words[0] == "exit" {
+			return nil
+		}
+		// a stray Ctrl-C from before must not stop the next command
+		select {
+		case <-sh.interrupt:
+		default:
+		}
+		if error := sh.run(words); error != nil {
+			fmt.Fprintf(sh.out, "%s: %v\n", words[0], error)
+		}
+	}
+}
+
+func defaultHistoryFile() string {
+	home, error := os.UserHomeDir()
+	if error != nil {
+		return ""
+	}
+	return filepath.Join(home, ".ping_history")
+}
+
+// shell is the engine behind the interactive shell. The monitored targets
+// are probed in rounds in the background, like the targets of the main
+// command; ping and trace run in the foreground.
+type shell struct {
+	privileged bool
+	session    *Session
+	targets    *TargetSet
+	out        io.Writer
+
+	mu       sync.Mutex
+	interval time.Duration
+	hosts    []string // pinged or traced before, for completion
+
+	wake      chan struct{} // cuts the wait for the next round short
+	interrupt chan os.Signal
+}
+
+// shellCommands are the shell's commands, in the order help lists them.
+var shellCommands = []struct {
+	name, args, help string
+	run              func(sh *shell, args []string) error
+}{
+	{"ping", "<host> [count]", "send count echo requests (default 4), one a second", (*shell).ping},
+	{"trace", "<host> [max-hops]", "trace the route to host (needs -privileged)", (*shell).trace},
+	{"add", "target <host[,key=value...]>", "monitor host in the background", (*shell).add},
+	{"remove", "target <host>", "stop monitoring host", (*shell).remove},
+	{"stats", "[host]", "show the statistics of the monitored targets", (*shell).stats},
+	{"reset", "[host]", "clear the statistics of host, or of every target", (*shell).reset},
+	{"set", "interval <duration>", "change the time between rounds of probes to the monitored targets", (*shell).set},
+	{"help", "", "list the commands", nil},
+	{"quit", "", "leave the shell (or Ctrl-D)", nil},
+}
+
+func (sh *shell) run(words []string) error {
+	if words[0] == "help" {
+		return sh.help()
+	}
+	for _, c := range shellCommands {
+		if c.name == words[0] && c.run != nil {
+			return c.run(sh, words[1:])
+		}
+	}
+	return fmt.Errorf("unknown command, try help")
+}
+
+// monitor probes the monitored targets in rounds until the shell exits.
+func (sh *shell) monitor() {
+	for {
+		var wg sync.WaitGroup
+		for _, target := range sh.targets.List() {
+			wg.Add(1)
+			go func(target *Target) {
+				defer wg.Done()
+				_, rtt, error := sh.session.Ping(target.Address)
+				target.Stats.Record(rtt, error)
+			}(target)
+		}
+		wg.Wait()
+		sh.targets.MarkRound()
+
+		sh.mu.Lock()
+		interval := sh.interval
+		sh.mu.Unlock()
+		select {
+		case <-time.After(interval):
+		case <-sh.wake:
+		}
+	}
+}
+
+// interrupted reports whether the user has pressed Ctrl-C since the command
+// started.
+func (sh *shell) interrupted() bool {
+	select {
+	case <-sh.interrupt:
+		return true
+	default:
+		return false
+	}
+}
+
+// sleep waits for d, or returns false early when the user presses Ctrl-C.
+func (sh *shell) sleep(d time.Duration) bool {
+	select {
+	case <-time.After(d):
+		return true
+	case <-sh.interrupt:
+		return false
+	}
+}
+
+func (sh *shell) ping(args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return fmt.Errorf("usage: ping <host> [count]")
+	}
+	count := 4
+	if len(args) == 2 {
+		n, error := strconv.Atoi(args[1])
+		if error != nil || n < 1 {
+			return fmt.Errorf("%q: count must be a positive number", args[1])
+		}
+		count = n
+	}
+	dst, error := net.ResolveIPAddr("ip", args[0])
+	if error != nil {
+		return error
+	}
+	sh.remember(args[0])
+
+	var stats Stats
+	for seq := 1; seq <= count; seq++ {
+		start := time.Now()
+		reply, error := sh.session.Probe(dst)
+		stats.Record(reply.RTT, error)
+		if error != nil {
+			fmt.Fprintf(sh.out, "no reply from %s: seq=%d (%v)\n", dst, seq, error)
+		} else {
+			ttl := ""
+			if reply.TTL >= 0 {
+				ttl = fmt.Sprintf(" ttl=%d", reply.TTL)
+			}
+			fmt.Fprintf(sh.out, "%d bytes from %s: seq=%d%s time=%.3f ms\n", reply.Size, dst, seq, ttl, milliseconds(reply.RTT))
+		}
+		if seq < count && !sh.sleep(time.Second-time.Since(start)) {
+			break
+		}
+	}
+	s := stats.Snapshot()
+	fmt.Fprintf(sh.out, "%d sent, %d received, %.1f%% loss", s.Sent, s.Received, s.Loss)
+	if s.Received > 0 {
+		fmt.Fprintf(sh.out, ", rtt min/avg/max/mdev = %.3f/%.3f/%.3f/%.3f ms", milliseconds(s.MinRTT),
+			milliseconds(s.AvgRTT), milliseconds(s.MaxRTT), milliseconds(s.MdevRTT))
+	}
+	fmt.Fprintln(sh.out)
+	return nil
+}
+
+func (sh *shell) trace(args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return fmt.Errorf("usage: trace <host> [max-hops]")
+	}
+	if !sh.privileged {
+		return fmt.Errorf("traceroute needs -privileged")
+	}
+	maxHops := 30
+	if len(args) == 2 {
+		n, error := strconv.Atoi(args[1])
+		if error != nil || n < 1 || n > 255 {
+			return fmt.Errorf("%q: max-hops must be between 1 and 255", args[1])
+		}
+		maxHops = n
+	}
+	dst, error := net.ResolveIPAddr("ip", args[0])
+	if error != nil {
+		return error
+	}
+	sh.remember(args[0])
+
+	// the session's TTL changes hop by hop, so it can't be the shared one
+	session, error := NewSession(true)
+	if error != nil {
+		return error
+	}
+	defer session.Close()
+	session.Timeout = sh.session.Timeout
+
+	fmt.Fprintf(sh.out, "traceroute to %s (%s), %d hops max\n", args[0], dst, maxHops)
+	hops, error := traceroute(session, dst, maxHops, 3, sh.interrupted)
+	for _, hop := range hops {
+		fmt.Fprintf(sh.out, "  %s\n", hop)
+	}
+	return error
+}
+
+func (sh *shell) add(args []string) error {
+	if len(args) != 2 || args[0] != "target" {
+		return fmt.Errorf("usage: add target <host[,key=value...]>")
+	}
+	if error := sh.addTarget(args[1]); error != nil {
+		return error
+	}
+	select {
+	case sh.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// addTarget adds a target to those monitored. Each one is a source of its
+// own, so removing one leaves the others be.
+func (sh *shell) addTarget(arg string) error {
+	spec, error := parseTargetSpec(arg)
+	if error != nil {
+		return error
+	}
+	if _, error := net.ResolveIPAddr("ip", spec.Address); error != nil {
+		return error
+	}
+	sh.targets.Sync("shell:"+spec.Address, []TargetSpec{spec})
+	sh.remember(spec.Address)
+	return nil
+}
+
+func (sh *shell) remove(args []string) error {
+	if len(args) != 2 || args[0] != "target" {
+		return fmt.Errorf("usage: remove target <host>")
+	}
+	if !sh.targets.ListedBy(args[1]) {
+		return fmt.Errorf("%s is not monitored", args[1])
+	}
+	sh.targets.Sync("shell:"+args[1], nil)
+	return nil
+}
+
+func (sh *shell) stats(args []string) error {
+	targets, error := sh.selectTargets(args)
+	if error != nil {
+		return error
+	}
+	if len(targets) == 0 {
+		fmt.Fprintln(sh.out, "no targets are monitored, add one with: add target <host>")
+		return nil
+	}
+	fmt.Fprintf(sh.out, "%-30s %6s %6s %7s %9s %9s %9s  %s\n", "TARGET", "SENT", "RECV", "LOSS", "MIN", "AVG", "MAX", "STATUS")
+	for _, t := range targets {
+		s := t.Stats.Snapshot()
+		status := "up"
+		switch {
+		case s.Sent == 0:
+			status = "waiting"
+		case s.Down:
+			status = "down since " + s.DownSince.Format("15:04:05")
+		case s.LastError != "":
+			status = s.LastError
+		}
+		name := t.Address
+		if labels := t.Labels(); len(labels) > 0 {
+			name += " [" + formatLabels(labels) + "]"
+		}
+		fmt.Fprintf(sh.out, "%-30s %6d %6d %6.1f%% %9.3f %9.3f %9.3f  %s\n", name, s.Sent, s.Received, s.Loss,
+			milliseconds(s.MinRTT), milliseconds(s.AvgRTT), milliseconds(s.MaxRTT), status)
+	}
+	return nil
+}
+
+func (sh *shell) reset(args []string) error {
+	targets, error := sh.selectTargets(args)
+	if error != nil {
+		return error
+	}
+	for _, t := range targets {
+		t.Stats.Reset()
+	}
+	return nil
+}
+
+// selectTargets returns the monitored target named in args, or all of them
+// when args is empty.
+func (sh *shell) selectTargets(args []string) ([]*Target, error) {
+	targets := sh.targets.List()
+	switch len(args) {
+	case 0:
+		return targets, nil
+	case 1:
+		for _, t := range targets {
+			if t.Address == args[0] {
+				return []*Target{t}, nil
+			}
+		}
+		return nil, fmt.Errorf("%s is not monitored", args[0])
+	}
+	return nil, fmt.Errorf("too many arguments")
+}
+
+func (sh *shell) set(args []string) error {
+	if len(args) != 2 || args[0] != "interval" {
+		return fmt.Errorf("usage: set interval <duration>")
+	}
+	d, error := time.ParseDuration(args[1])
+	if error != nil || d <= 0 {
+		return fmt.Errorf("%q: not a positive duration such as 500ms or 2s", args[1])
+	}
+	sh.mu.Lock()
+	sh.interval = d
+	sh.mu.Unlock()
+	select {
+	case sh.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (sh *shell) help() error {
+	for _, c := range shellCommands {
+		fmt.Fprintf(sh.out, "  %-38s %s\n", strings.TrimSpace(c.name+" "+c.args), c.help)
+	}
+	return nil
+}
+
+// remember notes a host for completion.
+func (sh *shell) remember(host string) {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	if !contains(sh.hosts, host) {
+		sh.hosts = append(sh.hosts, host)
+	}
+}
+
+// complete offers the commands for the first word, and then what each
+// command takes: hosts seen in this session, monitored targets, or the
+// setting.
+func (sh *shell) complete(words []string, word string) []string {
+	var options []string
+	monitored := func() {
+		for _, t := range sh.targets.List() {
+			options = append(options, t.Address)
+		}
+	}
+	switch {
+	case len(words) == 0:
+		for _, c := range shellCommands {
+			options = append(options, c.name)
+		}
+	case len(words) == 1 && (words[0] == "ping" || words[0] == "trace"):
+		sh.mu.Lock()
+		options = append(options, sh.hosts...)
+		sh.mu.Unlock()
+		monitored()
+	case len(words) == 1 && (words[0] == "add" || words[0] == "remove"):
+		options = []string{"target"}
+	case len(words) == 2 && words[0] == "add" && words[1] == "target":
+		sh.mu.Lock()
+		options = append(options, sh.hosts...)
+		sh.mu.Unlock()
+	case len(words) == 2 && words[0] == "remove" && words[1] == "target",
+		len(words) == 1 && (words[0] == "stats" || words[0] == "reset"):
+		monitored()
+	case len(words) == 1 && words[0] == "set":
+		options = []string{"interval"}
+	}
+
+	var candidates []string
+	for _, o := range options {
+		if strings.HasPrefix(o, word) && !contains(candidates, o) {
+			candidates = append(candidates, o)
+		}
+	}
+	sort.Strings(candidates)
+	return candidates
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestShell() (*shell, *bytes.Buffer) {
+	var out bytes.Buffer
+	return &shell{
+		targets:   NewTargetSet(),
+		out:       &out,
+		interval:  2 * time.Second,
+		wake:      make(chan struct{}, 1),
+		interrupt: make(chan os.Signal, 1),
+	}, &out
+}
+
+func TestShellComplete(t *testing.T) {
+	sh, _ := newTestShell()
+	sh.remember("example.com")
+	sh.remember("192.0.2.9")
+	sh.remember("example.com")
+	if error := sh.addTarget("192.0.2.1,site=ams"); error != nil {
+		t.Fatal(error)
+	}
+
+	tests := []struct {
+		line string // the words before the one being completed
+		word string
+		want []string
+	}{
+		{"", "", []string{"add", "help", "ping", "quit", "remove", "reset", "set", "stats", "trace"}},
+		{"", "re", []string{"remove", "reset"}},
+		{"", "x", nil},
+		{"ping", "", []string{"192.0.2.1", "192.0.2.9", "example.com"}},
+		{"trace", "192.0.2.", []string{"192.0.2.1", "192.0.2.9"}},
+		{"ping example.com", "", nil},
+		{"add", "", []string{"target"}},
+		{"remove", "t", []string{"target"}},
+		{"add target", "", []string{"192.0.2.1", "192.0.2.9", "example.com"}},
+		{"remove target", "", []string{"192.0.2.1"}},
+		{"stats", "", []string{"192.0.2.1"}},
+		{"reset", "192", []string{"192.0.2.1"}},
+		{"set", "", []string{"interval"}},
+		{"set interval", "", nil},
+		{"help", "", nil},
+	}
+	for _, test := range tests {
+		got := sh.complete(strings.Fields(test.line), test.word)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q + %q: got %v, want %v", test.line, test.word, got, test.want)
+		}
+	}
+}
+
+func TestShellRun(t *testing.T) {
+	sh, out := newTestShell()
+	tests := []struct {
+		line  string
+		error string // a part of the error, empty for none
+		out   string // a part of the output
+	}{
+		{line: "help", out: "set interval <duration>"},
+		{line: "frobnicate", error: "unknown command"},
+		{line: "quit", error: "unknown command"},
+		{line: "ping", error: "usage: ping"},
+		{line: "ping 192.0.2.1 0", error: "count must be a positive number"},
+		{line: "ping 192.0.2.1 4 5", error: "usage: ping"},
+		{line: "trace 192.0.2.1", error: "needs -privileged"},
+		{line: "add", error: "usage: add target"},
+		{line: "add host 192.0.2.1", error: "usage: add target"},
+		{line: "add target 192.0.2.1,bad", error: "key=value"},
+		{line: "add target 192.0.2.1,site=ams"},
+		{line: "add target 192.0.2.2"},
+		{line: "stats", out: "192.0.2.1 [site=ams]"},
+		{line: "stats 192.0.2.2", out: "waiting"},
+		{line: "stats 192.0.2.3", error: "not monitored"},
+		{line: "stats 192.0.2.1 192.0.2.2", error: "too many arguments"},
+		{line: "reset"},
+		{line: "reset 192.0.2.9", error: "not monitored"},
+		{line: "remove target 192.0.2.2"},
+		{line: "remove target 192.0.2.2", error: "not monitored"},
+		{line: "remove 192.0.2.1", error: "usage: remove target"},
+		{line: "set interval", error: "usage: set interval"},
+		{line: "set timeout 1s", error: "usage: set interval"},
+		{line: "set interval soon", error: "not a positive duration"},
+		{line: "set interval -1s", error: "not a positive duration"},
+		{line: "set interval 500ms"},
+	}
+	for _, test := range tests {
+		out.Reset()
+		error := sh.run(strings.Fields(test.line))
+		switch {
+		case test.error == "" && error != nil:
+			t.Errorf("%q: %v", test.line, error)
+		case test.error != "" && (error == nil || !strings.Contains(error.Error(), test.error)):
+			t.Errorf("%q: got error %v, want %q", test.line, error, test.error)
+		case !strings.Contains(out.String(), test.out):
+			t.Errorf("%q: output %q lacks %q", test.line, out.String(), test.out)
+		}
+	}
+
+	targets := sh.targets.List()
+	if len(targets) != 1 || targets[0].Address != "192.0.2.1" {
+		t.Errorf("monitoring %v, want 192.0.2.1 only", targets)
+	}
+	if sh.interval != 500*time.Millisecond {
+		t.Errorf("interval %v, want 500ms", sh.interval)
+	}
+	select {
+	case <-sh.wake:
+	default:
+		t.Errorf("changing the interval didn't wake the monitor")
+	}
+}
+
+func TestShellSelectTargets(t *testing.T) {
+	sh, _ := newTestShell()
+	if targets, error := sh.selectTargets(nil); error != nil || len(targets) != 0 {
+		t.Errorf("no targets: got %v, %v", targets, error)
+	}
+	sh.addTarget("192.0.2.1")
+	sh.addTarget("192.0.2.2")
+	tests := []struct {
+		args  []string
+		want  []string
+		error bool
+	}{
+		{args: nil, want: []string{"192.0.2.1", "192.0.2.2"}},
+		{args: []string{"192.0.2.2"}, want: []string{"192.0.2.2"}},
+		{args: []string{"192.0.2.3"}, error: true},
+		{args: []string{"192.0.2.1", "192.0.2.2"}, error: true},
+	}
+	for _, test := range tests {
+		targets, error := sh.selectTargets(test.args)
+		var got []string
+		for _, t := range targets {
+			got = append(got, t.Address)
+		}
+		if (error != nil) != test.error || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%v: got %v, %v, want %v", test.args, got, error, test.want)
+		}
+	}
+}
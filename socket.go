@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// SocketOptions steer which way a session's probes leave the host.
+type SocketOptions struct {
+	Interface string // bind to this egress interface (SO_BINDTODEVICE)
+	Mark      int    // set this firewall mark, for policy routing (SO_MARK)
+
+	// DontFragment sends every probe with DF set and without falling back
+	// to the cached path MTU, so oversized probes fail instead of being
+	// fragmented. Path MTU discovery needs it.
+	DontFragment bool
+}
+
+func (o SocketOptions) String() string {
+	var parts []string
+	if o.Interface != "" {
+		parts = append(parts, o.Interface)
+	}
+	if o.Mark != 0 {
+		parts = append(parts, fmt.Sprintf("mark=%#x", o.Mark))
+	}
+	if o.DontFragment {
+		parts = append(parts, "df")
+	}
+	if len(parts) == 0 {
+		return "default"
+	}
+	return strings.Join(parts, ",")
+}
+
+// parseSocketOptions parses a path written as "eth0", "mark=0x64" or
+// "eth0,mark=100".
+func parseSocketOptions(s string) (SocketOptions, error) {
+	var o SocketOptions
+	for _, field := range strings.Split(s, ",") {
+		if strings.HasPrefix(field, "mark=") {
+			mark, error := strconv.ParseUint(strings.TrimPrefix(field, "mark="), 0, 32)
+			if error != nil {
+				return o, fmt.Errorf("%q: bad firewall mark: %v", s, error)
+			}
+			o.Mark = int(mark)
+		} else if field != "" {
+			if o.Interface != "" {
+				return o, fmt.Errorf("%q: more than one interface", s)
+			}
+			o.Interface = field
+		}
+	}
+	if o == (SocketOptions{}) {
+		return o, fmt.Errorf("%q: neither an interface nor a mark", s)
+	}
+	return o, nil
+}
+
+// listenICMP opens an ICMP socket like icmp.ListenPacket, applying opts.
+func listenICMP(network, address string, opts SocketOptions) (net.PacketConn, error) {
+	if opts == (SocketOptions{}) {
+		c, error := icmp.ListenPacket(network, address)
+		if error != nil {
+			return nil, error
+		}
+		return c, nil
+	}
+	return listenICMPWithOptions(network, address, opts)
+}
+
+// ipv4Conn gives access to the IPv4 socket options of c, such as the TTL.
+func ipv4Conn(c net.PacketConn) *ipv4.PacketConn {
+	if c, ok := c.(*icmp.PacketConn); ok {
+		return c.IPv4PacketConn()
+	}
+	return ipv4.NewPacketConn(c)
+}
+
+// ipv6Conn gives access to the IPv6 socket options of c, such as the hop
+// limit.
+func ipv6Conn(c net.PacketConn) *ipv6.PacketConn {
+	if c, ok := c.(*icmp.PacketConn); ok {
+		return c.IPv6PacketConn()
+	}
+	return ipv6.NewPacketConn(c)
+}
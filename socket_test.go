@@ -0,0 +1,56 @@
+package main
+
+import "testing"
+
+func TestParseSocketOptions(t *testing.T) {
+	tests := []struct {
+		in    string
+		want  SocketOptions
+		error bool
+	}{
+		{in: "eth0", want: SocketOptions{Interface: "eth0"}},
+		{in: "mark=100", want: SocketOptions{Mark: 100}},
+		{in: "mark=0x64", want: SocketOptions{Mark: 0x64}},
+		{in: "mark=0xffffffff", want: SocketOptions{Mark: 0xffffffff}},
+		{in: "eth0,mark=100", want: SocketOptions{Interface: "eth0", Mark: 100}},
+		{in: "mark=100,eth0", want: SocketOptions{Interface: "eth0", Mark: 100}},
+		{in: "wg0,", want: SocketOptions{Interface: "wg0"}},
+		{in: "", error: true},
+		{in: ",", error: true},
+		{in: "mark=0", error: true},
+		{in: "mark=", error: true},
+		{in: "mark=fast", error: true},
+		{in: "mark=-1", error: true},
+		{in: "mark=0x100000000", error: true},
+		{in: "eth0,eth1", error: true},
+	}
+	for _, test := range tests {
+		got, error := parseSocketOptions(test.in)
+		if test.error {
+			if error == nil {
+				t.Errorf("%q: got %+v, want an error", test.in, got)
+			}
+			continue
+		}
+		if error != nil || got != test.want {
+			t.Errorf("%q: got %+v, %v, want %+v", test.in, got, error, test.want)
+		}
+	}
+}
+
+func TestSocketOptionsString(t *testing.T) {
+	tests := []struct {
+		o    SocketOptions
+		want string
+	}{
+		{SocketOptions{}, "default"},
+		{SocketOptions{Interface: "eth0"}, "eth0"},
+		{SocketOptions{Mark: 100}, "mark=0x64"},
+		{SocketOptions{Interface: "eth0", Mark: 100, DontFragment: true}, "eth0,mark=0x64,df"},
+	}
+	for _, test := range tests {
+		if got := test.o.String(); got != test.want {
+			t.Errorf("%+v: got %q, want %q", test.o, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// stateInterval is how often the state file is rewritten while running, on
+// top of the final save at shutdown.
+const stateInterval = time.Minute
+
+// stateFile is the on-disk form of the statistics, keyed by target address.
+type stateFile struct {
+	Saved   time.Time               `json:"saved"`
+	Targets map[string]*statsRecord `json:"targets"`
+}
+
+// statsRecord holds everything a Stats accumulates, so a restarted daemon
+// carries on with the same cumulative loss and availability figures.
+type statsRecord struct {
+	Sent        int           `json:"sent"`
+	Received    int           `json:"received"`
+	MinRTT      time.Duration `json:"min_rtt_ns"`
+	MaxRTT      time.Duration `json:"max_rtt_ns"`
+	TotalRTT    time.Duration `json:"total_rtt_ns"`
+	SumSquares  float64       `json:"sum_squares"`
+	LastRTT     time.Duration `json:"last_rtt_ns"`
+	LastProbe   time.Time     `json:"last_probe"`
+	LastReply   time.Time     `json:"last_reply"`
+	Histogram   []int         `json:"histogram"`
+	FailStreak  int           `json:"fail_streak"`
+	OutageStart time.Time     `json:"outage_start"`
+	OutageTime  time.Duration `json:"outage_ns,omitempty"`
+	Outages     int           `json:"outages"`
+	Downtime    time.Duration `json:"downtime_ns"`
+	Monitored   time.Duration `json:"monitored_ns"`
+}
+
+func (s *Stats) record() *statsRecord {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return &statsRecord{
+		Sent: s.sent, Received: s.received,
+		MinRTT: s.minRTT, MaxRTT: s.maxRTT, TotalRTT: s.totalRTT, LastRTT: s.lastRTT,
+		SumSquares: s.sumSquares,
+		LastProbe:  s.lastProbe,
+		LastReply:  s.lastReply,
+		Histogram:  append([]int(nil), s.histogram...),
+		FailStreak: s.failStreak, OutageStart: s.outageStart, OutageTime: s.outageTime,
+		Outages: s.outages, Downtime: s.downtime, Monitored: s.monitored,
+	}
+}
+
+func (s *Stats) restore(r *statsRecord) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sent, s.received = r.Sent, r.Received
+	s.minRTT, s.maxRTT, s.totalRTT, s.lastRTT = r.MinRTT, r.MaxRTT, r.TotalRTT, r.LastRTT
+	s.sumSquares = r.SumSquares
+	s.lastProbe, s.lastReply = r.LastProbe, r.LastReply
+	s.histogram = nil
+	if len(r.Histogram) == len(histogramBounds)+1 {
+		s.histogram = r.Histogram
+	}
+	s.failStreak, s.outageStart, s.outageTime = r.FailStreak, r.OutageStart, r.OutageTime
+	if !r.OutageStart.IsZero() && r.OutageTime == 0 && r.LastProbe.After(r.OutageStart) {
+		// files from before outage_ns: the outage ran until the last probe
+		s.outageTime = r.LastProbe.Sub(r.OutageStart)
+	}
+	s.outages, s.downtime, s.monitored = r.Outages, r.Downtime, r.Monitored
+}
+
+// loadState restores the statistics of the targets in set from path.
+// Targets that aren't in the set yet get theirs when they are added. A
+// missing file is not an error, it just means there is nothing to carry over.
+func loadState(path string, set *TargetSet) error {
+	b, error := os.ReadFile(path)
+	if os.IsNotExist(error) {
+		return nil
+	}
+	if error != nil {
+		return error
+	}
+	if len(b) == 0 {
+		return nil // created by openState, never saved
+	}
+	var state stateFile
+	if error := json.Unmarshal(b, &state); error != nil {
+		return error
+	}
+	set.mu.Lock()
+	defer set.mu.Unlock()
+	for address, r := range state.Targets {
+		if t := set.targets[address]; t != nil {
+			t.Stats.restore(r)
+		} else {
+			set.saved[address] = r
+		}
+	}
+	return nil
+}
+
+// openState opens the state file for saveState, creating it if need be. It
+// is called while the pinger may still be root, so the state can be saved
+// after privileges are dropped even where the user they are dropped to
+// can't write.
+func openState(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+}
+
+// saveState writes the statistics of the targets in set to path, along with
+// any restored ones whose target hasn't come back yet. The file is replaced
+// atomically, so a crash mid-write leaves the previous state intact. When
+// the directory isn't writable, as after dropping privileges, the file f
+// opened by openState is rewritten in place instead.
+func saveState(path string, f *os.File, set *TargetSet) error {
+	state := stateFile{Saved: time.Now(), Targets: make(map[string]*statsRecord)}
+	set.mu.Lock()
+	for address, r := range set.saved {
+		state.Targets[address] = r
+	}
+	set.mu.Unlock()
+	for _, t := range set.List() {
+		state.Targets[t.Address] = t.Stats.record()
+	}
+	b, error := json.MarshalIndent(state, "", "  ")
+	if error != nil {
+		return error
+	}
+
+	tmp, error := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if os.IsPermission(error) && f != nil {
+		if _, error := f.WriteAt(b, 0); error != nil {
+			return error
+		}
+		if error := f.Truncate(int64(len(b))); error != nil {
+			return error
+		}
+		return f.Sync()
+	}
+	if error != nil {
+		return error
+	}
+	defer os.Remove(tmp.Name())
+	if _, error := tmp.Write(b); error != nil {
+		tmp.Close()
+		return error
+	}
+	if error := tmp.Close(); error != nil {
+		return error
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestRestartDuringOutage checks that the time the pinger was stopped in the
+// middle of an outage counts neither as monitored nor as down.
+func TestRestartDuringOutage(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name   string
+		record statsRecord
+		// the downtime after the target recovers on the first probe
+		want time.Duration
+	}{
+		{
+			name: "stopped an hour",
+			record: statsRecord{
+				Sent: 100, Received: 90, FailStreak: 10, Outages: 1,
+				LastProbe: now.Add(-time.Hour), OutageStart: now.Add(-time.Hour - 10*time.Second), OutageTime: 10 * time.Second,
+				Monitored: time.Hour,
+			},
+			want: 10 * time.Second,
+		},
+		{
+			name: "file without outage_ns",
+			record: statsRecord{
+				Sent: 100, Received: 90, FailStreak: 10, Outages: 1,
+				LastProbe: now.Add(-time.Hour), OutageStart: now.Add(-time.Hour - 10*time.Second),
+				Monitored: time.Hour,
+			},
+			want: 10 * time.Second,
+		},
+		{
+			name: "earlier outages kept",
+			record: statsRecord{
+				Sent: 100, Received: 90, FailStreak: 10, Outages: 2,
+				LastProbe: now.Add(-time.Hour), OutageStart: now.Add(-time.Hour - 10*time.Second), OutageTime: 10 * time.Second,
+				Downtime: time.Minute, Monitored: time.Hour,
+			},
+			want: time.Minute + 10*time.Second,
+		},
+	}
+	for _, test := range tests {
+		path := filepath.Join(t.TempDir(), "state.json")
+		before := NewTargetSet()
+		before.Sync("test", []TargetSpec{{Address: "192.0.2.1"}})
+		before.List()[0].Stats.restore(&test.record)
+		if error := saveState(path, nil, before); error != nil {
+			t.Fatal(error)
+		}
+
+		after := NewTargetSet()
+		if error := loadState(path, after); error != nil {
+			t.Fatal(error)
+		}
+		after.Sync("test", []TargetSpec{{Address: "192.0.2.1"}})
+		stats := &after.List()[0].Stats
+		if s := stats.Snapshot(); !s.Down || s.Downtime != test.want {
+			t.Errorf("%s: restored down %v with %v downtime, want down with %v", test.name, s.Down, s.Downtime, test.want)
+		}
+		stats.Record(time.Millisecond, nil)
+		s := stats.Snapshot()
+		if s.Down || s.Downtime != test.want {
+			t.Errorf("%s: recovered down %v with %v downtime, want %v", test.name, s.Down, s.Downtime, test.want)
+		}
+		if want := (1 - float64(test.want)/float64(time.Hour)) * 100; s.Availability < want-0.001 || s.Availability > want+0.001 {
+			t.Errorf("%s: availability %.3f%%, want %.3f%%", test.name, s.Availability, want)
+		}
+	}
+}
+
+func TestOutageDowntime(t *testing.T) {
+	var s Stats
+	timeout := errors.New("timeout")
+	for i := 0; i < outageThreshold; i++ {
+		s.Record(0, timeout)
+	}
+	if snap := s.Snapshot(); !snap.Down || snap.Downtime != 0 {
+		t.Errorf("at the start of an outage: down %v, downtime %v", snap.Down, snap.Downtime)
+	}
+	time.Sleep(20 * time.Millisecond)
+	s.Record(0, timeout)
+	down := s.Snapshot().Downtime
+	if down < 20*time.Millisecond {
+		t.Errorf("downtime %v during the outage, want at least 20ms", down)
+	}
+	s.Record(time.Millisecond, nil)
+	if snap := s.Snapshot(); snap.Down || snap.Downtime < down || snap.Outages != 1 {
+		t.Errorf("after the outage: down %v, downtime %v, %d outages", snap.Down, snap.Downtime, snap.Outages)
+	}
+}
+
+func TestLoadStateEmpty(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	set := NewTargetSet()
+	if error := loadState(path, set); error != nil {
+		t.Errorf("missing file: %v", error)
+	}
+	if error := os.WriteFile(path, nil, 0600); error != nil {
+		t.Fatal(error)
+	}
+	if error := loadState(path, set); error != nil {
+		t.Errorf("empty file: %v", error)
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// outageThreshold is the number of consecutive lost probes after which a
+// target counts as down.
+const outageThreshold = 3
+
+// maxProbeGap bounds the time between two probes that still counts as
+// monitored, so the time the daemon was not running is left out of the
+// availability figure.
+const maxProbeGap = time.Minute
+
+// recentProbes is the number of latest probes the recent loss and RTT
+// figures cover, which tell how a target is doing now rather than overall.
+const recentProbes = 10
+
+// histogramBounds are the upper bounds of the RTT histogram buckets. A final
+// bucket catches everything slower.
+var histogramBounds = []time.Duration{
+	1 * time.Millisecond, 2 * time.Millisecond, 5 * time.Millisecond,
+	10 * time.Millisecond, 20 * time.Millisecond, 50 * time.Millisecond,
+	100 * time.Millisecond, 200 * time.Millisecond, 500 * time.Millisecond,
+	1 * time.Second,
+}
+
+// Stats accumulates the results of the probes sent to one target. It is
+// shared between the probe loop and the HTTP API, so all access goes through
+// its methods.
+type Stats struct {
+	mu sync.Mutex
+
+	sent, received int
+	minRTT, maxRTT time.Duration
+	totalRTT       time.Duration
+	sumSquares     float64 // of the RTTs in seconds, for the deviation
+	lastRTT        time.Duration
+	lastProbe      time.Time
+	lastReply      time.Time
+	lastError      string
+	histogram      []int
+	recent         []time.Duration // the latest probes, -1 for lost ones
+
+	failStreak  int
+	outageStart time.Time
+	outageTime  time.Duration // monitored time of the outage in progress
+	outages     int
+	downtime    time.Duration // of the outages that ended
+	monitored   time.Duration
+}
+
+// StatsSnapshot is a consistent copy of a Stats, as served by the HTTP API.
+type StatsSnapshot struct {
+	Sent         int           `json:"sent"`
+	Received     int           `json:"received"`
+	Lost         int           `json:"lost"`
+	Loss         float64       `json:"loss_percent"`
+	MinRTT       time.Duration `json:"min_rtt_ns"`
+	AvgRTT       time.Duration `json:"avg_rtt_ns"`
+	MaxRTT       time.Duration `json:"max_rtt_ns"`
+	MdevRTT      time.Duration `json:"mdev_rtt_ns"`
+	LastRTT      time.Duration `json:"last_rtt_ns"`
+	LastProbe    time.Time     `json:"last_probe"`
+	LastReply    time.Time     `json:"last_reply"`
+	LastError    string        `json:"last_error,omitempty"`
+	Histogram    []Bucket      `json:"histogram"`
+	Down         bool          `json:"down"`
+	DownSince    *time.Time    `json:"down_since,omitempty"`
+	Outages      int           `json:"outages"`
+	Downtime     time.Duration `json:"downtime_ns"`
+	Availability float64       `json:"availability_percent"`
+	RecentLoss   float64       `json:"recent_loss_percent"`
+	RecentRTT    time.Duration `json:"recent_avg_rtt_ns"`
+}
+
+// Bucket is one RTT histogram bucket. A zero UpperBound is the overflow
+// bucket.
+type Bucket struct {
+	UpperBound time.Duration `json:"le_ns"`
+	Count      int           `json:"count"`
+}
+
+// Record adds the outcome of one probe.
+func (s *Stats) Record(rtt time.Duration, error error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// downtime only grows by the gaps monitored grows by, so the time the
+	// daemon was stopped during an outage doesn't count against the target
+	now := time.Now()
+	if !s.lastProbe.IsZero() {
+		if gap := now.Sub(s.lastProbe); gap < maxProbeGap {
+			s.monitored += gap
+			if !s.outageStart.IsZero() {
+				s.outageTime += gap
+			}
+		}
+	}
+	s.sent++
+	s.lastProbe = now
+	if len(s.recent) == recentProbes {
+		s.recent = s.recent[1:]
+	}
+	if error != nil {
+		s.recent = append(s.recent, -1)
+		s.lastError = error.Error()
+		s.failStreak++
+		if s.failStreak == outageThreshold {
+			s.outageStart = now
+			s.outages++
+		}
+		return
+	}
+
+	if !s.outageStart.IsZero() {
+		s.downtime += s.outageTime
+		s.outageStart, s.outageTime = time.Time{}, 0
+	}
+	s.failStreak = 0
+	s.lastError = ""
+	s.received++
+	s.recent = append(s.recent, rtt)
+	s.lastReply = now
+	s.lastRTT = rtt
+	s.totalRTT += rtt
+	s.sumSquares += rtt.Seconds() * rtt.Seconds()
+	if s.received == 1 || rtt < s.minRTT {
+		s.minRTT = rtt
+	}
+	if rtt > s.maxRTT {
+		s.maxRTT = rtt
+	}
+	if s.histogram == nil {
+		s.histogram = make([]int, len(histogramBounds)+1)
+	}
+	i := 0
+	for i < len(histogramBounds) && rtt > histogramBounds[i] {
+		i++
+	}
+	s.histogram[i]++
+}
+
+// Reset forgets everything recorded so far.
+func (s *Stats) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sent, s.received = 0, 0
+	s.minRTT, s.maxRTT, s.totalRTT, s.sumSquares, s.lastRTT = 0, 0, 0, 0, 0
+	s.lastProbe, s.lastReply, s.lastError = time.Time{}, time.Time{}, ""
+	s.histogram, s.recent = nil, nil
+	s.failStreak, s.outageStart, s.outageTime, s.outages, s.downtime, s.monitored = 0, time.Time{}, 0, 0, 0, 0
+}
+
+// Snapshot returns a copy of the current figures.
+func (s *Stats) Snapshot() StatsSnapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	snap := StatsSnapshot{
+		Sent:      s.sent,
+		Received:  s.received,
+		Lost:      s.sent - s.received,
+		MinRTT:    s.minRTT,
+		MaxRTT:    s.maxRTT,
+		LastRTT:   s.lastRTT,
+		LastProbe: s.lastProbe,
+		LastReply: s.lastReply,
+		LastError: s.lastError,
+		Outages:   s.outages,
+		Downtime:  s.downtime,
+	}
+	if s.sent > 0 {
+		snap.Loss = float64(snap.Lost) / float64(s.sent) * 100
+	}
+	if s.received > 0 {
+		snap.AvgRTT = s.totalRTT / time.Duration(s.received)
+		// the mean deviation as iputils reports it: sqrt(E[rtt²] - E[rtt]²)
+		mean := snap.AvgRTT.Seconds()
+		if v := s.sumSquares/float64(s.received) - mean*mean; v > 0 {
+			snap.MdevRTT = time.Duration(math.Sqrt(v) * float64(time.Second))
+		}
+	}
+	for i := range histogramBounds {
+		snap.Histogram = append(snap.Histogram, Bucket{UpperBound: histogramBounds[i], Count: s.bucket(i)})
+	}
+	snap.Histogram = append(snap.Histogram, Bucket{Count: s.bucket(len(histogramBounds))})
+
+	if !s.outageStart.IsZero() {
+		since := s.outageStart
+		snap.Down = true
+		snap.DownSince = &since
+		snap.Downtime += s.outageTime
+	}
+	if len(s.recent) > 0 {
+		var total time.Duration
+		lost := 0
+		for _, rtt := range s.recent {
+			if rtt < 0 {
+				lost++
+			} else {
+				total += rtt
+			}
+		}
+		snap.RecentLoss = float64(lost) / float64(len(s.recent)) * 100
+		if lost < len(s.recent) {
+			snap.RecentRTT = total / time.Duration(len(s.recent)-lost)
+		}
+	}
+	snap.Availability = 100
+	if s.monitored > 0 {
+		snap.Availability = (1 - float64(snap.Downtime)/float64(s.monitored)) * 100
+		if snap.Availability < 0 {
+			snap.Availability = 0
+		}
+	}
+	return snap
+}
+
+func (s *Stats) bucket(i int) int {
+	if s.histogram == nil {
+		return 0
+	}
+	return s.histogram[i]
+}
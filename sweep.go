@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Sweep is a stored discovery run: what was swept, when, and which hosts
+// answered.
+type Sweep struct {
+	Time    time.Time `json:"time"`
+	Targets []string  `json:"targets"`
+	// Swept is Targets with host names replaced by the addresses they
+	// resolved to at the time, so diff doesn't depend on today's DNS.
+	Swept []string     `json:"swept,omitempty"`
+	Alive []HostResult `json:"alive"`
+}
+
+// sweepFileLayout names the files saveSweep writes into a directory, so they
+// sort by time. Sweeps started within the same microsecond get the next
+// free name.
+const sweepFileLayout = "sweep-20060102T150405.000000Z.json"
+
+// saveSweep stores the alive hosts of a sweep. If path is a directory the
+// sweep gets a new time-stamped file in it, otherwise it is written to path.
+func saveSweep(path string, targets, swept []string, results []HostResult) (string, error) {
+	sweep := Sweep{Time: time.Now().UTC(), Targets: targets, Swept: swept}
+	for _, r := range results {
+		if r.Alive {
+			sweep.Alive = append(sweep.Alive, r)
+		}
+	}
+	b, error := json.MarshalIndent(sweep, "", "  ")
+	if error != nil {
+		return "", error
+	}
+	if info, error := os.Stat(path); error != nil || !info.IsDir() {
+		return path, os.WriteFile(path, b, 0644)
+	}
+	for t := sweep.Time; ; t = t.Add(time.Microsecond) {
+		name := filepath.Join(path, t.Format(sweepFileLayout))
+		f, error := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if os.IsExist(error) {
+			continue
+		}
+		if error != nil {
+			return "", error
+		}
+		_, error = f.Write(b)
+		if closeError := f.Close(); error == nil {
+			error = closeError
+		}
+		return name, error
+	}
+}
+
+func loadSweep(path string) (*Sweep, error) {
+	b, error := os.ReadFile(path)
+	if error != nil {
+		return nil, error
+	}
+	var sweep Sweep
+	if error := json.Unmarshal(b, &sweep); error != nil {
+		return nil, fmt.Errorf("%s: %v", path, error)
+	}
+	return &sweep, nil
+}
+
+// SweepEvent is one difference between two sweeps.
+type SweepEvent struct {
+	Type    string `json:"type"` // "new", "gone" or "mac-changed"
+	Address string `json:"address"`
+	MAC     string `json:"mac,omitempty"`
+	OldMAC  string `json:"old_mac,omitempty"`
+	Methods string `json:"methods,omitempty"`
+}
+
+// diffSweeps lists the hosts that appeared, disappeared or changed MAC
+// address between old and new, ordered by address. A host is only gone if
+// new swept its address, so sweeping part of a network doesn't report the
+// rest of it as gone.
+func diffSweeps(old, new *Sweep) []SweepEvent {
+	before := make(map[string]HostResult)
+	for _, r := range old.Alive {
+		before[r.Address] = r
+	}
+	after := make(map[string]HostResult)
+	for _, r := range new.Alive {
+		after[r.Address] = r
+	}
+
+	var events []SweepEvent
+	for address, r := range after {
+		was, ok := before[address]
+		switch {
+		case !ok:
+			events = append(events, SweepEvent{Type: "new", Address: address, MAC: r.MAC, Methods: strings.Join(r.Methods, ",")})
+		case was.MAC != "" && r.MAC != "" && was.MAC != r.MAC:
+			events = append(events, SweepEvent{Type: "mac-changed", Address: address, MAC: r.MAC, OldMAC: was.MAC})
+		}
+	}
+	for address, r := range before {
+		if _, ok := after[address]; !ok && sweepCovers(new, net.ParseIP(address)) {
+			events = append(events, SweepEvent{Type: "gone", Address: address, MAC: r.MAC})
+		}
+	}
+	sort.Slice(events, func(i, j int) bool {
+		if c := compareIPs(net.ParseIP(events[i].Address), net.ParseIP(events[j].Address)); c != 0 {
+			return c < 0
+		}
+		return events[i].Type < events[j].Type
+	})
+	return events
+}
+
+// sweepCovers reports whether ip is one of the addresses sweep probed. A
+// sweep without targets, as in files from before they were stored, covers
+// everything. Files from before Swept was stored only cover the ranges and
+// addresses among their targets: what a host name resolves to now may not
+// be what was swept.
+func sweepCovers(sweep *Sweep, ip net.IP) bool {
+	targets := sweep.Swept
+	if targets == nil {
+		targets = sweep.Targets
+	}
+	if len(targets) == 0 || ip == nil {
+		return true
+	}
+	for _, target := range targets {
+		if _, n, error := net.ParseCIDR(target); error == nil {
+			if n.Contains(ip) {
+				return true
+			}
+		} else if target := net.ParseIP(target); target != nil && target.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// compareIPs orders addresses numerically, IPv4 before IPv6.
+func compareIPs(a, b net.IP) int {
+	a, b = normalizeIP(a), normalizeIP(b)
+	if len(a) != len(b) {
+		return len(a) - len(b)
+	}
+	return bytes.Compare(a, b)
+}
+
+// diffCommand compares two stored sweeps, given as files or as a directory
+// of sweeps, in which case its two most recent ones are compared.
+func diffCommand(args []string) error {
+	flags := flag.NewFlagSet("diff", flag.ExitOnError)
+	jsonOutput := flags.Bool("json", false, "print the differences as JSON events, one per line")
+	webhook := flags.String("webhook", "", "POST the differences as a JSON array of events to this URL")
+	flags.Usage = func() {
+		fmt.Println("Usage: ping diff [-json] [-webhook url] <old-sweep> <new-sweep> | <sweep-directory>")
+	}
+	flags.Parse(args)
+
+	var oldPath, newPath string
+	switch flags.NArg() {
+	case 1:
+		matches, error := filepath.Glob(filepath.Join(flags.Arg(0), "sweep-*.json"))
+		if error != nil {
+			return error
+		}
+		if len(matches) < 2 {
+			return fmt.Errorf("%s: need at least two sweeps to compare", flags.Arg(0))
+		}
+		sort.Strings(matches)
+		oldPath, newPath = matches[len(matches)-2], matches[len(matches)-1]
+	case 2:
+		oldPath, newPath = flags.Arg(0), flags.Arg(1)
+	default:
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	old, error := loadSweep(oldPath)
+	if error != nil {
+		return error
+	}
+	new, error := loadSweep(newPath)
+	if error != nil {
+		return error
+	}
+	events := diffSweeps(old, new)
+
+	if *jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		for _, e := range events {
+			enc.Encode(e)
+		}
+	} else {
+		fmt.Printf("Sweep %s (%d alive) -> %s (%d alive)\n",
+			old.Time.Format(time.RFC3339), len(old.Alive), new.Time.Format(time.RFC3339), len(new.Alive))
+		for _, e := range events {
+			switch e.Type {
+			case "new":
+				fmt.Printf("+ %s new%s (%s)\n", e.Address, macSuffix(e.MAC), e.Methods)
+			case "gone":
+				fmt.Printf("- %s gone%s\n", e.Address, macSuffix(e.MAC))
+			case "mac-changed":
+				fmt.Printf("~ %s MAC changed %s -> %s\n", e.Address, e.OldMAC, e.MAC)
+			}
+		}
+		fmt.Printf("%d differences\n", len(events))
+	}
+
+	if *webhook != "" && len(events) > 0 {
+		b, error := json.Marshal(events)
+		if error != nil {
+			return error
+		}
+		resp, error := http.Post(*webhook, "application/json", bytes.NewReader(b))
+		if error != nil {
+			return error
+		}
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			return fmt.Errorf("webhook %s: %s", *webhook, resp.Status)
+		}
+	}
+	return nil
+}
+
+func macSuffix(mac string) string {
+	if mac == "" {
+		return ""
+	}
+	return " [" + mac + "]"
+}
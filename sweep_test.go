@@ -0,0 +1,153 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestDiffSweeps(t *testing.T) {
+	tests := []struct {
+		name     string
+		old, new Sweep
+		want     []SweepEvent
+	}{
+		{
+			name: "no change",
+			old:  Sweep{Targets: []string{"192.0.2.0/24"}, Alive: []HostResult{{Address: "192.0.2.1"}}},
+			new:  Sweep{Targets: []string{"192.0.2.0/24"}, Alive: []HostResult{{Address: "192.0.2.1"}}},
+		},
+		{
+			name: "new, gone and MAC changed",
+			old: Sweep{Targets: []string{"192.0.2.0/24"}, Alive: []HostResult{
+				{Address: "192.0.2.1", MAC: "00:00:5e:00:53:01"},
+				{Address: "192.0.2.2", MAC: "00:00:5e:00:53:02"},
+			}},
+			new: Sweep{Targets: []string{"192.0.2.0/24"}, Alive: []HostResult{
+				{Address: "192.0.2.1", MAC: "00:00:5e:00:53:ff"},
+				{Address: "192.0.2.3", Methods: []string{"echo", "arp"}},
+			}},
+			want: []SweepEvent{
+				{Type: "mac-changed", Address: "192.0.2.1", MAC: "00:00:5e:00:53:ff", OldMAC: "00:00:5e:00:53:01"},
+				{Type: "gone", Address: "192.0.2.2", MAC: "00:00:5e:00:53:02"},
+				{Type: "new", Address: "192.0.2.3", Methods: "echo,arp"},
+			},
+		},
+		{
+			name: "numeric order",
+			old:  Sweep{Targets: []string{"192.0.2.0/24"}},
+			new: Sweep{Targets: []string{"192.0.2.0/24", "2001:db8::/120"}, Alive: []HostResult{
+				{Address: "2001:db8::1"}, {Address: "192.0.2.100"}, {Address: "192.0.2.9"}, {Address: "192.0.2.10"},
+			}},
+			want: []SweepEvent{
+				{Type: "new", Address: "192.0.2.9"},
+				{Type: "new", Address: "192.0.2.10"},
+				{Type: "new", Address: "192.0.2.100"},
+				{Type: "new", Address: "2001:db8::1"},
+			},
+		},
+		{
+			name: "hosts outside the new sweep are not gone",
+			old: Sweep{Targets: []string{"192.0.2.0/24", "198.51.100.7"}, Alive: []HostResult{
+				{Address: "192.0.2.1"}, {Address: "192.0.2.200"}, {Address: "198.51.100.7"},
+			}},
+			new: Sweep{Targets: []string{"192.0.2.0/25"}},
+			want: []SweepEvent{
+				{Type: "gone", Address: "192.0.2.1"},
+			},
+		},
+		{
+			name: "host names cover what they resolved to",
+			old: Sweep{Targets: []string{"printer.example"}, Swept: []string{"192.0.2.7"}, Alive: []HostResult{
+				{Address: "192.0.2.7"},
+			}},
+			new: Sweep{Targets: []string{"printer.example"}, Swept: []string{"192.0.2.8"}, Alive: []HostResult{
+				{Address: "192.0.2.8"},
+			}},
+			want: []SweepEvent{
+				{Type: "new", Address: "192.0.2.8"},
+			},
+		},
+		{
+			name: "host names in files without swept addresses cover nothing",
+			old:  Sweep{Targets: []string{"localhost"}, Alive: []HostResult{{Address: "127.0.0.1"}}},
+			new:  Sweep{Targets: []string{"localhost"}},
+		},
+		{
+			name: "sweeps without targets cover everything",
+			old:  Sweep{Alive: []HostResult{{Address: "192.0.2.1"}}},
+			new:  Sweep{},
+			want: []SweepEvent{
+				{Type: "gone", Address: "192.0.2.1"},
+			},
+		},
+	}
+	for _, test := range tests {
+		if got := diffSweeps(&test.old, &test.new); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestCompareIPs(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int // the sign of the result
+	}{
+		{"192.0.2.9", "192.0.2.10", -1},
+		{"10.0.0.1", "10.0.0.1", 0},
+		{"::ffff:10.0.0.1", "10.0.0.1", 0},
+		{"255.255.255.255", "::1", -1},
+		{"2001:db8::10", "2001:db8::9", 1},
+	}
+	for _, test := range tests {
+		got := compareIPs(net.ParseIP(test.a), net.ParseIP(test.b))
+		if got > 0 {
+			got = 1
+		} else if got < 0 {
+			got = -1
+		}
+		if got != test.want {
+			t.Errorf("compareIPs(%s, %s) = %d, want %d", test.a, test.b, got, test.want)
+		}
+	}
+}
+
+func TestSaveSweep(t *testing.T) {
+	dir := t.TempDir()
+	results := []HostResult{{Address: "192.0.2.1", Alive: true}, {Address: "192.0.2.2"}}
+	var paths []string
+	for i := 0; i < 3; i++ {
+		path, error := saveSweep(dir, []string{"printer.example"}, []string{"192.0.2.1"}, results)
+		if error != nil {
+			t.Fatal(error)
+		}
+		paths = append(paths, path)
+	}
+	matches, error := filepath.Glob(filepath.Join(dir, "sweep-*.json"))
+	if error != nil {
+		t.Fatal(error)
+	}
+	if len(matches) != len(paths) || !sort.StringsAreSorted(paths) {
+		t.Errorf("sweeps in quick succession: saved %v, found %v", paths, matches)
+	}
+
+	sweep, error := loadSweep(paths[0])
+	if error != nil {
+		t.Fatal(error)
+	}
+	if !reflect.DeepEqual(sweep.Swept, []string{"192.0.2.1"}) || len(sweep.Alive) != 1 || sweep.Alive[0].Address != "192.0.2.1" {
+		t.Errorf("loaded %+v", sweep)
+	}
+
+	file := filepath.Join(dir, "latest.json")
+	if path, error := saveSweep(file, nil, nil, results); error != nil || path != file {
+		t.Errorf("saving to a file: got %s, %v", path, error)
+	}
+	if _, error := os.Stat(file); error != nil {
+		t.Error(error)
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Target is one monitored host and the statistics gathered for it.
+type Target struct {
+	Address string
+	Stats   Stats
+
+	mu       sync.Mutex
+	labels   map[string]string
+	resolved net.IP // the IPv4 address isMapped last told about
+	mapped   bool
+}
+
+// Labels returns the target's key/value labels (site, role, owner...). The
+// map must not be modified.
+func (t *Target) Labels() map[string]string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.labels
+}
+
+func (t *Target) setLabels(labels map[string]string) {
+	t.mu.Lock()
+	t.labels = labels
+	t.mu.Unlock()
+}
+
+// TargetSpec is a target as a source lists it: an address and its labels.
+type TargetSpec struct {
+	Address string
+	Labels  map[string]string
+}
+
+// parseTargetSpec parses "host[,key=value...]", the way targets and their
+// labels are written on the command line.
+func parseTargetSpec(s string) (TargetSpec, error) {
+	fields := strings.Split(s, ",")
+	spec := TargetSpec{Address: fields[0]}
+	if spec.Address == "" {
+		return spec, fmt.Errorf("%q: missing address", s)
+	}
+	for _, field := range fields[1:] {
+		if error := addLabel(&spec.Labels, field); error != nil {
+			return spec, error
+		}
+	}
+	return spec, nil
+}
+
+// addLabel parses "key=value" into labels, allocating the map if needed.
+func addLabel(labels *map[string]string, s string) error {
+	i := strings.IndexByte(s, '=')
+	if i <= 0 {
+		return fmt.Errorf("%q: labels are written as key=value", s)
+	}
+	if *labels == nil {
+		*labels = make(map[string]string)
+	}
+	(*labels)[s[:i]] = s[i+1:]
+	return nil
+}
+
+// mergeLabels returns a copy of labels with extra added on top.
+func mergeLabels(labels, extra map[string]string) map[string]string {
+	merged := make(map[string]string, len(labels)+len(extra))
+	for k, v := range labels {
+		merged[k] = v
+	}
+	for k, v := range extra {
+		merged[k] = v
+	}
+	return merged
+}
+
+// formatLabels renders labels as "key=value" pairs sorted by key, the way
+// they appear in log lines.
+func formatLabels(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for k, v := range labels {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, " ")
+}
+
+// TargetSet is the set of monitored targets. Targets come from several
+// sources (the command line, target files, DNS), each of which replaces its
+// own share of the set with Sync. A target stays monitored as long as at
+// least one source still lists it.
+type TargetSet struct {
+	// Labels are added to every target, under the target's own labels.
+	Labels map[string]string
+
+	mu        sync.Mutex
+	targets   map[string]*Target
+	sources   map[string]map[string]TargetSpec
+	saved     map[string]*statsRecord
+	lastRound time.Time
+}
+
+func NewTargetSet() *TargetSet {
+	return &TargetSet{
+		targets: make(map[string]*Target),
+		sources: make(map[string]map[string]TargetSpec),
+		saved:   make(map[string]*statsRecord),
+	}
+}
+
+// Sync makes specs the complete list of targets from source, adding the new
+// ones, dropping those no source lists any more and updating the labels of
+// the rest. It returns the addresses that were added and removed.
+func (ts *TargetSet) Sync(source string, specs []TargetSpec) (added, removed []string) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	listed := make(map[string]TargetSpec, len(specs))
+	for _, spec := range specs {
+		listed[spec.Address] = spec
+	}
+	previous := ts.sources[source]
+	ts.sources[source] = listed
+
+	for a := range listed {
+		t := ts.targets[a]
+		if t == nil {
+			t = &Target{Address: a}
+			if r := ts.saved[a]; r != nil {
+				t.Stats.restore(r)
+				delete(ts.saved, a)
+			}
+			ts.targets[a] = t
+			added = append(added, a)
+		}
+		t.setLabels(ts.labels(a))
+	}
+	for a := range previous {
+		if _, ok := listed[a]; ok {
+			continue
+		}
+		if t := ts.targets[a]; t != nil && ts.listedElsewhere(a) {
+			t.setLabels(ts.labels(a))
+			continue
+		}
+		if t := ts.targets[a]; t != nil {
+			// Kept so the target picks up where it left off if a source
+			// lists it again, and so -state-file still saves it.
+			ts.saved[a] = t.Stats.record()
+		}
+		delete(ts.targets, a)
+		removed = append(removed, a)
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	return added, removed
+}
+
+// ListedBy reports whether a source other than those in except lists
+// address. Sources that only annotate targets use it to let go of the ones
+// the real sources dropped.
+func (ts *TargetSet) ListedBy(address string, except ...string) bool {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	for name, listed := range ts.sources {
+		if _, ok := listed[address]; ok && !contains(except, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (ts *TargetSet) listedElsewhere(address string) bool {
+	for _, listed := range ts.sources {
+		if _, ok := listed[address]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// labels merges the set-wide labels with those every source gives address.
+// Sources are applied in name order, so the outcome doesn't depend on which
+// one synced last.
+func (ts *TargetSet) labels(address string) map[string]string {
+	names := make([]string, 0, len(ts.sources))
+	for name := range ts.sources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	merged := make(map[string]string, len(ts.Labels))
+	for k, v := range ts.Labels {
+		merged[k] = v
+	}
+	for _, name := range names {
+		for k, v := range ts.sources[name][address].Labels {
+			merged[k] = v
+		}
+	}
+	return merged
+}
+
+// List returns the current targets, ordered by address.
+func (ts *TargetSet) List() []*Target {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	list := make([]*Target, 0, len(ts.targets))
+	for _, t := range ts.targets {
+		list = append(list, t)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Address < list[j].Address })
+	return list
+}
+
+// Len returns the number of targets.
+func (ts *TargetSet) Len() int {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	return len(ts.targets)
+}
+
+// MarkRound records that a full round of probes has completed.
+func (ts *TargetSet) MarkRound() {
+	ts.mu.Lock()
+	ts.lastRound = time.Now()
+	ts.mu.Unlock()
+}
+
+// LastRound returns when the last full round of probes completed.
+func (ts *TargetSet) LastRound() time.Time {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	return ts.lastRound
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSyncKeepsRemovedStats(t *testing.T) {
+	set := NewTargetSet()
+	set.Sync("dns", []TargetSpec{{Address: "192.0.2.1"}, {Address: "192.0.2.2"}})
+	for _, target := range set.List() {
+		target.Stats.Record(time.Millisecond, nil)
+	}
+
+	added, removed := set.Sync("dns", []TargetSpec{{Address: "192.0.2.2"}})
+	if len(added) != 0 || !reflect.DeepEqual(removed, []string{"192.0.2.1"}) {
+		t.Errorf("removing: got added %v, removed %v", added, removed)
+	}
+	if r := set.saved["192.0.2.1"]; r == nil || r.Sent != 1 {
+		t.Errorf("removed target's stats not kept: %+v", r)
+	}
+
+	added, removed = set.Sync("dns", []TargetSpec{{Address: "192.0.2.1"}, {Address: "192.0.2.2"}})
+	if !reflect.DeepEqual(added, []string{"192.0.2.1"}) || len(removed) != 0 {
+		t.Errorf("adding back: got added %v, removed %v", added, removed)
+	}
+	for _, target := range set.List() {
+		if s := target.Stats.Snapshot(); s.Sent != 1 || s.Received != 1 {
+			t.Errorf("%s: %d sent, %d received, want 1 and 1", target.Address, s.Sent, s.Received)
+		}
+	}
+	if len(set.saved) != 0 {
+		t.Errorf("restored stats still saved: %v", set.saved)
+	}
+}
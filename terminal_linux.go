@@ -0,0 +1,29 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// makeRaw puts the terminal on fd into raw mode, so the line editor sees
+// every key as it is pressed, and returns a function that restores the
+// previous mode. Output processing stays on, so "\n" still starts a new line.
+func makeRaw(fd int) (func(), error) {
+	old, error := unix.IoctlGetTermios(fd, unix.TCGETS)
+	if error != nil {
+		return nil, error
+	}
+	raw := *old
+	raw.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP | unix.INLCR | unix.IGNCR | unix.ICRNL | unix.IXON
+	raw.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
+	raw.Cflag &^= unix.CSIZE | unix.PARENB
+	raw.Cflag |= unix.CS8
+	raw.Cc[unix.VMIN] = 1
+	raw.Cc[unix.VTIME] = 0
+	if error := unix.IoctlSetTermios(fd, unix.TCSETS, &raw); error != nil {
+		return nil, error
+	}
+	return func() { unix.IoctlSetTermios(fd, unix.TCSETS, old) }, nil
+}
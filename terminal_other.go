@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"fmt"
+)
+
+func makeRaw(fd int) (func(), error) {
+	return nil, fmt.Errorf("line editing is only supported on Linux")
+}